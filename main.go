@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
@@ -27,7 +32,36 @@ func main() {
 	zap.ReplaceGlobals(log)
 	log.Info("logger initialized")
 
-	if err := run(log); err != nil {
+	// -------------------------------------------------------------------------
+	// Run the requested command, serving by default
+
+	cmd, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		cmd, args = os.Args[1], os.Args[2:]
+	}
+
+	switch cmd {
+	case "serve":
+		err = run(log)
+	case "recompute":
+		err = runRecompute(log, args)
+	case "migrate":
+		err = runMigrate(log, args)
+	case "restore":
+		err = runRestore(log, args)
+	case "export":
+		err = runExport(log, args)
+	case "import":
+		err = runImport(log, args)
+	case "coverage":
+		err = runCoverage(log, args)
+	case "backfill-muscles":
+		err = runBackfillMuscles(log, args)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+
+	if err != nil {
 		log.Sugar().Fatalf("error running application: %v", err)
 	}
 }
@@ -45,21 +79,105 @@ func run(log *zap.Logger) error {
 	// Initialize the database
 	log.Info("initializing database")
 
-	dbPath := os.Getenv("DB_PATH")
-	if dbPath == "" {
-		dbPath = "./worm-tracker.sqlite" // Fallback for local
+	store, err := src.OpenStore(log)
+	if err != nil {
+		return err
 	}
-	log.Info("using database path", zap.String("path", dbPath))
+	defer store.Close()
+
+	// -------------------------------------------------------------------------
+	// Initialize the locomotion model
+	log.Info("initializing locomotion model")
 
-	db, err := src.NewDBManager(dbPath)
+	locomotion, err := src.LocomotionConfigFromEnv()
 	if err != nil {
-		return fmt.Errorf("error initializing database: %w", err)
+		return err
+	}
+
+	model, err := src.NewLocomotionModel(locomotion)
+	if err != nil {
+		return fmt.Errorf("error initializing locomotion model: %w", err)
 	}
-	defer db.Close()
 
-	cleanSlate := os.Getenv("CLEAN_SLATE") == "true"
-	if err := db.Initialize(cleanSlate); err != nil {
-		return fmt.Errorf("error creating positions table: %w", err)
+	// -------------------------------------------------------------------------
+	// Initialize the arena
+	log.Info("initializing arena")
+
+	arena, err := src.ArenaFromEnv()
+	if err != nil {
+		return err
+	}
+
+	recomputer := src.NewRecomputer(log, store, locomotion, arena)
+
+	// -------------------------------------------------------------------------
+	// Initialize the snapshots
+	log.Info("initializing snapshots")
+
+	snapshotConfig, err := src.SnapshotConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	snapshotter, err := src.NewSnapshotter(log, store, snapshotConfig)
+	if err != nil {
+		return fmt.Errorf("error initializing snapshots: %w", err)
+	}
+	if snapshotter != nil {
+		go snapshotter.Run(context.Background())
+	}
+
+	// -------------------------------------------------------------------------
+	// Initialize the retention
+	log.Info("initializing retention")
+
+	retentionConfig, err := src.RetentionConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	retention, err := src.NewRetention(log, store, retentionConfig)
+	if err != nil {
+		return fmt.Errorf("error initializing retention: %w", err)
+	}
+	if retention != nil {
+		go retention.Run(context.Background())
+	}
+
+	// -------------------------------------------------------------------------
+	// Initialize the anomaly detector
+	log.Info("initializing anomaly detector")
+
+	anomalies, err := src.AnomalyConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	detector, err := src.NewAnomalyDetector(anomalies)
+	if err != nil {
+		return fmt.Errorf("error initializing anomaly detector: %w", err)
+	}
+
+	importer, err := src.NewImporter(log, store, locomotion, arena, anomalies)
+	if err != nil {
+		return fmt.Errorf("error initializing importer: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+	// Initialize the block range repairs
+	log.Info("initializing block range repairs")
+
+	repairConfig, err := src.RepairConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	repairer, err := src.NewRepairer(log, store, repairConfig, anomalies)
+	if err != nil {
+		return fmt.Errorf("error initializing block range repairs: %w", err)
+	}
+	if repairer != nil {
+		go repairer.Run(context.Background())
 	}
 
 	// -------------------------------------------------------------------------
@@ -78,7 +196,18 @@ func run(log *zap.Logger) error {
 	}
 
 	go func() {
-		if err := src.Run(log, fetcher, db); err != nil {
+		deps := src.WormDeps{
+			Fetcher:    fetcher,
+			Store:      store,
+			Model:      model,
+			Arena:      arena,
+			Detector:   detector,
+			Recomputer: recomputer,
+			Importer:   importer,
+			Repairer:   repairer,
+			Retention:  retention,
+		}
+		if err := src.Run(log, deps); err != nil {
 			log.Error("error running worm", zap.Error(err))
 		}
 	}()
@@ -87,7 +216,13 @@ func run(log *zap.Logger) error {
 	// Start the server
 	log.Info("starting server")
 
-	server := src.NewServer(log, "8080", db)
+	server := src.NewServer(log, src.ServerConfigFromEnv(), src.ServerDeps{
+		Store:       store,
+		Arena:       arena,
+		Recomputer:  recomputer,
+		Importer:    importer,
+		Snapshotter: snapshotter,
+	})
 	go func() {
 		if err := server.Start(); err != nil {
 			serverErr <- err
@@ -100,3 +235,431 @@ func run(log *zap.Logger) error {
 
 	return nil
 }
+
+// runRecompute replays the stored muscle inputs into a new trajectory version.
+// It must not run while the tracker is serving from the same database, use the
+// admin endpoint for that instead.
+func runRecompute(log *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("recompute", flag.ContinueOnError)
+	modelName := fs.String("model", "", "locomotion model, defaults to LOCOMOTION_MODEL")
+	wheelbase := fs.Float64("wheelbase", 0, "differential drive wheelbase, defaults to LOCOMOTION_WHEELBASE")
+	gain := fs.Float64("gain", 0, "differential drive gain, defaults to LOCOMOTION_GAIN")
+	activate := fs.Bool("activate", true, "make the new trajectory the active one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := src.OpenDatabase(log)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	locomotion, err := src.LocomotionConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	arena, err := src.ArenaFromEnv()
+	if err != nil {
+		return err
+	}
+
+	cfg := src.LocomotionConfig{Model: *modelName, Wheelbase: *wheelbase, Gain: *gain}
+	if cfg.Model != "" {
+		if cfg.Wheelbase == 0 {
+			cfg.Wheelbase = locomotion.Wheelbase
+		}
+		if cfg.Gain == 0 {
+			cfg.Gain = locomotion.Gain
+		}
+	}
+
+	recomputer := src.NewRecomputer(log, db, locomotion, arena)
+	t, err := recomputer.Recompute(context.Background(), cfg, *activate)
+	if err != nil {
+		return fmt.Errorf("error recomputing trajectory: %w", err)
+	}
+
+	log.Info("trajectory recomputed", zap.Int("version", t.Version), zap.String("status", t.Status))
+	return nil
+}
+
+// runMigrate moves the database schema with `migrate up [version]`, `migrate
+// down [version]` or shows it with `migrate status`. Up defaults to the latest
+// migration and down to the one before the current, down 0 empties the
+// database.
+func runMigrate(log *zap.Logger, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: migrate up|down|status [version]")
+	}
+
+	version := -1
+	if len(args) == 2 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		version = v
+	}
+
+	db, err := src.ConnectDatabase(log)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		if version == -1 {
+			version = 0
+		}
+		return db.MigrateUp(log, version)
+	case "down":
+		if version == -1 {
+			for _, s := range statuses {
+				if s.AppliedAt != nil {
+					version = s.Version - 1
+				}
+			}
+			if version == -1 {
+				return nil
+			}
+		}
+		return db.MigrateDown(log, version)
+	case "status":
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-24s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// runRestore swaps a snapshot from SNAPSHOT_DIR in for the database with
+// `restore [snapshot]`, the latest snapshot by default, or lists the snapshots
+// with `restore -list`. It must not run while the tracker is serving from the
+// same database.
+func runRestore(log *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	list := fs.Bool("list", false, "list the snapshots instead of restoring one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: restore [-list] [snapshot]")
+	}
+
+	cfg, err := src.SnapshotConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if cfg.Dir == "" {
+		return fmt.Errorf("SNAPSHOT_DIR is not set")
+	}
+
+	if *list {
+		snapshots, err := src.ListSnapshots(cfg.Dir)
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			fmt.Printf("%s  %10d bytes  schema %d  latest id %d  block %d\n", s.File, s.Size, s.SchemaVersion, s.LatestID, s.LatestBlock)
+		}
+		return nil
+	}
+
+	return src.RestoreSnapshot(log, cfg.Dir, fs.Arg(0))
+}
+
+// runExport writes the positions between -from and -to to a file in -format.
+// It only reads the database, so it can run while the tracker is serving.
+func runExport(log *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "csv, ndjson or geojson")
+	fromStr := fs.String("from", "", "export positions from this time, RFC 3339 or UNIX seconds")
+	toStr := fs.String("to", "", "export positions up to this time, RFC 3339 or UNIX seconds")
+	version := fs.Int("version", 0, "trajectory version, defaults to the active one")
+	out := fs.String("o", "", "output file, defaults to worm-positions.<format>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ext, err := src.ExportFormatExtension(*format)
+	if err != nil {
+		return err
+	}
+	from, err := src.ParseTime(*fromStr)
+	if err != nil {
+		return fmt.Errorf("invalid from %q", *fromStr)
+	}
+	to, err := src.ParseTime(*toStr)
+	if err != nil {
+		return fmt.Errorf("invalid to %q", *toStr)
+	}
+	if *out == "" {
+		*out = "worm-positions" + ext
+	}
+
+	db, err := src.ConnectDatabase(log)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The export is written next to the output and only moved into place
+	// once it's complete
+	f, err := os.CreateTemp(filepath.Dir(*out), filepath.Base(*out)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating export file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(0o644); err != nil {
+		return fmt.Errorf("error creating export file: %w", err)
+	}
+
+	summary, err := db.Export(context.Background(), f, *format, from, to, *version)
+	if err != nil {
+		return fmt.Errorf("error exporting positions: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing export file: %w", err)
+	}
+	if err := os.Rename(f.Name(), *out); err != nil {
+		return fmt.Errorf("error moving export file into place: %w", err)
+	}
+
+	// The summary carries the checkpoint an import resumes ingestion from
+	if err := src.WriteExportSummary(*out, summary); err != nil {
+		return err
+	}
+
+	log.Info("positions exported",
+		zap.Int("positions", summary.Positions),
+		zap.Int("checkpoint", summary.Checkpoint),
+		zap.String("file", *out),
+	)
+	return nil
+}
+
+// runImport seeds an empty database with `import [-format] [-checkpoint] file`,
+// an export of another instance or an archive of raw contract logs. Ingestion
+// resumes after -checkpoint, which defaults to the one in the summary written
+// next to the export. It must not run while the tracker is serving from the
+// same database, use the admin endpoint for that instead.
+func runImport(log *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "ndjson, csv or logs, inferred from the file extension by default")
+	checkpoint := fs.Int("checkpoint", 0, "latest block checked, defaults to the export summary or the last imported block")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [-format=ndjson|csv|logs] [-checkpoint=block] file")
+	}
+	path := fs.Arg(0)
+
+	opts := src.ImportOptions{Format: *format, Checkpoint: *checkpoint}
+	if opts.Format == "" {
+		f, err := src.ImportFormatFromExtension(path)
+		if err != nil {
+			return err
+		}
+		opts.Format = f
+	}
+
+	summary, err := src.ReadExportSummary(path)
+	if err != nil {
+		return err
+	}
+	if summary != nil {
+		opts.Positions = summary.Positions
+		if opts.Checkpoint == 0 {
+			opts.Checkpoint = summary.Checkpoint
+		}
+	} else if opts.Checkpoint == 0 {
+		log.Warn("no export summary or checkpoint given, ingestion resumes after the last imported block")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening import file: %w", err)
+	}
+	defer f.Close()
+
+	db, err := src.OpenDatabase(log)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	locomotion, err := src.LocomotionConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	arena, err := src.ArenaFromEnv()
+	if err != nil {
+		return err
+	}
+	anomalies, err := src.AnomalyConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	importer, err := src.NewImporter(log, db, locomotion, arena, anomalies)
+	if err != nil {
+		return fmt.Errorf("error initializing importer: %w", err)
+	}
+	result, err := importer.Import(context.Background(), f, opts)
+	if err != nil {
+		return fmt.Errorf("error importing positions: %w", err)
+	}
+
+	log.Info("positions imported",
+		zap.Int("positions", result.Positions),
+		zap.Int("skipped_logs", result.Skipped),
+		zap.Int("last_block", result.LastBlock),
+		zap.Int("checkpoint", result.Checkpoint),
+	)
+	return nil
+}
+
+// runCoverage lists the gaps in the ledger of block ranges with `coverage`, the
+// whole ledger with `coverage -ranges` or the repairs of the gaps with
+// `coverage -repairs`. It only reads the database, so it can run while the
+// tracker is serving.
+func runCoverage(log *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("coverage", flag.ContinueOnError)
+	ranges := fs.Bool("ranges", false, "list every block range instead of the gaps")
+	repairs := fs.Bool("repairs", false, "list the repairs of the gaps instead of the gaps")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 || *ranges && *repairs {
+		return fmt.Errorf("usage: coverage [-ranges | -repairs]")
+	}
+
+	db, err := src.ConnectDatabase(log)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *repairs {
+		rs, err := db.FetchRepairs("")
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			next := "-"
+			if r.NextAttemptAt != nil {
+				next = r.NextAttemptAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%10d-%-10d  %-10s %3d attempts  %6d recovered  next %s  %s\n", r.From, r.To, r.Status, r.Attempts, r.Recovered, next, r.Error)
+		}
+		return nil
+	}
+
+	c, err := src.Coverage(db)
+	if err != nil {
+		return err
+	}
+
+	if *ranges {
+		for _, r := range c.Ranges {
+			fmt.Printf("%10d-%-10d  %-15s %s  %s\n", r.From, r.To, r.Status, r.UpdatedAt.Format(time.RFC3339), r.Error)
+		}
+		return nil
+	}
+	for _, g := range c.Gaps {
+		fmt.Printf("%10d-%-10d  %8d blocks  %-15s %s\n", g.From, g.To, g.Blocks, g.Status, g.Error)
+	}
+	fmt.Printf("checkpoint %d, %d gaps\n", c.Checkpoint, len(c.Gaps))
+	return nil
+}
+
+// runBackfillMuscles recovers the muscles of positions stored without them
+// from an archive of raw contract logs with `backfill-muscles -logs=file`,
+// shows how far the chain backfill got with `backfill-muscles -status` or
+// makes the abandoned transactions due again with `backfill-muscles -retry`.
+func runBackfillMuscles(log *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("backfill-muscles", flag.ContinueOnError)
+	logs := fs.String("logs", "", "archive of raw contract logs, a JSON array or one log per line")
+	status := fs.Bool("status", false, "show the progress and the transactions that couldn't be recovered")
+	retry := fs.Bool("retry", false, "retry the abandoned transactions from the next start")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	modes := 0
+	for _, set := range []bool{*logs != "", *status, *retry} {
+		if set {
+			modes++
+		}
+	}
+	if fs.NArg() > 0 || modes != 1 {
+		return fmt.Errorf("usage: backfill-muscles -logs=file | -status | -retry")
+	}
+
+	db, err := src.OpenDatabase(log)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch {
+	case *status:
+		s, err := db.MuscleBackfillStatus()
+		if err != nil {
+			return err
+		}
+		for _, f := range s.Failures {
+			next := "-"
+			if f.NextAttemptAt != nil {
+				next = f.NextAttemptAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s  %-10s %3d positions  %3d updates  %3d attempts  next %s  %s\n", f.TransactionHash, f.Status, f.Positions, f.Updates, f.Attempts, next, f.Error)
+		}
+		fmt.Printf("looked at positions up to %d, %d missing muscles, %d transactions not recovered\n", s.LastID, s.Missing, len(s.Failures))
+		return nil
+	case *retry:
+		n, err := db.RetryMuscleBackfill()
+		if err != nil {
+			return err
+		}
+		log.Info("abandoned transactions retried from the next start", zap.Int("transactions", n))
+		return nil
+	}
+
+	f, err := os.Open(*logs)
+	if err != nil {
+		return fmt.Errorf("error opening log archive: %w", err)
+	}
+	defer f.Close()
+
+	archive, err := src.ReadLogArchive(f)
+	if err != nil {
+		return fmt.Errorf("error reading log archive: %w", err)
+	}
+	result, err := db.BackfillMusclesFromArchive(context.Background(), log, archive)
+	if err != nil {
+		return fmt.Errorf("error backfilling muscles: %w", err)
+	}
+
+	log.Info("muscles backfilled from the log archive",
+		zap.Int("recovered", result.Recovered),
+		zap.Int("unmatched", result.Unmatched),
+	)
+	return nil
+}
@@ -0,0 +1,541 @@
+package src
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// maxTrackPoints caps how many positions an analysis loads into memory. Longer
+// ranges are analysed over their most recent positions.
+const maxTrackPoints = 200000
+
+// trackPoint is the subset of a position the analytics work with.
+type trackPoint struct {
+	ID            int
+	Timestamp     time.Time
+	X             float64
+	Y             float64
+	Direction     float64
+	Price         float64
+	LeftMuscle    int64
+	RightMuscle   int64
+	HasMuscles    bool
+	StepLength    float64
+	HeadingChange float64
+	Behaviour     string // empty when unlabelled
+}
+
+// track is a run of consecutive positions.
+type track struct {
+	points    []trackPoint
+	truncated bool // whether older positions in the range were left out
+}
+
+// fetchTrack loads the positions between from and to, in order. A zero from or
+// to leaves that end of the range open.
+func (db *dbManager) fetchTrack(from, to time.Time) (track, error) {
+	const q = /* sql */ `
+		SELECT
+			id, ts, x, y, direction, price, left_muscle, right_muscle,
+			COALESCE(step_length, 0), COALESCE(heading_change, 0), COALESCE(behaviour, '')
+		FROM positions
+		WHERE (?1 IS NULL OR ts >= ?1)
+		AND (?2 IS NULL OR ts <= ?2)
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT ?3;
+	`
+
+	rows, err := db.reader.Query(q, nullTime(from), nullTime(to), maxTrackPoints+1)
+	if err != nil {
+		return track{}, fmt.Errorf("error fetching track: %w", err)
+	}
+	defer rows.Close()
+
+	points := make([]trackPoint, 0)
+	for rows.Next() {
+		var (
+			p           trackPoint
+			left, right sql.NullInt64
+		)
+		if err := rows.Scan(
+			&p.ID,
+			&p.Timestamp,
+			&p.X,
+			&p.Y,
+			&p.Direction,
+			&p.Price,
+			&left,
+			&right,
+			&p.StepLength,
+			&p.HeadingChange,
+			&p.Behaviour,
+		); err != nil {
+			return track{}, fmt.Errorf("error scanning track point: %w", err)
+		}
+		p.LeftMuscle, p.RightMuscle = left.Int64, right.Int64
+		p.HasMuscles = left.Valid && right.Valid
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return track{}, fmt.Errorf("error iterating track: %w", err)
+	}
+
+	t := track{points: points}
+	if len(t.points) > maxTrackPoints {
+		t.points, t.truncated = t.points[:maxTrackPoints], true
+	}
+
+	// The query reads the newest positions first so that truncation keeps the
+	// most recent ones, put them back in order
+	for i, j := 0, len(t.points)-1; i < j; i, j = i+1, j-1 {
+		t.points[i], t.points[j] = t.points[j], t.points[i]
+	}
+
+	return t, nil
+}
+
+// -----------------------------------------------------------------------------
+// Locomotion
+
+type locomotionParams struct {
+	from   time.Time
+	to     time.Time
+	window int // moves per straightness window
+	maxLag int // largest lag, in moves, of the mean squared displacement
+	bins   int // number of turning angle bins
+}
+
+type locomotionStats struct {
+	From          *time.Time        `json:"from"`
+	To            *time.Time        `json:"to"`
+	Points        int               `json:"points"`
+	Truncated     bool              `json:"truncated"`
+	MSD           []msdPoint        `json:"msd"`
+	Diffusion     diffusionEstimate `json:"diffusion"`
+	Straightness  straightnessStats `json:"straightness"`
+	TurningAngles turningAngleStats `json:"turningAngles"`
+}
+
+// msdPoint is the mean squared displacement over all pairs of positions lag
+// moves apart, along with the mean time between them.
+type msdPoint struct {
+	Lag     int     `json:"lag"`
+	Seconds float64 `json:"seconds"`
+	MSD     float64 `json:"msd"`
+	Pairs   int     `json:"pairs"`
+}
+
+// diffusionEstimate fits the mean squared displacement to 4Dt, the 2d
+// diffusion law, and to the power law t^alpha. An exponent of 1 is normal
+// diffusion, above 1 the worm moves more ballistically.
+type diffusionEstimate struct {
+	Coefficient float64 `json:"coefficient"` // D in units^2 per second
+	Exponent    float64 `json:"exponent"`    // alpha
+}
+
+type straightnessStats struct {
+	Window         int                  `json:"window"`
+	Mean           float64              `json:"mean"`
+	MeanTortuosity float64              `json:"meanTortuosity"`
+	Windows        []straightnessWindow `json:"windows"`
+}
+
+// straightnessWindow compares the net displacement over a window of moves to
+// the path travelled. Straightness is 1 for a straight line and tends to 0 for
+// a convoluted path, tortuosity is its inverse and is 0 when the worm ended
+// where it started.
+type straightnessWindow struct {
+	FromID       int       `json:"fromId"`
+	ToID         int       `json:"toId"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Straightness float64   `json:"straightness"`
+	Tortuosity   float64   `json:"tortuosity"`
+}
+
+// turningAngleStats is the distribution of heading changes. The mean is the
+// circular mean and the resultant length measures how concentrated the turns
+// are, from 0 (uniform) to 1 (always the same turn).
+type turningAngleStats struct {
+	BinWidth        float64           `json:"binWidth"`
+	Bins            []turningAngleBin `json:"bins"`
+	Mean            float64           `json:"mean"`
+	ResultantLength float64           `json:"resultantLength"`
+}
+
+type turningAngleBin struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Count int     `json:"count"`
+}
+
+func analyzeLocomotion(t track, params locomotionParams) locomotionStats {
+	stats := locomotionStats{
+		Points:        len(t.points),
+		Truncated:     t.truncated,
+		MSD:           meanSquaredDisplacement(t.points, params.maxLag),
+		Straightness:  straightness(t.points, params.window),
+		TurningAngles: turningAngles(t.points, params.bins),
+	}
+	if len(t.points) > 0 {
+		stats.From, stats.To = &t.points[0].Timestamp, &t.points[len(t.points)-1].Timestamp
+	}
+	stats.Diffusion = estimateDiffusion(stats.MSD)
+
+	return stats
+}
+
+func meanSquaredDisplacement(points []trackPoint, maxLag int) []msdPoint {
+	msd := make([]msdPoint, 0, maxLag)
+	for lag := 1; lag <= maxLag && lag < len(points); lag++ {
+		var sum, seconds float64
+		pairs := len(points) - lag
+		for i := 0; i < pairs; i++ {
+			a, b := points[i], points[i+lag]
+			dx, dy := b.X-a.X, b.Y-a.Y
+			sum += dx*dx + dy*dy
+			seconds += b.Timestamp.Sub(a.Timestamp).Seconds()
+		}
+		msd = append(msd, msdPoint{
+			Lag:     lag,
+			Seconds: seconds / float64(pairs),
+			MSD:     sum / float64(pairs),
+			Pairs:   pairs,
+		})
+	}
+	return msd
+}
+
+func estimateDiffusion(msd []msdPoint) diffusionEstimate {
+	var ts, ms, logTs, logMs []float64
+	for _, p := range msd {
+		if p.Seconds <= 0 {
+			continue
+		}
+		ts = append(ts, p.Seconds)
+		ms = append(ms, p.MSD)
+		if p.MSD > 0 {
+			logTs = append(logTs, math.Log(p.Seconds))
+			logMs = append(logMs, math.Log(p.MSD))
+		}
+	}
+
+	var d diffusionEstimate
+	if slope, _, ok := linearFit(ts, ms); ok {
+		d.Coefficient = slope / 4
+	}
+	if slope, _, ok := linearFit(logTs, logMs); ok {
+		d.Exponent = slope
+	}
+	return d
+}
+
+func straightness(points []trackPoint, window int) straightnessStats {
+	stats := straightnessStats{Window: window, Windows: make([]straightnessWindow, 0)}
+	if window < 1 {
+		return stats
+	}
+
+	// Windows slide by half their length so that every move is covered twice
+	step := window / 2
+	if step < 1 {
+		step = 1
+	}
+
+	var sumS, sumT float64
+	var nT int
+	for i := 0; i+window < len(points); i += step {
+		a, b := points[i], points[i+window]
+
+		var path float64
+		for _, p := range points[i+1 : i+window+1] {
+			path += p.StepLength
+		}
+		net := math.Hypot(b.X-a.X, b.Y-a.Y)
+
+		w := straightnessWindow{FromID: a.ID, ToID: b.ID, From: a.Timestamp, To: b.Timestamp}
+		if path > 0 {
+			w.Straightness = net / path
+		}
+		if net > 0 {
+			w.Tortuosity = path / net
+			sumT += w.Tortuosity
+			nT++
+		}
+		sumS += w.Straightness
+		stats.Windows = append(stats.Windows, w)
+	}
+
+	if len(stats.Windows) > 0 {
+		stats.Mean = sumS / float64(len(stats.Windows))
+	}
+	if nT > 0 {
+		stats.MeanTortuosity = sumT / float64(nT)
+	}
+	return stats
+}
+
+func turningAngles(points []trackPoint, bins int) turningAngleStats {
+	stats := turningAngleStats{BinWidth: 360 / float64(bins), Bins: make([]turningAngleBin, bins)}
+	for i := range stats.Bins {
+		stats.Bins[i].From = -180 + float64(i)*stats.BinWidth
+		stats.Bins[i].To = stats.Bins[i].From + stats.BinWidth
+	}
+
+	var sumSin, sumCos float64
+	var n int
+	for i, p := range points {
+		// the first move of a range turned from a position outside of it
+		if i == 0 {
+			continue
+		}
+		a := p.HeadingChange
+		bin := int((a + 180) / stats.BinWidth)
+		if bin >= bins {
+			bin = bins - 1
+		} else if bin < 0 {
+			bin = 0
+		}
+		stats.Bins[bin].Count++
+
+		sumSin += math.Sin(a * math.Pi / 180)
+		sumCos += math.Cos(a * math.Pi / 180)
+		n++
+	}
+
+	if n > 0 {
+		stats.Mean = math.Atan2(sumSin, sumCos) * 180 / math.Pi
+		stats.ResultantLength = math.Hypot(sumSin, sumCos) / float64(n)
+	}
+	return stats
+}
+
+// linearFit returns the least squares slope and intercept of y against x. It
+// reports false when there are fewer than two distinct x values.
+func linearFit(x, y []float64) (float64, float64, bool) {
+	n := float64(len(x))
+	if len(x) < 2 {
+		return 0, 0, false
+	}
+
+	var sx, sy, sxx, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		sxy += x[i] * y[i]
+	}
+
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return 0, 0, false
+	}
+	slope := (n*sxy - sx*sy) / den
+	return slope, (sy - slope*sx) / n, true
+}
+
+// -----------------------------------------------------------------------------
+// Price
+
+// priceSeries are the movement series the price returns are correlated with.
+var priceSeries = []string{"muscleAsymmetry", "stepLength", "headingChange"}
+
+type priceParams struct {
+	from   time.Time
+	to     time.Time
+	window int // moves per rolling window
+	maxLag int // largest lag, in moves, in either direction
+	lag    int // lag of the rolling windows
+}
+
+type priceStats struct {
+	From         *time.Time                      `json:"from"`
+	To           *time.Time                      `json:"to"`
+	Points       int                             `json:"points"`
+	Truncated    bool                            `json:"truncated"`
+	Correlations map[string][]priceCorrelation   `json:"correlations"`
+	Rolling      map[string][]priceRollingWindow `json:"rolling"`
+}
+
+// priceCorrelation correlates the price return of each update with the
+// movement lag moves later. A positive lag has the movement follow the price,
+// a negative one has it lead. Coefficients are null when either series is
+// constant over the pairs.
+type priceCorrelation struct {
+	Lag      int      `json:"lag"`
+	Pearson  *float64 `json:"pearson"`
+	Spearman *float64 `json:"spearman"`
+	Pairs    int      `json:"pairs"`
+}
+
+// priceRollingWindow is the correlation over a window of moves, windows slide
+// by half their length.
+type priceRollingWindow struct {
+	FromID   int       `json:"fromId"`
+	ToID     int       `json:"toId"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Pearson  *float64  `json:"pearson"`
+	Spearman *float64  `json:"spearman"`
+	Pairs    int       `json:"pairs"`
+}
+
+func analyzePrice(t track, params priceParams) priceStats {
+	stats := priceStats{
+		Points:       len(t.points),
+		Truncated:    t.truncated,
+		Correlations: make(map[string][]priceCorrelation),
+		Rolling:      make(map[string][]priceRollingWindow),
+	}
+	if len(t.points) > 0 {
+		stats.From, stats.To = &t.points[0].Timestamp, &t.points[len(t.points)-1].Timestamp
+	}
+
+	returns := priceReturns(t.points)
+	for _, name := range priceSeries {
+		movement := movementSeries(t.points, name)
+
+		correlations := make([]priceCorrelation, 0, 2*params.maxLag+1)
+		for lag := -params.maxLag; lag <= params.maxLag; lag++ {
+			x, y := lagPairs(returns, movement, lag, 0, len(t.points))
+			c := priceCorrelation{Lag: lag, Pairs: len(x)}
+			c.Pearson, c.Spearman = correlate(x, y)
+			correlations = append(correlations, c)
+		}
+		stats.Correlations[name] = correlations
+
+		step := params.window / 2
+		if step < 1 {
+			step = 1
+		}
+		rolling := make([]priceRollingWindow, 0)
+		for i := 0; i+params.window <= len(t.points); i += step {
+			a, b := t.points[i], t.points[i+params.window-1]
+			x, y := lagPairs(returns, movement, params.lag, i, i+params.window)
+			w := priceRollingWindow{FromID: a.ID, ToID: b.ID, From: a.Timestamp, To: b.Timestamp, Pairs: len(x)}
+			w.Pearson, w.Spearman = correlate(x, y)
+			rolling = append(rolling, w)
+		}
+		stats.Rolling[name] = rolling
+	}
+
+	return stats
+}
+
+// priceReturns returns the log return of the price at each point, NaN where
+// it's unknown: at the first point and wherever a price isn't positive.
+func priceReturns(points []trackPoint) []float64 {
+	returns := make([]float64, len(points))
+	for i, p := range points {
+		returns[i] = math.NaN()
+		if i > 0 && p.Price > 0 && points[i-1].Price > 0 {
+			returns[i] = math.Log(p.Price / points[i-1].Price)
+		}
+	}
+	return returns
+}
+
+// movementSeries returns one of the priceSeries at each point, NaN where it's
+// unknown.
+func movementSeries(points []trackPoint, name string) []float64 {
+	series := make([]float64, len(points))
+	for i, p := range points {
+		switch name {
+		case "muscleAsymmetry":
+			series[i] = math.NaN()
+			if p.HasMuscles {
+				series[i] = float64(p.RightMuscle - p.LeftMuscle)
+			}
+		case "stepLength":
+			series[i] = p.StepLength
+		case "headingChange":
+			series[i] = p.HeadingChange
+		}
+	}
+	return series
+}
+
+// lagPairs pairs the return at each point in [from, to) with the movement lag
+// points later, also within [from, to), leaving out unknown values.
+func lagPairs(returns, movement []float64, lag, from, to int) ([]float64, []float64) {
+	var x, y []float64
+	for i := from; i < to; i++ {
+		j := i + lag
+		if j < from || j >= to {
+			continue
+		}
+		if math.IsNaN(returns[i]) || math.IsNaN(movement[j]) {
+			continue
+		}
+		x = append(x, returns[i])
+		y = append(y, movement[j])
+	}
+	return x, y
+}
+
+// correlate returns the Pearson and Spearman correlation coefficients of x and
+// y, nil when they're undefined.
+func correlate(x, y []float64) (*float64, *float64) {
+	var pearson, spearman *float64
+	if r, ok := pearsonCorrelation(x, y); ok {
+		pearson = &r
+	}
+	if r, ok := pearsonCorrelation(ranks(x), ranks(y)); ok {
+		spearman = &r
+	}
+	return pearson, spearman
+}
+
+// pearsonCorrelation reports false when there are fewer than two pairs or
+// either series is constant.
+func pearsonCorrelation(x, y []float64) (float64, bool) {
+	n := float64(len(x))
+	if len(x) < 2 {
+		return 0, false
+	}
+
+	var mx, my float64
+	for i := range x {
+		mx += x[i]
+		my += y[i]
+	}
+	mx, my = mx/n, my/n
+
+	var sxy, sxx, syy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return 0, false
+	}
+	return sxy / math.Sqrt(sxx*syy), true
+}
+
+// ranks returns the rank of each value, ties sharing the mean of their ranks.
+func ranks(v []float64) []float64 {
+	order := make([]int, len(v))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return v[order[a]] < v[order[b]] })
+
+	r := make([]float64, len(v))
+	for i := 0; i < len(order); {
+		j := i
+		for j+1 < len(order) && v[order[j+1]] == v[order[i]] {
+			j++
+		}
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			r[order[k]] = rank
+		}
+		i = j + 1
+	}
+	return r
+}
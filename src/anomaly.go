@@ -0,0 +1,227 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The data quality problems an ingested update can be flagged with.
+const (
+	anomalyMuscleRange        = "muscle_out_of_range" // a muscle outside the expected range
+	anomalyTimestampBackwards = "timestamp_backwards" // older than the previous update
+	anomalyTimestampRepeated  = "timestamp_repeated"  // as old as the previous update
+	anomalyLongGap            = "long_gap"            // long after the previous update
+	anomalyDuplicate          = "duplicate_in_block"  // the same update twice in a block
+	anomalyPriceJump          = "price_jump"          // a price return beyond the configured sigmas
+)
+
+var anomalyTypes = []string{
+	anomalyMuscleRange,
+	anomalyTimestampBackwards,
+	anomalyTimestampRepeated,
+	anomalyLongGap,
+	anomalyDuplicate,
+	anomalyPriceJump,
+}
+
+// minPriceReturns is the number of price returns needed before price jumps are
+// flagged.
+const minPriceReturns = 20
+
+var anomaliesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "worm_tracker_anomalies_total",
+		Help: "Ingested updates flagged with a data quality anomaly, by type.",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(anomaliesTotal)
+}
+
+// AnomalyConfig sets what the anomaly detector considers unusual.
+type AnomalyConfig struct {
+	MuscleMin   int64
+	MuscleMax   int64
+	MaxGap      time.Duration // 0 never flags gaps
+	PriceSigma  float64       // standard deviations of the recent returns a price may move by
+	PriceWindow int           // number of recent returns
+}
+
+// anomalyDetector flags data quality problems of updates as they are ingested.
+// It compares each update with the ones before it, so it must see them in
+// order.
+type anomalyDetector struct {
+	cfg AnomalyConfig
+
+	prev    *position
+	inBlock []position // the updates of the previous update's block
+
+	returns []float64 // ring of the recent log returns of the price
+	next    int
+}
+
+func NewAnomalyDetector(cfg AnomalyConfig) (*anomalyDetector, error) {
+	if cfg.MuscleMin > cfg.MuscleMax {
+		return nil, fmt.Errorf("invalid muscle range [%d, %d]", cfg.MuscleMin, cfg.MuscleMax)
+	}
+	if cfg.MaxGap < 0 {
+		return nil, fmt.Errorf("invalid max gap %v: must not be negative", cfg.MaxGap)
+	}
+	if cfg.PriceSigma <= 0 {
+		return nil, fmt.Errorf("invalid price sigma %v: must be positive", cfg.PriceSigma)
+	}
+	if cfg.PriceWindow < minPriceReturns {
+		return nil, fmt.Errorf("invalid price window %d: must be at least %d", cfg.PriceWindow, minPriceReturns)
+	}
+	return &anomalyDetector{cfg: cfg, returns: make([]float64, 0, cfg.PriceWindow)}, nil
+}
+
+// prime feeds the detector the latest stored updates so that the first update
+// ingested is compared with the history rather than with nothing.
+func (d *anomalyDetector) prime(store Store) error {
+	ps, err := store.RecentPositions(d.cfg.PriceWindow + 1)
+	if err != nil {
+		return fmt.Errorf("error fetching positions for anomaly detection: %w", err)
+	}
+	for _, p := range ps {
+		d.check(p)
+	}
+	return nil
+}
+
+// reset forgets every update the detector has seen, for when the stored
+// history changed under it.
+func (d *anomalyDetector) reset() {
+	d.prev, d.inBlock = nil, nil
+	d.returns, d.next = d.returns[:0], 0
+}
+
+// check returns the anomalies of an update, given in the order of ingestion.
+func (d *anomalyDetector) check(p position) []string {
+	var flags []string
+
+	if outOfRange := func(m *int64) bool {
+		return m != nil && (*m < d.cfg.MuscleMin || *m > d.cfg.MuscleMax)
+	}; outOfRange(p.LeftMuscle) || outOfRange(p.RightMuscle) {
+		flags = append(flags, anomalyMuscleRange)
+	}
+
+	if prev := d.prev; prev != nil {
+		switch gap := p.Timestamp.Sub(prev.Timestamp); {
+		case gap < 0:
+			flags = append(flags, anomalyTimestampBackwards)
+		case gap == 0:
+			flags = append(flags, anomalyTimestampRepeated)
+		case d.cfg.MaxGap > 0 && gap > d.cfg.MaxGap:
+			flags = append(flags, anomalyLongGap)
+		}
+
+		if p.Block != prev.Block {
+			d.inBlock = d.inBlock[:0]
+		}
+		for _, q := range d.inBlock {
+			if sameUpdate(p, q) {
+				flags = append(flags, anomalyDuplicate)
+				break
+			}
+		}
+
+		if prev.Price > 0 && p.Price > 0 {
+			r := math.Log(p.Price / prev.Price)
+			if mean, std := d.priceReturnStats(); len(d.returns) >= minPriceReturns && std > 0 && math.Abs(r-mean) > d.cfg.PriceSigma*std {
+				flags = append(flags, anomalyPriceJump)
+			}
+			d.addPriceReturn(r)
+		}
+	}
+
+	d.prev = &p
+	d.inBlock = append(d.inBlock, p)
+	return flags
+}
+
+// sameUpdate reports whether two updates carry the same values.
+func sameUpdate(a, b position) bool {
+	sameMuscle := func(x, y *int64) bool {
+		return (x == nil) == (y == nil) && (x == nil || *x == *y)
+	}
+	return a.Timestamp.Equal(b.Timestamp) &&
+		a.Price == b.Price &&
+		sameMuscle(a.LeftMuscle, b.LeftMuscle) &&
+		sameMuscle(a.RightMuscle, b.RightMuscle)
+}
+
+func (d *anomalyDetector) addPriceReturn(r float64) {
+	if len(d.returns) < d.cfg.PriceWindow {
+		d.returns = append(d.returns, r)
+		return
+	}
+	d.returns[d.next] = r
+	d.next = (d.next + 1) % d.cfg.PriceWindow
+}
+
+// priceReturnStats returns the mean and standard deviation of the recent price
+// returns.
+func (d *anomalyDetector) priceReturnStats() (float64, float64) {
+	if len(d.returns) < 2 {
+		return 0, 0
+	}
+	var sum float64
+	for _, r := range d.returns {
+		sum += r
+	}
+	mean := sum / float64(len(d.returns))
+	var ss float64
+	for _, r := range d.returns {
+		ss += (r - mean) * (r - mean)
+	}
+	return mean, math.Sqrt(ss / float64(len(d.returns)-1))
+}
+
+// countAnomalies adds the anomalies of a stored update to the metrics.
+func countAnomalies(flags []string) {
+	for _, f := range flags {
+		anomaliesTotal.WithLabelValues(f).Inc()
+	}
+}
+
+// joinAnomalies maps anomalies to their column value, NULL when there are
+// none.
+func joinAnomalies(flags []string) any {
+	if len(flags) == 0 {
+		return nil
+	}
+	return strings.Join(flags, ",")
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+// fetchAnomalies returns up to limit positions flagged with anomalies between
+// from and to, in order, only those flagged with kind when it is set.
+func (db *dbManager) fetchAnomalies(from, to time.Time, kind string, limit int) ([]position, error) {
+	const q = /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE anomalies IS NOT NULL
+		AND (?1 IS NULL OR ts >= ?1)
+		AND (?2 IS NULL OR ts <= ?2)
+		AND (?3 IS NULL OR ',' || anomalies || ',' LIKE '%,' || ?3 || ',%')
+		ORDER BY id ASC
+		LIMIT ?4;
+	`
+
+	rows, err := db.reader.Query(q, nullTime(from), nullTime(to), nullString(kind), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching anomalies: %w", err)
+	}
+	defer rows.Close()
+
+	return scanPositions(rows)
+}
@@ -0,0 +1,159 @@
+package src
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	ArenaUnbounded = "none"
+	ArenaRectangle = "rectangle"
+	ArenaCircle    = "circle"
+
+	BoundaryClamp   = "clamp"
+	BoundaryReflect = "reflect"
+	BoundaryWrap    = "wrap"
+)
+
+// ArenaConfig describes the area the worm is allowed to move in. Arenas are
+// centred on the origin, where the worm starts. Width and Height are only used
+// by rectangles and Radius only by circles.
+type ArenaConfig struct {
+	Shape    string  `json:"shape"`
+	Boundary string  `json:"boundary,omitempty"`
+	Width    float64 `json:"width,omitempty"`
+	Height   float64 `json:"height,omitempty"`
+	Radius   float64 `json:"radius,omitempty"`
+}
+
+type arena struct {
+	cfg ArenaConfig
+}
+
+func NewArena(cfg ArenaConfig) (*arena, error) {
+	if cfg.Shape == "" {
+		cfg.Shape = ArenaUnbounded
+	}
+
+	switch cfg.Shape {
+	case ArenaUnbounded:
+		return &arena{cfg: ArenaConfig{Shape: ArenaUnbounded}}, nil
+	case ArenaRectangle:
+		if cfg.Width <= 0 || cfg.Height <= 0 {
+			return nil, fmt.Errorf("invalid rectangle %vx%v: width and height must be positive", cfg.Width, cfg.Height)
+		}
+		cfg.Radius = 0
+	case ArenaCircle:
+		if cfg.Radius <= 0 {
+			return nil, fmt.Errorf("invalid circle radius %v: must be positive", cfg.Radius)
+		}
+		cfg.Width, cfg.Height = 0, 0
+	default:
+		return nil, fmt.Errorf("unknown arena shape %q", cfg.Shape)
+	}
+
+	switch cfg.Boundary {
+	case "":
+		cfg.Boundary = BoundaryClamp
+	case BoundaryClamp, BoundaryReflect:
+	case BoundaryWrap:
+		if cfg.Shape != ArenaRectangle {
+			return nil, fmt.Errorf("%s boundary requires a %s arena", BoundaryWrap, ArenaRectangle)
+		}
+	default:
+		return nil, fmt.Errorf("unknown arena boundary %q", cfg.Boundary)
+	}
+
+	return &arena{cfg: cfg}, nil
+}
+
+// constrain moves a point that left the arena back inside it according to the
+// boundary behaviour. It reports whether the worm hit the boundary.
+func (a *arena) constrain(x, y, direction float64) (float64, float64, float64, bool) {
+	switch a.cfg.Shape {
+	case ArenaRectangle:
+		return a.constrainRectangle(x, y, direction)
+	case ArenaCircle:
+		return a.constrainCircle(x, y, direction)
+	default:
+		return x, y, direction, false
+	}
+}
+
+func (a *arena) constrainRectangle(x, y, direction float64) (float64, float64, float64, bool) {
+	halfW, halfH := a.cfg.Width/2, a.cfg.Height/2
+	if x >= -halfW && x <= halfW && y >= -halfH && y <= halfH {
+		return x, y, direction, false
+	}
+
+	switch a.cfg.Boundary {
+	case BoundaryWrap:
+		x = -halfW + positiveMod(x+halfW, a.cfg.Width)
+		y = -halfH + positiveMod(y+halfH, a.cfg.Height)
+	case BoundaryReflect:
+		var flipX, flipY bool
+		x, flipX = fold(x, -halfW, halfW)
+		y, flipY = fold(y, -halfH, halfH)
+		// Bouncing off a vertical wall mirrors the heading about the y axis,
+		// bouncing off a horizontal wall mirrors it about the x axis.
+		if flipX {
+			direction = 180 - direction
+		}
+		if flipY {
+			direction = -direction
+		}
+		direction = normalizeDirection(direction)
+	default:
+		x = math.Max(-halfW, math.Min(halfW, x))
+		y = math.Max(-halfH, math.Min(halfH, y))
+	}
+
+	return x, y, direction, true
+}
+
+func (a *arena) constrainCircle(x, y, direction float64) (float64, float64, float64, bool) {
+	r := math.Hypot(x, y)
+	if r <= a.cfg.Radius {
+		return x, y, direction, false
+	}
+
+	phi := math.Atan2(y, x)
+	switch a.cfg.Boundary {
+	case BoundaryReflect:
+		// Mirror the overshoot back inside the wall and reflect the heading
+		// about the wall's normal.
+		r = math.Max(0, 2*a.cfg.Radius-r)
+
+		theta := direction * math.Pi / 180
+		dx, dy := math.Cos(theta), math.Sin(theta)
+		nx, ny := math.Cos(phi), math.Sin(phi)
+		dot := dx*nx + dy*ny
+		dx, dy = dx-2*dot*nx, dy-2*dot*ny
+		direction = normalizeDirection(math.Atan2(dy, dx) * 180 / math.Pi)
+	default:
+		r = a.cfg.Radius
+	}
+
+	return r * math.Cos(phi), r * math.Sin(phi), direction, true
+}
+
+// fold reflects v back into [min, max] as if the walls were mirrors, and
+// reports whether an odd number of reflections took place.
+func fold(v, min, max float64) (float64, bool) {
+	width := max - min
+	k := math.Floor((v - min) / width)
+	t := v - min - k*width
+	odd := math.Mod(math.Abs(k), 2) == 1
+	if odd {
+		t = width - t
+	}
+	return min + t, odd
+}
+
+func positiveMod(v, m float64) float64 {
+	v = math.Mod(v, m)
+	if v < 0 {
+		v += m
+	}
+	return v
+}
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"math"
+	"testing"
+)
+
+func TestArenaConstrain(t *testing.T) {
+	rect := func(boundary string) ArenaConfig {
+		return ArenaConfig{Shape: ArenaRectangle, Boundary: boundary, Width: 10, Height: 20}
+	}
+	circle := func(boundary string) ArenaConfig {
+		return ArenaConfig{Shape: ArenaCircle, Boundary: boundary, Radius: 10}
+	}
+
+	tests := []struct {
+		name                string
+		cfg                 ArenaConfig
+		x, y, direction     float64
+		wantX, wantY, wantD float64
+		wantHit             bool
+	}{
+		{"Unbounded", ArenaConfig{}, 1e6, -1e6, 10, 1e6, -1e6, 10, false},
+		{"RectangleInside", rect(BoundaryClamp), 5, -10, 30, 5, -10, 30, false},
+		{"RectangleClamp", rect(BoundaryClamp), 7, -12, 30, 5, -10, 30, true},
+		{"RectangleReflectX", rect(BoundaryReflect), 7, 0, 30, 3, 0, 150, true},
+		{"RectangleReflectY", rect(BoundaryReflect), 0, 12, 30, 0, 8, 330, true},
+		{"RectangleReflectCorner", rect(BoundaryReflect), -7, -12, 30, -3, -8, 210, true},
+		{"RectangleReflectTwice", rect(BoundaryReflect), 17, 0, 30, -3, 0, 30, true},
+		{"RectangleWrap", rect(BoundaryWrap), 7, -12, 30, -3, 8, 30, true},
+		{"RectangleWrapFar", rect(BoundaryWrap), 26, 0, 30, -4, 0, 30, true},
+		{"CircleInside", circle(BoundaryClamp), 6, 8, 45, 6, 8, 45, false},
+		{"CircleClamp", circle(BoundaryClamp), 12, 16, 45, 6, 8, 45, true},
+		{"CircleReflect", circle(BoundaryReflect), 12, 0, 0, 8, 0, 180, true},
+		{"CircleReflectGlancing", circle(BoundaryReflect), 0, 12, 45, 0, 8, 315, true},
+		{"CircleReflectPastCentre", circle(BoundaryReflect), 25, 0, 0, 0, 0, 180, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewArena(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			x, y, d, hit := a.constrain(tt.x, tt.y, tt.direction)
+			if math.Abs(x-tt.wantX) > 1e-9 || math.Abs(y-tt.wantY) > 1e-9 || math.Abs(d-tt.wantD) > 1e-9 || hit != tt.wantHit {
+				t.Errorf("constrained to (%v, %v) heading %v hit %v, want (%v, %v) heading %v hit %v",
+					x, y, d, hit, tt.wantX, tt.wantY, tt.wantD, tt.wantHit)
+			}
+		})
+	}
+}
+
+func TestNewArena(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ArenaConfig
+		want    ArenaConfig
+		wantErr bool
+	}{
+		{"DefaultsToUnbounded", ArenaConfig{Width: 10, Boundary: BoundaryWrap}, ArenaConfig{Shape: ArenaUnbounded}, false},
+		{"DefaultsToClamp", ArenaConfig{Shape: ArenaCircle, Radius: 5, Width: 3}, ArenaConfig{Shape: ArenaCircle, Boundary: BoundaryClamp, Radius: 5}, false},
+		{"RectangleDropsRadius", ArenaConfig{Shape: ArenaRectangle, Boundary: BoundaryWrap, Width: 2, Height: 3, Radius: 5}, ArenaConfig{Shape: ArenaRectangle, Boundary: BoundaryWrap, Width: 2, Height: 3}, false},
+		{"RectangleWithoutHeight", ArenaConfig{Shape: ArenaRectangle, Width: 2}, ArenaConfig{}, true},
+		{"CircleWithoutRadius", ArenaConfig{Shape: ArenaCircle}, ArenaConfig{}, true},
+		{"CircleWrap", ArenaConfig{Shape: ArenaCircle, Boundary: BoundaryWrap, Radius: 5}, ArenaConfig{}, true},
+		{"UnknownShape", ArenaConfig{Shape: "hexagon"}, ArenaConfig{}, true},
+		{"UnknownBoundary", ArenaConfig{Shape: ArenaCircle, Boundary: "teleport", Radius: 5}, ArenaConfig{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewArena(tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got arena %+v, want an error", a.cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.cfg != tt.want {
+				t.Errorf("arena is %+v, want %+v", a.cfg, tt.want)
+			}
+		})
+	}
+}
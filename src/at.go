@@ -0,0 +1,152 @@
+package src
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var errBeforeFirstPosition = errors.New("no position at or before that moment")
+
+// stateAt is where the worm was at a moment: the position in effect, the last
+// update at or before it, and the next update after it. Interpolated places
+// the worm between the two in proportion to the moment's block number or time.
+type stateAt struct {
+	Block        *int          `json:"block,omitempty"`
+	Timestamp    *time.Time    `json:"timestamp,omitempty"`
+	Position     position      `json:"position"`
+	Next         *position     `json:"next"` // nil when no update has followed yet
+	Interpolated interpolation `json:"interpolated"`
+}
+
+type interpolation struct {
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Direction float64 `json:"direction"`
+	Fraction  float64 `json:"fraction"` // how far towards the next update, from 0 to 1
+}
+
+// StateAtBlock returns the state of the worm at a block of the active
+// trajectory.
+func (db *dbManager) StateAtBlock(block int) (stateAt, error) {
+	return db.fetchStateAtBlock(block, 0)
+}
+
+// StateAtTime returns the state of the worm at a time of the active
+// trajectory.
+func (db *dbManager) StateAtTime(ts time.Time) (stateAt, error) {
+	return db.fetchStateAtTime(ts, 0)
+}
+
+// fetchStateAtBlock returns the state of the worm at a block of a trajectory
+// version. Of several updates in a block the last one is in effect.
+func (db *dbManager) fetchStateAtBlock(block, version int) (stateAt, error) {
+	at, next, err := db.fetchNeighbours("blck", block, version)
+	if err != nil {
+		return stateAt{}, err
+	}
+	return stateAtBlock(block, at, next), nil
+}
+
+// fetchStateAtTime returns the state of the worm at a time of a trajectory
+// version.
+func (db *dbManager) fetchStateAtTime(ts time.Time, version int) (stateAt, error) {
+	at, next, err := db.fetchNeighbours("ts", ts, version)
+	if err != nil {
+		return stateAt{}, err
+	}
+	return stateAtTime(ts, at, next), nil
+}
+
+// stateAtBlock places the worm at a block between the position in effect and
+// the next update.
+func stateAtBlock(block int, at position, next *position) stateAt {
+	s := stateAt{Block: &block, Position: at, Next: next}
+	var fraction float64
+	if next != nil && next.Block > at.Block {
+		fraction = float64(block-at.Block) / float64(next.Block-at.Block)
+	}
+	s.Interpolated = interpolate(at, next, fraction)
+	return s
+}
+
+// stateAtTime places the worm at a time between the position in effect and the
+// next update.
+func stateAtTime(ts time.Time, at position, next *position) stateAt {
+	s := stateAt{Timestamp: &ts, Position: at, Next: next}
+	var fraction float64
+	if next != nil {
+		if span := next.Timestamp.Sub(at.Timestamp); span > 0 {
+			fraction = float64(ts.Sub(at.Timestamp)) / float64(span)
+		}
+	}
+	s.Interpolated = interpolate(at, next, fraction)
+	return s
+}
+
+// fetchNeighbours returns the last position with column at or before value and
+// the first one after it, read through the column's index. Moments before the
+// positions held in full are read from the points kept of rolled up ones.
+func (db *dbManager) fetchNeighbours(column string, value any, version int) (position, *position, error) {
+	source, args, err := db.positionsSource(version)
+	if err != nil {
+		return position{}, nil, err
+	}
+
+	at, next, err := db.fetchNeighboursIn(source, args, column, value)
+	if errors.Is(err, errBeforeFirstPosition) && source == "positions" {
+		return db.fetchNeighboursIn(historySource, nil, column, value)
+	}
+	return at, next, err
+}
+
+func (db *dbManager) fetchNeighboursIn(source string, args []any, column string, value any) (position, *position, error) {
+	atQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		WHERE ` + column + ` <= ?
+		ORDER BY ` + column + ` DESC, ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	at, err := scanPosition(db.reader.QueryRow(atQ, append(args, value)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return position{}, nil, errBeforeFirstPosition
+	}
+	if err != nil {
+		return position{}, nil, fmt.Errorf("error fetching position at %s: %w", column, err)
+	}
+
+	nextQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		WHERE ` + column + ` > ?
+		ORDER BY ` + column + ` ASC, ` + chainOrder + `
+		LIMIT 1;
+	`
+	next, err := scanPosition(db.reader.QueryRow(nextQ, append(args, value)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return at, nil, nil
+	}
+	if err != nil {
+		return position{}, nil, fmt.Errorf("error fetching position after %s: %w", column, err)
+	}
+
+	return at, &next, nil
+}
+
+// interpolate places the worm a fraction of the way from at to next, turning
+// the shortest way.
+func interpolate(at position, next *position, fraction float64) interpolation {
+	if next == nil {
+		return interpolation{X: at.X, Y: at.Y, Direction: at.Direction}
+	}
+	fraction = math.Max(0, math.Min(1, fraction))
+	return interpolation{
+		X:         at.X + fraction*(next.X-at.X),
+		Y:         at.Y + fraction*(next.Y-at.Y),
+		Direction: normalizeDirection(at.Direction + fraction*headingChange(at.Direction, next.Direction)),
+		Fraction:  fraction,
+	}
+}
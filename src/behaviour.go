@@ -0,0 +1,432 @@
+package src
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The behavioural states of C. elegans tracking. Real worms move forward in
+// runs broken up by reversals, pauses and sharp omega turns.
+const (
+	behaviourForward  = "forward"
+	behaviourReversal = "reversal"
+	behaviourPause    = "pause"
+	behaviourTurn     = "turn"
+)
+
+var behaviours = []string{behaviourForward, behaviourReversal, behaviourPause, behaviourTurn}
+
+// BehaviourConfig sets the thresholds of the behaviour classifier. The drive of
+// a move is the mean of its muscle activations.
+type BehaviourConfig struct {
+	PauseThreshold float64 `json:"pauseThreshold"` // drive at or below which the worm is pausing
+	TurnAngle      float64 `json:"turnAngle"`      // heading change in degrees from which a move is a sharp turn
+	ReversalAngle  float64 `json:"reversalAngle"`  // heading change in degrees from which a move is a reversal
+}
+
+// behaviourClassifier labels every position with a behavioural state and
+// merges consecutive labels into episodes.
+type behaviourClassifier struct {
+	cfg BehaviourConfig
+}
+
+func NewBehaviourClassifier(cfg BehaviourConfig) (*behaviourClassifier, error) {
+	if cfg.PauseThreshold < 0 {
+		return nil, fmt.Errorf("invalid pause threshold %v: must not be negative", cfg.PauseThreshold)
+	}
+	if cfg.TurnAngle <= 0 || cfg.ReversalAngle > 180 || cfg.TurnAngle >= cfg.ReversalAngle {
+		return nil, fmt.Errorf("invalid turn angle %v and reversal angle %v: must satisfy 0 < turn < reversal <= 180", cfg.TurnAngle, cfg.ReversalAngle)
+	}
+	return &behaviourClassifier{cfg: cfg}, nil
+}
+
+// classify labels the move that led to a position. Positions without recorded
+// muscle inputs or kinematics can't be labelled and return an empty state.
+func (c *behaviourClassifier) classify(p position) string {
+	if p.LeftMuscle == nil || p.RightMuscle == nil || p.Kinematics == nil {
+		return ""
+	}
+
+	drive := float64(*p.LeftMuscle+*p.RightMuscle) / 2
+	turn := math.Abs(p.Kinematics.HeadingChange)
+
+	switch {
+	case drive < -c.cfg.PauseThreshold, turn >= c.cfg.ReversalAngle:
+		return behaviourReversal
+	case turn >= c.cfg.TurnAngle:
+		return behaviourTurn
+	case math.Abs(drive) <= c.cfg.PauseThreshold:
+		return behaviourPause
+	default:
+		return behaviourForward
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+type behaviourEpisode struct {
+	ID           int       `json:"id"`
+	State        string    `json:"state"`
+	StartID      int       `json:"startId"`
+	EndID        int       `json:"endId"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Duration     float64   `json:"duration"` // seconds
+	Moves        int       `json:"moves"`
+	Displacement float64   `json:"displacement"`
+	PathLength   float64   `json:"pathLength"`
+
+	startX, startY, endX, endY float64
+}
+
+// extend adds the move to p to the episode.
+func (e *behaviourEpisode) extend(p position) {
+	e.EndID, e.End = p.ID, p.Timestamp
+	e.endX, e.endY = p.X, p.Y
+	e.Moves++
+	if p.Kinematics != nil {
+		e.PathLength += p.Kinematics.StepLength
+	}
+}
+
+// newBehaviourEpisode starts an episode with the move from prev to p. The zero
+// prev is the origin, whose time is taken to be that of the first move.
+func newBehaviourEpisode(state string, prev, p position) behaviourEpisode {
+	e := behaviourEpisode{State: state, StartID: p.ID, Start: prev.Timestamp, startX: prev.X, startY: prev.Y}
+	if prev.Timestamp.IsZero() {
+		e.Start = p.Timestamp
+	}
+	e.extend(p)
+	return e
+}
+
+func (c *behaviourClassifier) name() string { return "behaviours" }
+
+func (c *behaviourClassifier) fingerprint() string {
+	return fmt.Sprintf("v1 %+v", c.cfg)
+}
+
+func (c *behaviourClassifier) apply(ex execer, p position) error {
+	state := c.classify(p)
+	if _, err := ex.Exec(`UPDATE positions SET behaviour = ? WHERE id = ?;`, nullString(state), p.ID); err != nil {
+		return fmt.Errorf("error labelling position: %w", err)
+	}
+	if state == "" {
+		return nil
+	}
+
+	prevQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` < (?, ?, ?)
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	prev, err := scanPosition(ex.QueryRow(prevQ, p.chainKey()...))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error fetching previous position: %w", err)
+	}
+
+	// Extend the latest episode when it ended with the previous position in the
+	// same state
+	last, err := scanEpisode(ex.QueryRow(`SELECT ` + episodeColumns + ` FROM behaviour_episodes ORDER BY id DESC LIMIT 1;`))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error fetching latest episode: %w", err)
+	}
+	if err == nil && last.State == state && last.EndID == prev.ID {
+		last.extend(p)
+		return saveEpisode(ex, last)
+	}
+
+	return saveEpisode(ex, newBehaviourEpisode(state, prev, p))
+}
+
+// rebuild labels the positions again. The episodes that started with rolled
+// up positions are kept with the labels they were given, the latest of them
+// cut back to the last rolled up position and extended again from there.
+func (c *behaviourClassifier) rebuild(ex execer) error {
+	const batchSize = 1000
+
+	last, err := lastRolledUp(ex)
+	if err != nil {
+		return err
+	}
+	episode, err := keptEpisode(ex, last)
+	if err != nil {
+		return err
+	}
+
+	batchQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` > (?, ?, ?)
+		ORDER BY ` + chainOrder + `
+		LIMIT ?;
+	`
+
+	prev := last
+	for {
+		rows, err := ex.Query(batchQ, append(prev.chainKey(), batchSize)...)
+		if err != nil {
+			return fmt.Errorf("error fetching positions to label: %w", err)
+		}
+		ps, err := scanPositions(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(ps) == 0 {
+			break
+		}
+
+		for _, p := range ps {
+			state := c.classify(p)
+			if _, err := ex.Exec(`UPDATE positions SET behaviour = ? WHERE id = ?;`, nullString(state), p.ID); err != nil {
+				return fmt.Errorf("error labelling position: %w", err)
+			}
+
+			if episode != nil && episode.State == state {
+				episode.extend(p)
+				prev = p
+				continue
+			}
+
+			if episode != nil {
+				if err := saveEpisode(ex, *episode); err != nil {
+					return err
+				}
+				episode = nil
+			}
+			if state != "" {
+				e := newBehaviourEpisode(state, prev, p)
+				episode = &e
+			}
+			prev = p
+		}
+	}
+
+	if episode != nil {
+		return saveEpisode(ex, *episode)
+	}
+	return nil
+}
+
+// keptEpisode deletes the episodes that started with positions still held in
+// full and cuts the one left going on over them back to last, the last rolled
+// up position. It returns that episode to extend, nil when none ended with
+// last.
+func keptEpisode(ex execer, last position) (*behaviourEpisode, error) {
+	if last.ID == 0 {
+		if _, err := ex.Exec(`DELETE FROM behaviour_episodes;`); err != nil {
+			return nil, fmt.Errorf("error deleting episodes: %w", err)
+		}
+		return nil, nil
+	}
+
+	if _, err := ex.Exec(`DELETE FROM behaviour_episodes WHERE start_id IN (SELECT id FROM positions);`); err != nil {
+		return nil, fmt.Errorf("error deleting episodes: %w", err)
+	}
+	e, err := scanEpisode(ex.QueryRow(`SELECT ` + episodeColumns + ` FROM behaviour_episodes ORDER BY id DESC LIMIT 1;`))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching latest episode: %w", err)
+	}
+
+	if e.EndID != last.ID {
+		const q = /* sql */ `
+			SELECT COUNT(*), COALESCE(SUM(step_length), 0)
+			FROM positions
+			WHERE ` + chainKey + ` > (?, ?, ?)
+			AND ` + chainKey + ` <= (SELECT blck, log_index, id FROM positions WHERE id = ?);
+		`
+		var (
+			moves int
+			steps float64
+		)
+		if err := ex.QueryRow(q, append(last.chainKey(), e.EndID)...).Scan(&moves, &steps); err != nil {
+			return nil, fmt.Errorf("error fetching episode moves: %w", err)
+		}
+		if moves == 0 {
+			// The episode ended before last
+			return nil, nil
+		}
+		e.EndID, e.End = last.ID, last.Timestamp
+		e.endX, e.endY = last.X, last.Y
+		e.Moves -= moves
+		e.PathLength -= steps
+	}
+	return &e, nil
+}
+
+const episodeColumns = /* sql */ `
+	id, state, start_id, end_id, start_ts, end_ts, start_x, start_y, end_x, end_y,
+	moves, path_length`
+
+func scanEpisode(row scanner) (behaviourEpisode, error) {
+	var e behaviourEpisode
+	if err := row.Scan(
+		&e.ID,
+		&e.State,
+		&e.StartID,
+		&e.EndID,
+		&e.Start,
+		&e.End,
+		&e.startX,
+		&e.startY,
+		&e.endX,
+		&e.endY,
+		&e.Moves,
+		&e.PathLength,
+	); err != nil {
+		return behaviourEpisode{}, err
+	}
+	e.Duration = e.End.Sub(e.Start).Seconds()
+	e.Displacement = math.Hypot(e.endX-e.startX, e.endY-e.startY)
+	return e, nil
+}
+
+// saveEpisode inserts a new episode or updates an existing one.
+func saveEpisode(ex execer, e behaviourEpisode) error {
+	if e.ID == 0 {
+		const q = /* sql */ `
+			INSERT INTO behaviour_episodes
+				(state, start_id, end_id, start_ts, end_ts, start_x, start_y, end_x, end_y,
+				moves, path_length)
+			VALUES
+				(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+		`
+		if _, err := ex.Exec(q, e.State, e.StartID, e.EndID, e.Start, e.End, e.startX, e.startY, e.endX, e.endY, e.Moves, e.PathLength); err != nil {
+			return fmt.Errorf("error inserting episode: %w", err)
+		}
+		return nil
+	}
+
+	const q = /* sql */ `
+		UPDATE behaviour_episodes
+		SET end_id = ?, end_ts = ?, end_x = ?, end_y = ?, moves = ?, path_length = ?
+		WHERE id = ?;
+	`
+	if _, err := ex.Exec(q, e.EndID, e.End, e.endX, e.endY, e.Moves, e.PathLength, e.ID); err != nil {
+		return fmt.Errorf("error updating episode: %w", err)
+	}
+	return nil
+}
+
+// fetchEpisodes returns up to limit episodes that started between from and to,
+// in order, optionally only those in one state.
+func (db *dbManager) fetchEpisodes(from, to time.Time, state string, limit int) ([]behaviourEpisode, error) {
+	const q = /* sql */ `
+		SELECT ` + episodeColumns + `
+		FROM behaviour_episodes
+		WHERE (?1 IS NULL OR start_ts >= ?1)
+		AND (?2 IS NULL OR start_ts <= ?2)
+		AND (?3 IS NULL OR state = ?3)
+		ORDER BY id ASC
+		LIMIT ?4;
+	`
+
+	rows, err := db.reader.Query(q, nullTime(from), nullTime(to), nullString(state), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching episodes: %w", err)
+	}
+	defer rows.Close()
+
+	episodes := make([]behaviourEpisode, 0)
+	for rows.Next() {
+		e, err := scanEpisode(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning episode: %w", err)
+		}
+		episodes = append(episodes, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating episodes: %w", err)
+	}
+
+	return episodes, nil
+}
+
+// -----------------------------------------------------------------------------
+// Summaries
+
+// behaviourWindow summarises the behaviour of the worm over a window of time.
+type behaviourWindow struct {
+	Start  time.Time                       `json:"start"`
+	End    time.Time                       `json:"end"`
+	States map[string]*behaviourStateStats `json:"states"`
+}
+
+// behaviourStateStats counts the moves labelled with a state, the episodes of
+// the state that started in the window and the time spent in the state. Time
+// is the gap between a position and the one before it, fraction is the share of
+// the window's labelled time.
+type behaviourStateStats struct {
+	Moves    int     `json:"moves"`
+	Episodes int     `json:"episodes"`
+	Seconds  float64 `json:"seconds"`
+	Fraction float64 `json:"fraction"`
+}
+
+func summarizeBehaviours(t track, window time.Duration) []behaviourWindow {
+	windows := make([]behaviourWindow, 0)
+
+	var (
+		current *behaviourWindow
+		total   float64
+	)
+	closeWindow := func() {
+		if current == nil {
+			return
+		}
+		for _, s := range current.States {
+			if total > 0 {
+				s.Fraction = s.Seconds / total
+			}
+		}
+		windows = append(windows, *current)
+	}
+
+	for i, p := range t.points {
+		if p.Behaviour == "" {
+			continue
+		}
+
+		start := p.Timestamp.Truncate(window)
+		if current == nil || !current.Start.Equal(start) {
+			closeWindow()
+			current = &behaviourWindow{Start: start, End: start.Add(window), States: make(map[string]*behaviourStateStats)}
+			for _, b := range behaviours {
+				current.States[b] = &behaviourStateStats{}
+			}
+			total = 0
+		}
+
+		s := current.States[p.Behaviour]
+		s.Moves++
+		if i == 0 || t.points[i-1].Behaviour != p.Behaviour {
+			s.Episodes++
+		}
+		if i > 0 {
+			dt := p.Timestamp.Sub(t.points[i-1].Timestamp).Seconds()
+			s.Seconds += dt
+			total += dt
+		}
+	}
+	closeWindow()
+
+	return windows
+}
+
+// nullString maps the empty string to NULL.
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package src
+
+import (
+	"fmt"
+	"sync"
+)
+
+// positionsState identifies the contents of the positions table, it changes
+// whenever positions are added or rolled up, or a recomputed trajectory is
+// activated.
+type positionsState struct {
+	firstID    int
+	latestID   int
+	trajectory int
+	rollups    int // the retention buckets, which change as they're compacted
+}
+
+func (db *dbManager) getPositionsState() (positionsState, error) {
+	const q = /* sql */ `
+		SELECT
+			COALESCE((SELECT MIN(id) FROM positions), 0),
+			COALESCE((SELECT MAX(id) FROM positions), 0),
+			COALESCE((SELECT version FROM trajectories WHERE status = 'active'), 0),
+			(SELECT COUNT(*) FROM retention_buckets);
+	`
+
+	var s positionsState
+	if err := db.reader.QueryRow(q).Scan(&s.firstID, &s.latestID, &s.trajectory, &s.rollups); err != nil {
+		return positionsState{}, fmt.Errorf("error getting positions state: %w", err)
+	}
+
+	return s, nil
+}
+
+// resultCache remembers results computed from the positions table until the
+// positions change. Entries are keyed by the request parameters and dropped as
+// soon as a request sees a different positions state.
+type resultCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	state   positionsState
+	entries map[K]V
+	max     int
+}
+
+func newResultCache[K comparable, V any](max int) *resultCache[K, V] {
+	return &resultCache[K, V]{entries: make(map[K]V), max: max}
+}
+
+func (c *resultCache[K, V]) get(state positionsState, key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if state != c.state {
+		var zero V
+		return zero, false
+	}
+	v, ok := c.entries[key]
+	return v, ok
+}
+
+func (c *resultCache[K, V]) put(state positionsState, key K, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if state != c.state || len(c.entries) >= c.max {
+		c.entries = make(map[K]V)
+		c.state = state
+	}
+	c.entries[key] = v
+}
@@ -0,0 +1,329 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OpenDatabase opens the database at DB_PATH and applies any pending
+// migrations. The derivations configured in the environment are registered on
+// it.
+func OpenDatabase(log *zap.Logger) (*dbManager, error) {
+	db, err := ConnectDatabase(log)
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("CLEAN_SLATE") == "true" {
+		log.Warn("CLEAN_SLATE is no longer supported, run `migrate down 0` to empty the database")
+	}
+	if err := db.MigrateUp(log, 0); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+
+	behaviour, err := BehaviourConfigFromEnv()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	classifier, err := NewBehaviourClassifier(behaviour)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing behaviour classifier: %w", err)
+	}
+	if err := db.Derive(log, classifier); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Derive(log, NewSeriesRollups()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Derive(log, NewSpatialIndex()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	cell, err := envFloat("HEATMAP_CELL", 10)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	heatmap, err := NewHeatmapOccupancy(cell)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing heatmap: %w", err)
+	}
+	if err := db.Derive(log, heatmap); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// ConnectDatabase opens the database at DB_PATH as it is, without migrating
+// it.
+func ConnectDatabase(log *zap.Logger) (*dbManager, error) {
+	dbPath := dbPathFromEnv()
+	log.Info("using database path", zap.String("path", dbPath))
+
+	db, err := NewDBManager(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing database: %w", err)
+	}
+	return db, nil
+}
+
+// dbPathFromEnv returns the path of the database, DB_PATH.
+func dbPathFromEnv() string {
+	if dbPath := os.Getenv("DB_PATH"); dbPath != "" {
+		return dbPath
+	}
+	return "./worm-tracker.sqlite" // Fallback for local
+}
+
+// ServerConfigFromEnv reads the admin token from ADMIN_TOKEN. The server
+// listens on port 8080.
+func ServerConfigFromEnv() ServerConfig {
+	return ServerConfig{Port: "8080", AdminToken: os.Getenv("ADMIN_TOKEN")}
+}
+
+// SnapshotConfigFromEnv reads where and how often snapshots are taken from
+// SNAPSHOT_DIR, SNAPSHOT_INTERVAL, SNAPSHOT_KEEP and SNAPSHOT_KEEP_DAILY.
+func SnapshotConfigFromEnv() (SnapshotConfig, error) {
+	interval, err := envDuration("SNAPSHOT_INTERVAL", 6*time.Hour)
+	if err != nil {
+		return SnapshotConfig{}, err
+	}
+	keep, err := envInt("SNAPSHOT_KEEP", 4)
+	if err != nil {
+		return SnapshotConfig{}, err
+	}
+	keepDaily, err := envInt("SNAPSHOT_KEEP_DAILY", 7)
+	if err != nil {
+		return SnapshotConfig{}, err
+	}
+
+	return SnapshotConfig{
+		Dir:       os.Getenv("SNAPSHOT_DIR"),
+		Interval:  interval,
+		Keep:      int(keep),
+		KeepDaily: int(keepDaily),
+	}, nil
+}
+
+// RetentionConfigFromEnv reads the retention tiers from RETENTION_FULL_DAYS,
+// RETENTION_TIERS, RETENTION_POINTS and RETENTION_INTERVAL.
+func RetentionConfigFromEnv() (RetentionConfig, error) {
+	fullDays, err := envInt("RETENTION_FULL_DAYS", 0)
+	if err != nil {
+		return RetentionConfig{}, err
+	}
+	tiersValue := os.Getenv("RETENTION_TIERS")
+	if tiersValue == "" {
+		tiersValue = "1h:90,1d"
+	}
+	tiers, err := ParseRetentionTiers(tiersValue)
+	if err != nil {
+		return RetentionConfig{}, fmt.Errorf("invalid RETENTION_TIERS: %w", err)
+	}
+	points, err := envInt("RETENTION_POINTS", 16)
+	if err != nil {
+		return RetentionConfig{}, err
+	}
+	interval, err := envDuration("RETENTION_INTERVAL", time.Hour)
+	if err != nil {
+		return RetentionConfig{}, err
+	}
+
+	return RetentionConfig{
+		FullDays: int(fullDays),
+		Tiers:    tiers,
+		Points:   int(points),
+		Interval: interval,
+	}, nil
+}
+
+// RepairConfigFromEnv reads how skipped and failed block ranges are retried
+// from REPAIR_RPC_URL, REPAIR_INTERVAL, REPAIR_BACKOFF, REPAIR_MAX_BACKOFF and
+// REPAIR_MAX_ATTEMPTS.
+func RepairConfigFromEnv() (RepairConfig, error) {
+	interval, err := envDuration("REPAIR_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return RepairConfig{}, err
+	}
+	backoff, err := envDuration("REPAIR_BACKOFF", time.Minute)
+	if err != nil {
+		return RepairConfig{}, err
+	}
+	maxBackoff, err := envDuration("REPAIR_MAX_BACKOFF", 6*time.Hour)
+	if err != nil {
+		return RepairConfig{}, err
+	}
+	maxAttempts, err := envInt("REPAIR_MAX_ATTEMPTS", 10)
+	if err != nil {
+		return RepairConfig{}, err
+	}
+	rpc := os.Getenv("REPAIR_RPC_URL")
+	if rpc == "" {
+		rpc = hypeAPI
+	}
+
+	return RepairConfig{
+		RPC:         rpc,
+		Interval:    interval,
+		Backoff:     backoff,
+		MaxBackoff:  maxBackoff,
+		MaxAttempts: int(maxAttempts),
+	}, nil
+}
+
+// BehaviourConfigFromEnv reads the behaviour classifier thresholds from
+// BEHAVIOUR_PAUSE_THRESHOLD, BEHAVIOUR_TURN_ANGLE and BEHAVIOUR_REVERSAL_ANGLE.
+func BehaviourConfigFromEnv() (BehaviourConfig, error) {
+	pause, err := envFloat("BEHAVIOUR_PAUSE_THRESHOLD", 5)
+	if err != nil {
+		return BehaviourConfig{}, err
+	}
+	turn, err := envFloat("BEHAVIOUR_TURN_ANGLE", 45)
+	if err != nil {
+		return BehaviourConfig{}, err
+	}
+	reversal, err := envFloat("BEHAVIOUR_REVERSAL_ANGLE", 135)
+	if err != nil {
+		return BehaviourConfig{}, err
+	}
+
+	return BehaviourConfig{PauseThreshold: pause, TurnAngle: turn, ReversalAngle: reversal}, nil
+}
+
+// AnomalyConfigFromEnv reads the anomaly detector thresholds from
+// ANOMALY_MUSCLE_MIN, ANOMALY_MUSCLE_MAX, ANOMALY_MAX_GAP, ANOMALY_PRICE_SIGMA
+// and ANOMALY_PRICE_WINDOW.
+func AnomalyConfigFromEnv() (AnomalyConfig, error) {
+	muscleMin, err := envInt("ANOMALY_MUSCLE_MIN", -100)
+	if err != nil {
+		return AnomalyConfig{}, err
+	}
+	muscleMax, err := envInt("ANOMALY_MUSCLE_MAX", 100)
+	if err != nil {
+		return AnomalyConfig{}, err
+	}
+	maxGap, err := envDuration("ANOMALY_MAX_GAP", time.Hour)
+	if err != nil {
+		return AnomalyConfig{}, err
+	}
+	sigma, err := envFloat("ANOMALY_PRICE_SIGMA", 4)
+	if err != nil {
+		return AnomalyConfig{}, err
+	}
+	window, err := envInt("ANOMALY_PRICE_WINDOW", 100)
+	if err != nil {
+		return AnomalyConfig{}, err
+	}
+
+	return AnomalyConfig{
+		MuscleMin:   muscleMin,
+		MuscleMax:   muscleMax,
+		MaxGap:      maxGap,
+		PriceSigma:  sigma,
+		PriceWindow: int(window),
+	}, nil
+}
+
+// LocomotionConfigFromEnv reads the locomotion model configuration from
+// LOCOMOTION_MODEL, LOCOMOTION_WHEELBASE and LOCOMOTION_GAIN.
+func LocomotionConfigFromEnv() (LocomotionConfig, error) {
+	wheelbase, err := envFloat("LOCOMOTION_WHEELBASE", DefaultWheelbase)
+	if err != nil {
+		return LocomotionConfig{}, err
+	}
+	gain, err := envFloat("LOCOMOTION_GAIN", 1)
+	if err != nil {
+		return LocomotionConfig{}, err
+	}
+
+	return LocomotionConfig{
+		Model:     os.Getenv("LOCOMOTION_MODEL"),
+		Wheelbase: wheelbase,
+		Gain:      gain,
+	}, nil
+}
+
+// ArenaFromEnv creates the arena described by ARENA_SHAPE, ARENA_BOUNDARY,
+// ARENA_WIDTH, ARENA_HEIGHT and ARENA_RADIUS.
+func ArenaFromEnv() (*arena, error) {
+	width, err := envFloat("ARENA_WIDTH", 0)
+	if err != nil {
+		return nil, err
+	}
+	height, err := envFloat("ARENA_HEIGHT", 0)
+	if err != nil {
+		return nil, err
+	}
+	radius, err := envFloat("ARENA_RADIUS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := NewArena(ArenaConfig{
+		Shape:    os.Getenv("ARENA_SHAPE"),
+		Boundary: os.Getenv("ARENA_BOUNDARY"),
+		Width:    width,
+		Height:   height,
+		Radius:   radius,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error initializing arena: %w", err)
+	}
+
+	return a, nil
+}
+
+// envFloat reads a float from the environment, falling back to def when the
+// variable is unset.
+func envFloat(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return f, nil
+}
+
+// envInt reads an integer from the environment, falling back to def when the
+// variable is unset.
+func envInt(name string, def int64) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return i, nil
+}
+
+// envDuration reads a duration from the environment, falling back to def when
+// the variable is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return d, nil
+}
@@ -1,210 +1,341 @@
 package src
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"runtime"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var (
-	errUniqueConstraintViolation = errors.New("unique constraint violation")
-)
-
+// dbManager reads and writes the database through separate pools. SQLite allows
+// a single writer at a time, so writes go through one connection and never wait
+// on each other for the lock, while in WAL mode reads run on a pool of read-only
+// connections without waiting on the writer.
 type dbManager struct {
-	db *sql.DB
+	reader      *statements
+	writer      *statements
+	derivations []derivation
 }
 
-func NewDBManager(dataSourceName string) (*dbManager, error) {
-	db, err := sql.Open("sqlite3", dataSourceName)
+// The connection parameters of the writer and the readers. A busy timeout
+// covers other processes using the database, such as the migrate command.
+const (
+	writerParams = "_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_txlock=immediate"
+	readerParams = "_busy_timeout=5000&_query_only=true"
+)
+
+func NewDBManager(path string) (*dbManager, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+
+	// The writer is opened first so that the database is created and switched
+	// to WAL before any reader connects.
+	writer, err := sql.Open("sqlite3", path+sep+writerParams)
 	if err != nil {
 		return nil, err
 	}
-	return &dbManager{db: db}, nil
+	writer.SetMaxOpenConns(1)
+	if err := writer.Ping(); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("error connecting to database: %w", err)
+	}
+
+	reader, err := sql.Open("sqlite3", path+sep+readerParams)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	readers := max(4, runtime.NumCPU())
+	reader.SetMaxOpenConns(readers)
+	reader.SetMaxIdleConns(readers)
+
+	return &dbManager{reader: newStatements(reader), writer: newStatements(writer)}, nil
 }
 
-func (db *dbManager) Initialize(cleanSlate bool) error {
-	if cleanSlate {
-		dropPositions := /* sql */ `DROP TABLE IF EXISTS positions;`
-		if _, err := db.db.Exec(dropPositions); err != nil {
-			return fmt.Errorf("failed to drop positions table: %w", err)
-		}
+// begin starts a write transaction.
+func (db *dbManager) begin(ctx context.Context) (*stmtTx, error) {
+	return db.writer.begin(ctx)
+}
+
+// positionColumns are the positions columns in the order scanPosition reads
+// them.
+const positionColumns = /* sql */ `
+	id, blck, log_index, transaction_hash, x, y, direction, price, ts, model,
+	model_version, collision, left_muscle, right_muscle, step_length, heading_change,
+	speed, angular_velocity, path_length, displacement, behaviour, anomalies`
+
+// Positions are replayed in chain order, the order their updates were emitted
+// in: by block, then by log index. Ids only tell the order positions were
+// stored in, the updates a repair recovers are stored after later ones.
+// Positions stored before log indexes were recorded all have index 0 and keep
+// the order they were stored in within their block.
+const (
+	chainOrder     = `blck ASC, log_index ASC, id ASC`
+	chainOrderDesc = `blck DESC, log_index DESC, id DESC`
+	chainKey       = `(blck, log_index, id)` // compared with a position's chainKey()
+)
+
+// chainKey returns the values a position is ordered by, in the order of the
+// chainKey columns.
+func (p position) chainKey() []any {
+	return []any{p.Block, p.LogIndex, p.ID}
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPosition(row scanner) (position, error) {
+	var (
+		p         position
+		k         nullKinematics
+		behaviour sql.NullString
+		anomalies sql.NullString
+	)
+	dest := []any{
+		&p.ID,
+		&p.Block,
+		&p.LogIndex,
+		&p.TransactionHash,
+		&p.X,
+		&p.Y,
+		&p.Direction,
+		&p.Price,
+		&p.Timestamp,
+		&p.Model,
+		&p.ModelVersion,
+		&p.Collision,
+		&p.LeftMuscle,
+		&p.RightMuscle,
+	}
+	dest = append(dest, k.dest()...)
+	if err := row.Scan(append(dest, &behaviour, &anomalies)...); err != nil {
+		return position{}, err
+	}
+	p.Kinematics = k.kinematics()
+	p.Behaviour = behaviour.String
+	if anomalies.Valid {
+		p.Anomalies = strings.Split(anomalies.String, ",")
+	}
+	return p, nil
+}
 
-		dropBlocksChecked := /* sql */ `DROP TABLE IF EXISTS blocks_checked;`
-		if _, err := db.db.Exec(dropBlocksChecked); err != nil {
-			return fmt.Errorf("failed to drop blocks_checked table: %w", err)
+func scanPositions(rows *sql.Rows) ([]position, error) {
+	positions := make([]position, 0)
+	for rows.Next() {
+		p, err := scanPosition(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning position: %w", err)
 		}
+		positions = append(positions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating positions: %w", err)
 	}
 
-	createPositions := /* sql */ `
-		CREATE TABLE IF NOT EXISTS positions (
-			id               INTEGER PRIMARY KEY AUTOINCREMENT,
-			blck             INTEGER NOT NULL, -- the block number
-			transaction_hash TEXT NOT NULL, -- the transaction hash
-			x                FLOAT NOT NULL,
-			y                FLOAT NOT NULL,
-			direction        FLOAT NOT NULL,
-			price            FLOAT NOT NULL,
-			ts               TIMESTAMP NOT NULL
-		);`
+	return positions, nil
+}
 
-	if _, err := db.db.Exec(createPositions); err != nil {
-		return fmt.Errorf("failed to create positions table: %w", err)
+// SavePosition stores a new position and applies it to every derivation in the
+// same transaction. It returns the position with its id set.
+func (db *dbManager) SavePosition(p position) (position, error) {
+	tx, err := db.begin(context.Background())
+	if err != nil {
+		return position{}, fmt.Errorf("error starting transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	createBlocksChecked := /* sql */ `
-		CREATE TABLE IF NOT EXISTS blocks_checked (
-			blck INTEGER PRIMARY KEY
-		);`
-
-	if _, err := db.db.Exec(createBlocksChecked); err != nil {
-		return fmt.Errorf("failed to create blocks_checked table: %w", err)
+	p.ID, err = insertPosition(tx, p)
+	if err != nil {
+		return position{}, err
 	}
 
-	// insert 0 as the first block checked if it doesn't exist
-	const q = /* sql */ `
-		INSERT OR IGNORE INTO blocks_checked (blck) VALUES (0);
-	`
+	for _, d := range db.derivations {
+		if err := d.apply(tx, p); err != nil {
+			return position{}, fmt.Errorf("error applying position to %s derivation: %w", d.name(), err)
+		}
+	}
 
-	if _, err := db.db.Exec(q); err != nil {
-		return fmt.Errorf("failed to insert 0 into blocks_checked: %w", err)
+	if err := tx.Commit(); err != nil {
+		return position{}, fmt.Errorf("error committing position: %w", err)
 	}
 
-	return nil
+	return p, nil
 }
 
-func (db *dbManager) savePosition(p position) error {
+// insertPosition inserts a new position and returns its id.
+func insertPosition(ex execer, p position) (int, error) {
+	return insertPositionAt(ex, 0, p)
+}
+
+// insertPositionAt inserts a position at an id, the next one when id is 0,
+// and returns its id.
+func insertPositionAt(ex execer, id int, p position) (int, error) {
 	const q = /* sql */ `
 		INSERT INTO positions
-			(blck, transaction_hash, x, y, direction, price, ts)
+			(id, blck, log_index, transaction_hash, x, y, direction, price, ts, model,
+			model_version, collision, left_muscle, right_muscle, step_length, heading_change,
+			speed, angular_velocity, path_length, displacement, anomalies)
 		VALUES
-			(?, ?, ?, ?, ?, ?, ?)
+			(NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	if _, err := db.db.Exec(q, p.Block, p.TransactionHash, p.X, p.Y, p.Direction, p.Price, p.Timestamp); err != nil {
-		return fmt.Errorf("error executing position insert: %w", err)
+	args := []any{
+		id,
+		p.Block,
+		p.LogIndex,
+		p.TransactionHash,
+		p.X,
+		p.Y,
+		p.Direction,
+		p.Price,
+		p.Timestamp,
+		p.Model,
+		p.ModelVersion,
+		p.Collision,
+		p.LeftMuscle,
+		p.RightMuscle,
+	}
+
+	args = append(args, kinematicsArgs(p.Kinematics)...)
+	res, err := ex.Exec(q, append(args, joinAnomalies(p.Anomalies))...)
+	if err != nil {
+		return 0, fmt.Errorf("error executing position insert: %w", err)
+	}
+	inserted, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error getting position id: %w", err)
 	}
 
-	return nil
+	return int(inserted), nil
 }
 
-func (db *dbManager) fetchPositions(id int) ([]position, error) {
-	const q = /* sql */ `
-		SELECT
-			id, blck, transaction_hash, x, y, direction, price, ts
+// Positions returns up to limit positions of the active trajectory after id,
+// in order.
+func (db *dbManager) Positions(id, limit int) ([]position, error) {
+	return db.fetchPositions(id, 0, limit)
+}
+
+// fetchPositions returns up to limit positions after id from a trajectory
+// version, 0 being the active trajectory.
+func (db *dbManager) fetchPositions(id, version, limit int) ([]position, error) {
+	source, args, err := db.positionsSource(version)
+	if err != nil {
+		return nil, err
+	}
+
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
 		FROM
-			positions
+			` + source + `
 		WHERE id > ?
 		ORDER BY id ASC
-		LIMIT 100;
+		LIMIT ?;
 	`
 
-	rows, err := db.db.Query(q, id)
+	rows, err := db.reader.Query(q, append(args, id, limit)...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	positions := make([]position, 0)
-	for rows.Next() {
-		var p position
-		if err := rows.Scan(&p.ID, &p.Block, &p.TransactionHash, &p.X, &p.Y, &p.Direction, &p.Price, &p.Timestamp); err != nil {
-			return nil, err
-		}
-		positions = append(positions, p)
-	}
+	return scanPositions(rows)
+}
 
-	return positions, nil
+// RecentPositions returns the last limit positions of the active trajectory, in
+// order.
+func (db *dbManager) RecentPositions(limit int) ([]position, error) {
+	return db.fetchRecentPositions(limit, 0)
 }
 
-// fetchSample returns evenly distributed positions from ID 1 up to (lastId -
-// 100). The last 100 positions are excluded as they will be fetched separately.
-// note: the website doesnt work until there are 100 positions in the database
-func (db *dbManager) fetchSample(count int) ([]position, error) {
-	const query = /* sql */ `
-		WITH bounds as (
-			SELECT MAX(id) - 100 as max_id
-			FROM positions
+// fetchRecentPositions returns the last limit positions of a trajectory
+// version in the order of the chain, 0 being the active trajectory.
+func (db *dbManager) fetchRecentPositions(limit, version int) ([]position, error) {
+	source, args, err := db.positionsSource(version)
+	if err != nil {
+		return nil, err
+	}
+
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM (
+			SELECT *
+			FROM ` + source + `
+			ORDER BY ` + chainOrderDesc + `
+			LIMIT ?
 		)
-		SELECT id, blck, transaction_hash, x, y, direction, price, ts
-		FROM positions, bounds
-		WHERE id <= max_id
-		AND id >= 1
-		AND ((id - 1) * ?) % (max_id - 1) < ?
-		ORDER BY id ASC;
+		ORDER BY ` + chainOrder + `;
 	`
-	rows, err := db.db.Query(query, count, count)
+
+	rows, err := db.reader.Query(q, append(args, limit)...)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching evenly distributed sample: %w", err)
+		return nil, fmt.Errorf("error fetching recent positions: %w", err)
 	}
 	defer rows.Close()
 
-	var positions []position
-	for rows.Next() {
-		var p position
-		if err := rows.Scan(
-			&p.ID,
-			&p.Block,
-			&p.TransactionHash,
-			&p.X,
-			&p.Y,
-			&p.Direction,
-			&p.Price,
-			&p.Timestamp,
-		); err != nil {
-			return nil, fmt.Errorf("error scanning position: %w", err)
-		}
-		positions = append(positions, p)
-	}
-
-	return positions, nil
+	return scanPositions(rows)
 }
 
-func (db *dbManager) getLatestPosition() (position, error) {
+// HasUpdate reports whether the active trajectory holds the position of the
+// update logged at logIndex by a transaction.
+func (db *dbManager) HasUpdate(transactionHash string, logIndex int) (bool, error) {
 	const q = /* sql */ `
-		SELECT
-			id, x, y, direction, price, ts
-		FROM positions
-		WHERE id = (SELECT MAX(id) FROM positions);
+		SELECT EXISTS (SELECT 1 FROM positions WHERE transaction_hash = ? AND log_index = ?);
 	`
 
-	var p position
-	if err := db.db.QueryRow(q).Scan(&p.ID, &p.X, &p.Y, &p.Direction, &p.Price, &p.Timestamp); err != nil {
-		// check for now rows
-		if errors.Is(err, sql.ErrNoRows) {
-			return position{}, nil
-		}
-		return position{}, fmt.Errorf("error getting latest position: %w", err)
+	var stored bool
+	if err := db.reader.QueryRow(q, transactionHash, logIndex).Scan(&stored); err != nil {
+		return false, fmt.Errorf("error checking for stored update: %w", err)
 	}
+	return stored, nil
+}
 
-	return p, nil
+// LatestPosition returns the latest position of the active trajectory.
+func (db *dbManager) LatestPosition() (position, error) {
+	return db.getLatestPosition(0)
 }
 
-func (db *dbManager) saveBlockChecked(blck int) error {
-	const q = /* sql */ `
-		INSERT INTO blocks_checked (blck) VALUES (?);
+// getLatestPosition returns the latest position of a trajectory version, 0
+// being the active trajectory.
+func (db *dbManager) getLatestPosition(version int) (position, error) {
+	source, args, err := db.positionsSource(version)
+	if err != nil {
+		return position{}, err
+	}
+
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
 	`
 
-	if _, err := db.db.Exec(q, blck); err != nil {
-		// Handle unique constraint violation
-		if err.Error() == "UNIQUE constraint failed: blocks_checked.blck" {
-			return errUniqueConstraintViolation
+	p, err := scanPosition(db.reader.QueryRow(q, args...))
+	if err != nil {
+		// check for now rows
+		if errors.Is(err, sql.ErrNoRows) {
+			return position{}, nil
 		}
-		return fmt.Errorf("error executing block insert: %w", err)
+		return position{}, fmt.Errorf("error getting latest position: %w", err)
 	}
 
-	return nil
+	return p, nil
 }
 
-func (db *dbManager) getLatestBlockChecked() (int, error) {
+// LatestCheckpoint returns the latest block recorded in the ledger.
+func (db *dbManager) LatestCheckpoint() (int, error) {
 	const q = /* sql */ `
-		SELECT MAX(blck) FROM blocks_checked;
+		SELECT COALESCE(MAX(end_block), 0) FROM block_ranges;
 	`
 
 	var blck int
-	if err := db.db.QueryRow(q).Scan(&blck); err != nil {
+	if err := db.reader.QueryRow(q).Scan(&blck); err != nil {
 		// check for no rows
 		if errors.Is(err, sql.ErrNoRows) {
 			return 0, nil
@@ -215,8 +346,6 @@ func (db *dbManager) getLatestBlockChecked() (int, error) {
 	return blck, nil
 }
 
-func (db *dbManager) Close() {
-	if err := db.db.Close(); err != nil {
-		log.Fatal(err)
-	}
+func (db *dbManager) Close() error {
+	return errors.Join(db.reader.db.Close(), db.writer.db.Close())
 }
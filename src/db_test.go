@@ -0,0 +1,164 @@
+package src
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// benchmarkPositions is how many positions the benchmarks seed the database
+// with.
+const benchmarkPositions = 5000
+
+// openBenchmarkDB returns a file database with every derivation registered
+// and seeded with benchmarkPositions positions.
+func openBenchmarkDB(b *testing.B) *dbManager {
+	b.Helper()
+
+	db, err := NewDBManager(filepath.Join(b.TempDir(), "worm-tracker.sqlite"))
+	if err != nil {
+		b.Fatalf("opening database: %v", err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	log := zap.NewNop()
+	if err := db.MigrateUp(log, 0); err != nil {
+		b.Fatalf("migrating database: %v", err)
+	}
+
+	classifier, err := NewBehaviourClassifier(BehaviourConfig{PauseThreshold: 5, TurnAngle: 45, ReversalAngle: 135})
+	if err != nil {
+		b.Fatal(err)
+	}
+	heatmap, err := NewHeatmapOccupancy(10)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, d := range []derivation{classifier, NewSeriesRollups(), NewSpatialIndex(), heatmap} {
+		if err := db.Derive(log, d); err != nil {
+			b.Fatalf("registering derivation: %v", err)
+		}
+	}
+
+	var p position
+	for i := 0; i < benchmarkPositions; i++ {
+		if p, err = db.SavePosition(benchmarkPosition(i, p)); err != nil {
+			b.Fatalf("seeding position %d: %v", i, err)
+		}
+	}
+	return db
+}
+
+// benchmarkContractData returns the i-th update of a made up trajectory.
+func benchmarkContractData(i int) contractData {
+	return contractData{
+		transactionHash: fmt.Sprintf("0x%064x", i),
+		block:           initialBlock + i,
+		leftMuscle:      int64(i%7 - 3),
+		rightMuscle:     int64(i%5 - 2),
+		price:           1 + float64(i%100)/1000,
+		ts:              time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+	}
+}
+
+// benchmarkPosition returns the i-th position of a made up trajectory, moved
+// on from prev.
+func benchmarkPosition(i int, prev position) position {
+	a, _ := NewArena(ArenaConfig{})
+	return updatePosition(legacyModel{}, a, benchmarkContractData(i), prev)
+}
+
+// benchmarkRead is what the API reads on a typical request: the latest
+// position, the state the caches are keyed on and a page of positions.
+func benchmarkRead(db *dbManager) error {
+	latest, err := db.LatestPosition()
+	if err != nil {
+		return err
+	}
+	if _, err := db.getPositionsState(); err != nil {
+		return err
+	}
+	_, err = db.Positions(max(0, latest.ID-100), 100)
+	return err
+}
+
+func BenchmarkSavePosition(b *testing.B) {
+	db := openBenchmarkDB(b)
+	p, err := db.LatestPosition()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if p, err = db.SavePosition(benchmarkPosition(benchmarkPositions+i, p)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReads(b *testing.B) {
+	db := openBenchmarkDB(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := benchmarkRead(db); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadsUnderWriter reads while positions are saved as fast as the
+// writer takes them, reporting the read latency percentiles and the writer's
+// throughput.
+func BenchmarkReadsUnderWriter(b *testing.B) {
+	db := openBenchmarkDB(b)
+	p, err := db.LatestPosition()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var (
+		stop    atomic.Bool
+		written atomic.Int64
+		wg      sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := benchmarkPositions; !stop.Load(); i++ {
+			if p, err = db.SavePosition(benchmarkPosition(i, p)); err != nil {
+				b.Error(err)
+				return
+			}
+			written.Add(1)
+		}
+	}()
+
+	latencies := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		t := time.Now()
+		if err := benchmarkRead(db); err != nil {
+			b.Fatal(err)
+		}
+		latencies = append(latencies, time.Since(t))
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	stop.Store(true)
+	wg.Wait()
+
+	slices.Sort(latencies)
+	b.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-us")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-us")
+	b.ReportMetric(float64(written.Load())/elapsed.Seconds(), "writes/s")
+}
@@ -0,0 +1,93 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// A derivation maintains data derived from the positions table. Each new
+// position is applied in the transaction that saves it, and the whole
+// derivation is rebuilt whenever the positions change wholesale, such as when a
+// recomputed trajectory is activated or the derivation's configuration changes.
+// Rebuilds keep what was derived from positions since rolled up by the
+// retention.
+type derivation interface {
+	name() string
+	// fingerprint identifies the configuration of the derivation, a change
+	// triggers a rebuild on startup.
+	fingerprint() string
+	apply(ex execer, p position) error
+	rebuild(ex execer) error
+}
+
+// Derive registers a derivation. It's rebuilt straight away unless it was last
+// built with the same configuration.
+func (db *dbManager) Derive(log *zap.Logger, d derivation) error {
+	var fingerprint string
+	err := db.reader.QueryRow(`SELECT fingerprint FROM derivations WHERE name = ?;`, d.name()).Scan(&fingerprint)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error getting %s derivation: %w", d.name(), err)
+	}
+
+	if err != nil || fingerprint != d.fingerprint() {
+		log.Info("rebuilding derivation", zap.String("derivation", d.name()))
+
+		tx, err := db.begin(context.Background())
+		if err != nil {
+			return fmt.Errorf("error starting transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		if err := d.rebuild(tx); err != nil {
+			return fmt.Errorf("error rebuilding %s derivation: %w", d.name(), err)
+		}
+
+		const q = /* sql */ `
+			INSERT INTO derivations (name, fingerprint) VALUES (?, ?)
+			ON CONFLICT (name) DO UPDATE SET fingerprint = excluded.fingerprint;
+		`
+		if _, err := tx.Exec(q, d.name(), d.fingerprint()); err != nil {
+			return fmt.Errorf("error saving %s derivation: %w", d.name(), err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing %s derivation: %w", d.name(), err)
+		}
+	}
+
+	db.derivations = append(db.derivations, d)
+	return nil
+}
+
+// rebuildDerivations rebuilds every registered derivation.
+func (db *dbManager) rebuildDerivations(ex execer) error {
+	for _, d := range db.derivations {
+		if err := d.rebuild(ex); err != nil {
+			return fmt.Errorf("error rebuilding %s derivation: %w", d.name(), err)
+		}
+	}
+	return nil
+}
+
+// refreshDerivations rebuilds every registered derivation in its own
+// transaction, for when existing positions were updated in place.
+func (db *dbManager) refreshDerivations() error {
+	tx, err := db.begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := db.rebuildDerivations(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing derivations: %w", err)
+	}
+	return nil
+}
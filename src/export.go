@@ -0,0 +1,353 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFormats are the formats positions can be exported in, with their
+// content types.
+var exportFormats = map[string]string{
+	"csv":     "text/csv",
+	"ndjson":  "application/x-ndjson",
+	"geojson": "application/geo+json",
+}
+
+var errInvalidExportFormat = errors.New("invalid format: must be csv, ndjson or geojson")
+
+// ExportFormatExtension returns the file extension of an export format, or
+// errInvalidExportFormat.
+func ExportFormatExtension(format string) (string, error) {
+	if _, ok := exportFormats[format]; !ok {
+		return "", errInvalidExportFormat
+	}
+	return "." + format, nil
+}
+
+// exportSummary describes an export. It's read in the same transaction as the
+// exported positions, so the checkpoint is the one they were stored up to.
+type exportSummary struct {
+	Format     string    `json:"format"`
+	Positions  int       `json:"positions"`
+	FirstID    int       `json:"firstId"`
+	LastID     int       `json:"lastId"`
+	Checkpoint int       `json:"checkpoint"` // the latest block recorded
+	ExportedAt time.Time `json:"exportedAt"`
+}
+
+// Export writes the positions of a trajectory version between from and to in
+// a format, streaming them off a database cursor. Errors about the request are
+// returned before anything is written.
+func (db *dbManager) Export(ctx context.Context, w io.Writer, format string, from, to time.Time, version int) (exportSummary, error) {
+	if _, ok := exportFormats[format]; !ok {
+		return exportSummary{}, errInvalidExportFormat
+	}
+	source, args, err := db.positionsSource(version)
+	if err != nil {
+		return exportSummary{}, err
+	}
+
+	tx, err := db.reader.begin(ctx)
+	if err != nil {
+		return exportSummary{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	e := positionExport{tx: tx, source: source, args: args, from: from, to: to}
+
+	summary := exportSummary{Format: format, ExportedAt: time.Now().UTC()}
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(end_block), 0) FROM block_ranges;`).Scan(&summary.Checkpoint); err != nil {
+		return exportSummary{}, fmt.Errorf("error getting latest block checked: %w", err)
+	}
+	count, err := e.count()
+	if err != nil {
+		return exportSummary{}, err
+	}
+	summary.FirstID, summary.LastID = count.firstID, count.lastID
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	switch format {
+	case "csv":
+		summary.Positions, err = exportCSV(ctx, bw, e)
+	case "ndjson":
+		summary.Positions, err = exportNDJSON(ctx, bw, e)
+	case "geojson":
+		summary.Positions, err = exportGeoJSON(ctx, bw, e, count)
+	}
+	if err != nil {
+		return summary, err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return summary, fmt.Errorf("error writing export: %w", err)
+	}
+	return summary, nil
+}
+
+// exportSummarySuffix names the summary written next to an export file.
+const exportSummarySuffix = ".meta.json"
+
+// WriteExportSummary writes the summary of the export file at path next to it.
+func WriteExportSummary(path string, summary exportSummary) error {
+	b, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding export summary: %w", err)
+	}
+	if err := os.WriteFile(path+exportSummarySuffix, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing export summary: %w", err)
+	}
+	return nil
+}
+
+// ReadExportSummary reads the summary written next to the export file at path,
+// nil when there is none.
+func ReadExportSummary(path string) (*exportSummary, error) {
+	b, err := os.ReadFile(path + exportSummarySuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading export summary: %w", err)
+	}
+	var summary exportSummary
+	if err := json.Unmarshal(b, &summary); err != nil {
+		return nil, fmt.Errorf("error decoding export summary: %w", err)
+	}
+	return &summary, nil
+}
+
+var exportCSVHeader = []string{
+	"id", "blockNumber", "transactionHash", "timestamp", "x", "y", "direction",
+	"price", "leftMuscle", "rightMuscle", "model", "modelVersion", "collision",
+	"behaviour", "anomalies", "logIndex",
+}
+
+func exportCSV(ctx context.Context, w io.Writer, e positionExport) (int, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportCSVHeader); err != nil {
+		return 0, fmt.Errorf("error writing export: %w", err)
+	}
+
+	formatFloat := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	formatMuscle := func(m *int64) string {
+		if m == nil {
+			return ""
+		}
+		return strconv.FormatInt(*m, 10)
+	}
+
+	n := 0
+	err := e.each(ctx, func(p position) error {
+		record := []string{
+			strconv.Itoa(p.ID),
+			strconv.Itoa(p.Block),
+			p.TransactionHash,
+			p.Timestamp.UTC().Format(time.RFC3339Nano),
+			formatFloat(p.X),
+			formatFloat(p.Y),
+			formatFloat(p.Direction),
+			formatFloat(p.Price),
+			formatMuscle(p.LeftMuscle),
+			formatMuscle(p.RightMuscle),
+			p.Model,
+			strconv.Itoa(p.ModelVersion),
+			strconv.FormatBool(p.Collision),
+			p.Behaviour,
+			strings.Join(p.Anomalies, ","),
+			strconv.Itoa(p.LogIndex),
+		}
+		if err := cw.Write(record); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return n, fmt.Errorf("error writing export: %w", err)
+	}
+	return n, nil
+}
+
+func exportNDJSON(ctx context.Context, w io.Writer, e positionExport) (int, error) {
+	enc := json.NewEncoder(w)
+
+	n := 0
+	err := e.each(ctx, func(p position) error {
+		p.Kinematics = nil
+		if err := enc.Encode(p); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// geoJSONPointProperties are the properties of a position's point feature.
+type geoJSONPointProperties struct {
+	ID              int       `json:"id"`
+	Block           int       `json:"blockNumber"`
+	TransactionHash string    `json:"transactionHash"`
+	Timestamp       time.Time `json:"timestamp"`
+	Direction       float64   `json:"direction"`
+	Price           float64   `json:"price"`
+	LeftMuscle      *int64    `json:"leftMuscle"`
+	RightMuscle     *int64    `json:"rightMuscle"`
+}
+
+// exportGeoJSON writes a FeatureCollection of the path as a LineString followed
+// by a point feature per position. The path is written before the points, so
+// the positions are read twice.
+func exportGeoJSON(ctx context.Context, w io.Writer, e positionExport, count exportCount) (int, error) {
+	if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+		return 0, fmt.Errorf("error writing export: %w", err)
+	}
+
+	// A LineString needs two positions
+	features := 0
+	if count.positions >= 2 {
+		if _, err := io.WriteString(w, `{"type":"Feature","geometry":{"type":"LineString","coordinates":[`); err != nil {
+			return 0, fmt.Errorf("error writing export: %w", err)
+		}
+		sep := ""
+		err := e.each(ctx, func(p position) error {
+			if _, err := fmt.Fprintf(w, "%s[%s,%s]", sep, geoJSONNumber(p.X), geoJSONNumber(p.Y)); err != nil {
+				return fmt.Errorf("error writing export: %w", err)
+			}
+			sep = ","
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if _, err := fmt.Fprintf(w, `]},"properties":{"fromId":%d,"toId":%d}}`, count.firstID, count.lastID); err != nil {
+			return 0, fmt.Errorf("error writing export: %w", err)
+		}
+		features++
+	}
+
+	n := 0
+	err := e.each(ctx, func(p position) error {
+		props, err := json.Marshal(geoJSONPointProperties{
+			ID:              p.ID,
+			Block:           p.Block,
+			TransactionHash: p.TransactionHash,
+			Timestamp:       p.Timestamp,
+			Direction:       p.Direction,
+			Price:           p.Price,
+			LeftMuscle:      p.LeftMuscle,
+			RightMuscle:     p.RightMuscle,
+		})
+		if err != nil {
+			return fmt.Errorf("error encoding position %d: %w", p.ID, err)
+		}
+		sep := ","
+		if features == 0 {
+			sep = ""
+		}
+		if _, err := fmt.Fprintf(w, `%s{"type":"Feature","geometry":{"type":"Point","coordinates":[%s,%s]},"properties":%s}`,
+			sep, geoJSONNumber(p.X), geoJSONNumber(p.Y), props); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+		features++
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if _, err := io.WriteString(w, "]}\n"); err != nil {
+		return n, fmt.Errorf("error writing export: %w", err)
+	}
+	return n, nil
+}
+
+func geoJSONNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+// positionExport reads the positions of an export. Every read runs in the
+// export's read transaction, so they all see the same positions.
+type positionExport struct {
+	tx       *stmtTx
+	source   string // the FROM clause of the trajectory version, and its arguments
+	args     []any
+	from, to time.Time // zero leaves the end of the range open
+}
+
+// each calls fn with the positions in order. They are read one at a time off
+// the cursor.
+func (e positionExport) each(ctx context.Context, fn func(position) error) error {
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + e.source + `
+		WHERE (? IS NULL OR ts >= ?)
+		AND (? IS NULL OR ts <= ?)
+		ORDER BY ` + chainOrder + `;
+	`
+
+	args := append(slices.Clone(e.args), nullTime(e.from), nullTime(e.from), nullTime(e.to), nullTime(e.to))
+	rows, err := e.tx.Query(q, args...)
+	if err != nil {
+		return fmt.Errorf("error fetching positions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p, err := scanPosition(rows)
+		if err != nil {
+			return fmt.Errorf("error scanning position: %w", err)
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating positions: %w", err)
+	}
+
+	return nil
+}
+
+// exportCount is the number of positions of an export and their id range.
+type exportCount struct {
+	positions       int
+	firstID, lastID int
+}
+
+func (e positionExport) count() (exportCount, error) {
+	q := /* sql */ `
+		SELECT COUNT(*), COALESCE(MIN(id), 0), COALESCE(MAX(id), 0)
+		FROM ` + e.source + `
+		WHERE (? IS NULL OR ts >= ?)
+		AND (? IS NULL OR ts <= ?);
+	`
+
+	var c exportCount
+	args := append(slices.Clone(e.args), nullTime(e.from), nullTime(e.from), nullTime(e.to), nullTime(e.to))
+	if err := e.tx.QueryRow(q, args...).Scan(&c.positions, &c.firstID, &c.lastID); err != nil {
+		return exportCount{}, fmt.Errorf("error counting positions: %w", err)
+	}
+	return c, nil
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"go.uber.org/zap"
 )
@@ -35,12 +36,21 @@ var (
 type contractData struct {
 	transactionHash string
 	block           int
+	logIndex        int // the index of the log in its block
 	leftMuscle      int64
 	rightMuscle     int64
 	price           float64
 	ts              time.Time
 }
 
+// fetchedRange is a range of blocks the fetcher processed along with the
+// updates logged in it, so that the range is only recorded once they're all
+// stored.
+type fetchedRange struct {
+	blockRange
+	updates []contractData
+}
+
 type blockFetcher struct {
 	log    *zap.Logger
 	client *ethclient.Client
@@ -48,42 +58,59 @@ type blockFetcher struct {
 }
 
 func NewBlockFetcher(log *zap.Logger) (*blockFetcher, error) {
+	return newBlockFetcherAt(log, hypeAPI)
+}
+
+// newBlockFetcherAt returns a fetcher reading the chain through the RPC
+// endpoint at url.
+func newBlockFetcherAt(log *zap.Logger, url string) (*blockFetcher, error) {
 	// Connect to Hyperliquid or any Ethereum-compatible blockchain
-	client, err := ethclient.Dial(hypeAPI)
+	client, err := ethclient.Dial(url)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to hype client: %w", err)
 	}
 
-	// ABI parsing
-	contractAbi, err := abi.JSON(strings.NewReader(abiStr))
+	contractAbi, err := parseContractABI()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse contract ABI: %w", err)
+		return nil, err
 	}
 
 	return &blockFetcher{log: log, client: client, abi: contractAbi}, nil
 }
 
+func parseContractABI() (abi.ABI, error) {
+	contractAbi, err := abi.JSON(strings.NewReader(abiStr))
+	if err != nil {
+		return abi.ABI{}, fmt.Errorf("failed to parse contract ABI: %w", err)
+	}
+	return contractAbi, nil
+}
+
 func (bf *blockFetcher) mockFetch() (contractData, error) {
 	return contractData{
 		block:       rand.Int(),
 		leftMuscle:  int64(rand.Intn(100)),
 		rightMuscle: int64(rand.Intn(100)),
 		price:       rand.Float64(),
-		ts:          time.Now(),
+		ts:          time.Now().UTC(),
 	}, nil
 }
 
-// fetch fetches the contract data from the blockchain and sends it to the
-// contractData channel. It also sends the latest block checked to the
-// latestBlock channel. It does so in batches of 50 blocks. However, if it
-// encounters an invalid block range, it will switch to single block fetching to
-// find the problematic block.
-func (bf *blockFetcher) fetch(contractDataCh chan contractData, latestBlockCh chan int, startBlock int) error {
-	if startBlock == 0 {
-		startBlock = initialBlock
+// fetch fetches the contract data of the blocks after checkpoint from the
+// blockchain, from the initial block when it's 0, and sends every block range
+// it processed, with its status and contract data, to the fetchedRange
+// channel. It does so in batches of 50 blocks.
+// However, if it encounters an invalid block range, it will switch to single
+// block fetching to find the problematic block, which is recorded as skipped.
+// A range that fails otherwise is recorded as failed before fetch returns. It
+// stops with the context's error once it's cancelled.
+func (bf *blockFetcher) fetch(ctx context.Context, rangeCh chan fetchedRange, checkpoint int) error {
+	startBlock := initialBlock
+	if checkpoint > 0 {
+		startBlock = checkpoint + 1
 	}
 
-	latestBlock, err := bf.getLatestBlock(context.TODO())
+	latestBlock, err := bf.getLatestBlock(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get latest block: %w", err)
 	}
@@ -92,20 +119,27 @@ func (bf *blockFetcher) fetch(contractDataCh chan contractData, latestBlockCh ch
 		"fetching blocks",
 		zap.Int("start", startBlock),
 		zap.Int("latest", latestBlock),
-		zap.Int("to_query", latestBlock-startBlock),
+		zap.Int("to_query", latestBlock-startBlock+1),
 	)
 
+	record := func(r blockRange, cds []contractData) error {
+		select {
+		case rangeCh <- fetchedRange{blockRange: r, updates: cds}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
 	// Start with batch size of 50
 	i := startBlock
 	batchSize := 50
 
-	for i < latestBlock {
-		from, to := i, i+batchSize
-		if to > latestBlock {
-			to = latestBlock
-		}
+	// Ranges include both ends
+	for i <= latestBlock {
+		from, to := i, min(i+batchSize-1, latestBlock)
 
-		cds, err := bf.fetchBlockRange(context.Background(), int64(from), int64(to))
+		cds, err := bf.fetchBlockRange(ctx, int64(from), int64(to))
 		if err != nil {
 			if errors.Is(err, errInvalidBlockRange) {
 				// If we hit an invalid block range and we're not already at
@@ -120,13 +154,27 @@ func (bf *blockFetcher) fetch(contractDataCh chan contractData, latestBlockCh ch
 				} else {
 					// We found the problematic block, log it and skip it
 					bf.log.Warn("found invalid block, skipping", zap.Int("block", i))
+					if err := record(blockRange{From: i, To: i, Status: BlockRangeSkippedInvalid, Error: err.Error()}, nil); err != nil {
+						return err
+					}
 					i++
 					continue // Skip to next block
 				}
 			}
+			if ctx.Err() == nil {
+				if err := record(blockRange{From: from, To: to, Status: BlockRangeFailed, Error: err.Error()}, nil); err != nil {
+					return err
+				}
+			}
 			return fmt.Errorf("failed to fetch block range: %w", err)
 		}
 
+		// Record the range as done along with its updates
+		if err := record(blockRange{From: from, To: to, Status: BlockRangeDone}, cds); err != nil {
+			return err
+		}
+		i = to + 1
+
 		// If we successfully fetched with batch size 1, try increasing batch
 		// size again
 		if batchSize == 1 {
@@ -134,13 +182,11 @@ func (bf *blockFetcher) fetch(contractDataCh chan contractData, latestBlockCh ch
 			bf.log.Info("resuming batch fetching", zap.Int("at_block", i))
 		}
 
-		for _, cd := range cds {
-			contractDataCh <- cd
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-
-		latestBlockCh <- to // Save the last block checked
-		i += batchSize
-		time.Sleep(1 * time.Second)
 	}
 
 	return nil
@@ -171,31 +217,44 @@ func (bf *blockFetcher) fetchBlockRange(ctx context.Context, from, to int64) ([]
 
 	// Decode logs
 	for _, vLog := range logs {
-		event := struct {
-			DeltaX            *big.Int
-			DeltaY            *big.Int
-			LeftMuscle        *big.Int
-			RightMuscle       *big.Int
-			PositionTimestamp *big.Int // timestamp is int?
-			PositionPrice     *big.Int // float or int?
-		}{}
-
-		if err := bf.abi.UnpackIntoInterface(&event, "WormStateUpdated", vLog.Data); err != nil {
+		cd, err := decodeLog(bf.abi, vLog)
+		if err != nil {
 			log.Sugar().Warnf("failed to unpack log data: %w", err)
 			continue
 		}
 
-		cd := contractData{
-			transactionHash: vLog.TxHash.String(),
-			block:           int(vLog.BlockNumber),
-			leftMuscle:      event.LeftMuscle.Int64(),
-			rightMuscle:     event.RightMuscle.Int64(),
-			price:           float64(event.PositionPrice.Int64()) / 10000000,
-			ts:              time.Unix(event.PositionTimestamp.Int64(), 0), // Set ts by converting the UNIX timestamp
+		if cd.leftMuscle == 0 && cd.rightMuscle == 0 {
+			log.Info("zero muscle movements, ignoring", zap.Int("block", cd.block))
+			continue
+		}
+
+		cds = append(cds, cd)
+	}
+
+	return cds, nil
+}
+
+// fetchTransaction returns the contract data of every non-zero worm state
+// update emitted by a transaction, in log order.
+func (bf *blockFetcher) fetchTransaction(ctx context.Context, txHash string) ([]contractData, error) {
+	receipt, err := bf.client.TransactionReceipt(ctx, common.HexToHash(txHash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch transaction receipt: %w", err)
+	}
+
+	cds := make([]contractData, 0, len(receipt.Logs))
+	for _, vLog := range receipt.Logs {
+		if vLog.Address != contractAddress {
+			continue
+		}
+
+		cd, err := decodeLog(bf.abi, *vLog)
+		if err != nil {
+			bf.log.Sugar().Warnf("failed to unpack log data: %w", err)
+			continue
 		}
 
 		if cd.leftMuscle == 0 && cd.rightMuscle == 0 {
-			log.Info("zero muscle movements, ignoring", zap.Int("block", cd.block))
 			continue
 		}
 
@@ -205,6 +264,32 @@ func (bf *blockFetcher) fetchBlockRange(ctx context.Context, from, to int64) ([]
 	return cds, nil
 }
 
+// decodeLog decodes a WormStateUpdated log of the contract.
+func decodeLog(contractAbi abi.ABI, vLog types.Log) (contractData, error) {
+	event := struct {
+		DeltaX            *big.Int
+		DeltaY            *big.Int
+		LeftMuscle        *big.Int
+		RightMuscle       *big.Int
+		PositionTimestamp *big.Int // timestamp is int?
+		PositionPrice     *big.Int // float or int?
+	}{}
+
+	if err := contractAbi.UnpackIntoInterface(&event, "WormStateUpdated", vLog.Data); err != nil {
+		return contractData{}, err
+	}
+
+	return contractData{
+		transactionHash: vLog.TxHash.String(),
+		block:           int(vLog.BlockNumber),
+		logIndex:        int(vLog.Index),
+		leftMuscle:      event.LeftMuscle.Int64(),
+		rightMuscle:     event.RightMuscle.Int64(),
+		price:           float64(event.PositionPrice.Int64()) / 10000000,
+		ts:              time.Unix(event.PositionTimestamp.Int64(), 0).UTC(), // Set ts by converting the UNIX timestamp
+	}, nil
+}
+
 func (bf *blockFetcher) getLatestBlock(ctx context.Context) (int, error) {
 	header, err := bf.client.HeaderByNumber(ctx, nil)
 	if err != nil {
@@ -0,0 +1,390 @@
+package src
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"time"
+)
+
+// maxHeatmapCells caps the number of cells in a heatmap grid.
+const maxHeatmapCells = 1000 * 1000
+
+// heatmapOccupancy counts the moves and the time the worm spent in each cell of
+// a square grid per hour, so that heatmaps of any window and of any multiple of
+// the cell size can be read without scanning the positions. The time spent at a
+// position runs until the next one arrives.
+type heatmapOccupancy struct {
+	cell float64
+}
+
+func NewHeatmapOccupancy(cell float64) (*heatmapOccupancy, error) {
+	if cell <= 0 {
+		return nil, fmt.Errorf("invalid heatmap cell %v: must be positive", cell)
+	}
+	return &heatmapOccupancy{cell: cell}, nil
+}
+
+// heatmapKey identifies a cell in an hour.
+type heatmapKey struct {
+	hour   time.Time
+	cx, cy int64
+}
+
+type heatmapCount struct {
+	moves   int
+	seconds float64
+}
+
+func (h *heatmapOccupancy) key(p position) heatmapKey {
+	return heatmapKey{
+		hour: p.Timestamp.UTC().Truncate(time.Hour),
+		cx:   int64(math.Floor(p.X / h.cell)),
+		cy:   int64(math.Floor(p.Y / h.cell)),
+	}
+}
+
+func (h *heatmapOccupancy) name() string { return "heatmap" }
+
+func (h *heatmapOccupancy) fingerprint() string {
+	return fmt.Sprintf("v1 cell=%v", h.cell)
+}
+
+func (h *heatmapOccupancy) apply(ex execer, p position) error {
+	counts := map[heatmapKey]heatmapCount{h.key(p): {moves: 1}}
+
+	prevQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` < (?, ?, ?)
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	prev, err := scanPosition(ex.QueryRow(prevQ, p.chainKey()...))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error fetching previous position: %w", err)
+	}
+	if err == nil {
+		c := counts[h.key(prev)]
+		c.seconds += math.Max(p.Timestamp.Sub(prev.Timestamp).Seconds(), 0)
+		counts[h.key(prev)] = c
+	}
+
+	return saveHeatmapCounts(ex, counts)
+}
+
+// rebuild counts the positions again. The hours of rolled up positions are
+// kept, their moves are gone, and only move to the new grid when the cell
+// size changed.
+func (h *heatmapOccupancy) rebuild(ex execer) error {
+	const batchSize = 1000
+
+	last, err := lastRolledUp(ex)
+	if err != nil {
+		return err
+	}
+	kept := last.Timestamp.UTC().Truncate(time.Hour)
+	if _, err := ex.Exec(`DELETE FROM heatmap_cells WHERE hour > ?;`, kept); err != nil {
+		return fmt.Errorf("error deleting heatmap: %w", err)
+	}
+	if last.ID != 0 {
+		if err := h.regrid(ex); err != nil {
+			return err
+		}
+	}
+
+	batchQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` > (?, ?, ?)
+		ORDER BY ` + chainOrder + `
+		LIMIT ?;
+	`
+
+	prev := last
+	for {
+		rows, err := ex.Query(batchQ, append(prev.chainKey(), batchSize)...)
+		if err != nil {
+			return fmt.Errorf("error fetching positions for heatmap: %w", err)
+		}
+		ps, err := scanPositions(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(ps) == 0 {
+			return nil
+		}
+
+		counts := make(map[heatmapKey]heatmapCount)
+		for _, p := range ps {
+			if !rolledUpBucket(last, p, time.Hour) {
+				c := counts[h.key(p)]
+				c.moves++
+				counts[h.key(p)] = c
+			}
+
+			if prev.ID != 0 && !rolledUpBucket(last, prev, time.Hour) {
+				c := counts[h.key(prev)]
+				c.seconds += math.Max(p.Timestamp.Sub(prev.Timestamp).Seconds(), 0)
+				counts[h.key(prev)] = c
+			}
+			prev = p
+		}
+
+		if err := saveHeatmapCounts(ex, counts); err != nil {
+			return err
+		}
+	}
+}
+
+// regrid moves the stored cells to the grid of the current cell size when the
+// counts were made with another one. A stored cell goes whole to the cell
+// holding its centre, as the positions it counted are gone.
+func (h *heatmapOccupancy) regrid(ex execer) error {
+	var fingerprint string
+	err := ex.QueryRow(`SELECT fingerprint FROM derivations WHERE name = ?;`, h.name()).Scan(&fingerprint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching heatmap fingerprint: %w", err)
+	}
+	var cell float64
+	if _, err := fmt.Sscanf(fingerprint, "v1 cell=%g", &cell); err != nil || cell <= 0 || cell == h.cell {
+		return nil
+	}
+
+	rows, err := ex.Query(`SELECT hour, cx, cy, moves, seconds FROM heatmap_cells;`)
+	if err != nil {
+		return fmt.Errorf("error fetching heatmap cells: %w", err)
+	}
+	counts := make(map[heatmapKey]heatmapCount)
+	for rows.Next() {
+		var (
+			k heatmapKey
+			c heatmapCount
+		)
+		if err := rows.Scan(&k.hour, &k.cx, &k.cy, &c.moves, &c.seconds); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning heatmap cell: %w", err)
+		}
+		k = h.key(position{
+			Timestamp: k.hour,
+			X:         (float64(k.cx) + 0.5) * cell,
+			Y:         (float64(k.cy) + 0.5) * cell,
+		})
+		n := counts[k]
+		n.moves += c.moves
+		n.seconds += c.seconds
+		counts[k] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error fetching heatmap cells: %w", err)
+	}
+
+	if _, err := ex.Exec(`DELETE FROM heatmap_cells;`); err != nil {
+		return fmt.Errorf("error deleting heatmap: %w", err)
+	}
+	return saveHeatmapCounts(ex, counts)
+}
+
+// saveHeatmapCounts adds counts to the stored cells.
+func saveHeatmapCounts(ex execer, counts map[heatmapKey]heatmapCount) error {
+	const q = /* sql */ `
+		INSERT INTO heatmap_cells (hour, cx, cy, moves, seconds)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (hour, cx, cy) DO UPDATE SET
+			moves = moves + excluded.moves,
+			seconds = seconds + excluded.seconds;
+	`
+
+	for k, c := range counts {
+		if _, err := ex.Exec(q, k.hour, k.cx, k.cy, c.moves, c.seconds); err != nil {
+			return fmt.Errorf("error saving heatmap cell: %w", err)
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// Grids
+
+var (
+	errHeatmapTooLarge    = errors.New("heatmap too large, use a larger cell")
+	errInvalidHeatmapCell = errors.New("invalid cell")
+)
+
+// heatmapGrid is a 2d histogram of the worm's moves or time. Values are
+// indexed by row then column, row 0 being the lowest y. Cell (column, row)
+// covers x from minX + column*cell and y from minY + row*cell.
+type heatmapGrid struct {
+	From    *time.Time  `json:"from"` // hour of the first counts included
+	To      *time.Time  `json:"to"`   // end of the hour of the last counts included
+	Weight  string      `json:"weight"`
+	Cell    float64     `json:"cell"`
+	MinX    float64     `json:"minX"`
+	MinY    float64     `json:"minY"`
+	Columns int         `json:"columns"`
+	Rows    int         `json:"rows"`
+	Max     float64     `json:"max"`
+	Total   float64     `json:"total"`
+	Values  [][]float64 `json:"values"`
+}
+
+// heatmap returns the registered heatmap derivation, nil when there is none.
+func (db *dbManager) heatmap() *heatmapOccupancy {
+	for _, d := range db.derivations {
+		if h, ok := d.(*heatmapOccupancy); ok {
+			return h
+		}
+	}
+	return nil
+}
+
+// fetchHeatmap sums the cells of the hours overlapping from and to into a grid
+// of cells of the given size, a multiple of the stored cell size. The weight is
+// either "moves" or "time".
+func (db *dbManager) fetchHeatmap(cell float64, weight string, from, to time.Time) (heatmapGrid, error) {
+	h := db.heatmap()
+	if h == nil {
+		return heatmapGrid{}, errors.New("heatmap not configured")
+	}
+
+	factor := int64(math.Round(cell / h.cell))
+	if factor < 1 || math.Abs(float64(factor)*h.cell-cell) > 1e-9*cell {
+		return heatmapGrid{}, fmt.Errorf("%w %v: must be a multiple of %v", errInvalidHeatmapCell, cell, h.cell)
+	}
+	if !from.IsZero() {
+		from = from.UTC().Truncate(time.Hour)
+	}
+
+	const q = /* sql */ `
+		SELECT cx, cy, SUM(moves), SUM(seconds), MIN(hour), MAX(hour)
+		FROM heatmap_cells
+		WHERE (?1 IS NULL OR hour >= ?1)
+		AND (?2 IS NULL OR hour <= ?2)
+		GROUP BY cx, cy;
+	`
+
+	rows, err := db.reader.Query(q, nullTime(from), nullTime(to))
+	if err != nil {
+		return heatmapGrid{}, fmt.Errorf("error fetching heatmap: %w", err)
+	}
+	defer rows.Close()
+
+	type binned struct{ gx, gy int64 }
+	values := make(map[binned]float64)
+	var first, last string
+	for rows.Next() {
+		var (
+			cx, cy           int64
+			moves            int
+			seconds          float64
+			minHour, maxHour string
+		)
+		if err := rows.Scan(&cx, &cy, &moves, &seconds, &minHour, &maxHour); err != nil {
+			return heatmapGrid{}, fmt.Errorf("error scanning heatmap cell: %w", err)
+		}
+		b := binned{floorDiv(cx, factor), floorDiv(cy, factor)}
+		if weight == "time" {
+			values[b] += seconds
+		} else {
+			values[b] += float64(moves)
+		}
+		if first == "" || minHour < first {
+			first = minHour
+		}
+		if maxHour > last {
+			last = maxHour
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return heatmapGrid{}, fmt.Errorf("error iterating heatmap: %w", err)
+	}
+
+	grid := heatmapGrid{Weight: weight, Cell: cell, Values: make([][]float64, 0)}
+	if len(values) == 0 {
+		return grid, nil
+	}
+
+	// The hours are aggregated as strings, they're stored in the same format
+	// so they sort in time order
+	if t, err := time.Parse(sqliteTimestampFormat, first); err == nil {
+		grid.From = &t
+	}
+	if t, err := time.Parse(sqliteTimestampFormat, last); err == nil {
+		end := t.Add(time.Hour)
+		grid.To = &end
+	}
+
+	var minGX, minGY, maxGX, maxGY int64 = math.MaxInt64, math.MaxInt64, math.MinInt64, math.MinInt64
+	for b := range values {
+		minGX, maxGX = min(minGX, b.gx), max(maxGX, b.gx)
+		minGY, maxGY = min(minGY, b.gy), max(maxGY, b.gy)
+	}
+	grid.Columns, grid.Rows = int(maxGX-minGX+1), int(maxGY-minGY+1)
+	if grid.Columns*grid.Rows > maxHeatmapCells {
+		return heatmapGrid{}, errHeatmapTooLarge
+	}
+	grid.MinX, grid.MinY = float64(minGX)*cell, float64(minGY)*cell
+
+	grid.Values = make([][]float64, grid.Rows)
+	for i := range grid.Values {
+		grid.Values[i] = make([]float64, grid.Columns)
+	}
+	for b, v := range values {
+		grid.Values[b.gy-minGY][b.gx-minGX] = v
+		grid.Max = max(grid.Max, v)
+		grid.Total += v
+	}
+
+	return grid, nil
+}
+
+// sqliteTimestampFormat is the format the sqlite driver stores times in.
+const sqliteTimestampFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// floorDiv divides rounding towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// render draws the grid with scale pixels per cell, north up. Values are
+// mapped through a square root so that rarely visited cells stay visible.
+func (g heatmapGrid) render(scale int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, g.Columns*scale, g.Rows*scale))
+	for row, values := range g.Values {
+		for col, v := range values {
+			var c color.RGBA
+			if g.Max > 0 {
+				c = heatColor(math.Sqrt(v / g.Max))
+			} else {
+				c = heatColor(0)
+			}
+			top := (g.Rows - 1 - row) * scale
+			for y := top; y < top+scale; y++ {
+				for x := col * scale; x < (col+1)*scale; x++ {
+					img.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// heatColor maps [0, 1] from black through red and yellow to white.
+func heatColor(f float64) color.RGBA {
+	channel := func(from float64) uint8 {
+		return uint8(math.Round(255 * math.Max(0, math.Min(1, (f-from)*3))))
+	}
+	return color.RGBA{R: channel(0), G: channel(1.0 / 3), B: channel(2.0 / 3), A: 255}
+}
@@ -0,0 +1,551 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/types"
+	"go.uber.org/zap"
+)
+
+var (
+	errInvalidImportFormat = errors.New("invalid format: must be ndjson, csv or logs")
+	errImportNotEmpty      = errors.New("positions can only be imported into an empty database")
+	errInvalidImport       = errors.New("invalid import")
+)
+
+// ImportOptions describe what is being imported.
+type ImportOptions struct {
+	Format     string // ndjson or csv exports, or logs for an archive of raw contract logs
+	Checkpoint int    // the latest block checked to resume ingestion after, 0 for the last imported block
+	Positions  int    // the number of positions expected, 0 doesn't check
+}
+
+// ImportFormatFromExtension infers the format of an import file from its
+// extension, logs archives have to be named explicitly.
+func ImportFormatFromExtension(path string) (string, error) {
+	switch {
+	case strings.HasSuffix(path, ".ndjson"):
+		return "ndjson", nil
+	case strings.HasSuffix(path, ".csv"):
+		return "csv", nil
+	}
+	return "", fmt.Errorf("can't infer the format of %q, set it explicitly", path)
+}
+
+// importResult describes a finished import.
+type importResult struct {
+	Positions  int `json:"positions"`
+	Skipped    int `json:"skipped"` // logs of an archive that aren't worm state updates
+	LastID     int `json:"lastId"`
+	LastBlock  int `json:"lastBlock"`
+	Checkpoint int `json:"checkpoint"` // the latest block checked, where ingestion resumes
+}
+
+// importJob asks the worm loop to run an import. The loop owns the latest
+// position and the fetcher so it has to be the one importing.
+type importJob struct {
+	ctx  context.Context
+	r    io.Reader
+	opts ImportOptions
+	done chan importDone
+}
+
+type importDone struct {
+	result importResult
+	err    error
+}
+
+// importer seeds an empty database with the positions of another instance,
+// recomputing them with the configured model to check they continue each
+// other.
+type importer struct {
+	log       *zap.Logger
+	db        *dbManager
+	cfg       LocomotionConfig // the configured locomotion model
+	model     LocomotionModel
+	arena     *arena
+	anomalies AnomalyConfig
+	jobs      chan importJob
+}
+
+// NewImporter returns the importer of the store, nil when the store isn't
+// SQLite.
+func NewImporter(log *zap.Logger, store Store, cfg LocomotionConfig, arena *arena, anomalies AnomalyConfig) (*importer, error) {
+	db, ok := store.(*dbManager)
+	if !ok {
+		return nil, nil
+	}
+	cfg = cfg.normalized()
+	model, err := NewLocomotionModel(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := NewAnomalyDetector(anomalies); err != nil {
+		return nil, err
+	}
+	return &importer{
+		log:       log,
+		db:        db,
+		cfg:       cfg,
+		model:     model,
+		arena:     arena,
+		anomalies: anomalies,
+		jobs:      make(chan importJob),
+	}, nil
+}
+
+// Import imports straight into the database. It must only be used while the
+// worm loop isn't running.
+func (im *importer) Import(ctx context.Context, r io.Reader, opts ImportOptions) (importResult, error) {
+	result, _, err := im.run(ctx, r, opts)
+	return result, err
+}
+
+// Submit hands an import to the worm loop and waits for it to finish.
+func (im *importer) Submit(ctx context.Context, r io.Reader, opts ImportOptions) (importResult, error) {
+	job := importJob{ctx: ctx, r: r, opts: opts, done: make(chan importDone, 1)}
+	select {
+	case im.jobs <- job:
+	case <-ctx.Done():
+		return importResult{}, ctx.Err()
+	}
+
+	select {
+	case d := <-job.done:
+		return d.result, d.err
+	case <-ctx.Done():
+		return importResult{}, ctx.Err()
+	}
+}
+
+// run imports the positions in a single transaction and returns the latest
+// position along with the result.
+func (im *importer) run(ctx context.Context, r io.Reader, opts ImportOptions) (importResult, position, error) {
+	if opts.Checkpoint < 0 {
+		return importResult{}, position{}, fmt.Errorf("%w: negative checkpoint", errInvalidImport)
+	}
+	records, err := newImportReader(r, opts.Format)
+	if err != nil {
+		return importResult{}, position{}, err
+	}
+	detector, err := NewAnomalyDetector(im.anomalies)
+	if err != nil {
+		return importResult{}, position{}, err
+	}
+
+	tx, err := im.db.begin(ctx)
+	if err != nil {
+		return importResult{}, position{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkImportEmpty(tx); err != nil {
+		return importResult{}, position{}, err
+	}
+
+	params := trajectoryParams{Locomotion: im.cfg, Arena: im.arena.cfg}
+	if err := describeActiveTrajectory(tx, im.model, params); err != nil {
+		return importResult{}, position{}, err
+	}
+
+	var (
+		result importResult
+		prev   position
+		lastID int
+		flags  []string
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return importResult{}, position{}, err
+		}
+
+		rec, err := records.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return importResult{}, position{}, err
+		}
+
+		np, err := im.continuePosition(prev, rec)
+		if err != nil {
+			return importResult{}, position{}, err
+		}
+		np.Anomalies = detector.check(np)
+		flags = append(flags, np.Anomalies...)
+
+		// Exported positions keep their ids, raw logs are numbered in order
+		if rec.stored {
+			var duplicate bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM positions WHERE id = ?);`, np.ID).Scan(&duplicate); err != nil {
+				return importResult{}, position{}, fmt.Errorf("error checking position id: %w", err)
+			}
+			if duplicate {
+				return importResult{}, position{}, fmt.Errorf("%w: position %d is imported twice", errInvalidImport, np.ID)
+			}
+		}
+		if np.ID, err = insertPositionAt(tx, np.ID, np); err != nil {
+			return importResult{}, position{}, err
+		}
+		prev, lastID = np, max(lastID, np.ID)
+		result.Positions++
+	}
+
+	// Unique ids from 1 up to as many as there are positions leave none out
+	if lastID != result.Positions {
+		return importResult{}, position{}, fmt.Errorf(
+			"%w: ids up to %d hold %d positions, imports must hold every position from the first on",
+			errInvalidImport, lastID, result.Positions,
+		)
+	}
+
+	result.Skipped = records.skipped()
+	result.LastID, result.LastBlock = lastID, prev.Block
+	if opts.Positions > 0 && result.Positions != opts.Positions {
+		return importResult{}, position{}, fmt.Errorf("%w: read %d positions, expected %d", errInvalidImport, result.Positions, opts.Positions)
+	}
+
+	// The ledger of a database without positions was recorded by a fetcher
+	// that found nothing yet, the import's replaces it
+	result.Checkpoint = opts.Checkpoint
+	if result.Checkpoint == 0 {
+		result.Checkpoint = prev.Block
+	}
+	if err := seedBlockRanges(tx, result.Checkpoint); err != nil {
+		return importResult{}, position{}, err
+	}
+
+	if err := im.db.rebuildDerivations(tx); err != nil {
+		return importResult{}, position{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return importResult{}, position{}, fmt.Errorf("error committing import: %w", err)
+	}
+	countAnomalies(flags)
+
+	return result, prev, nil
+}
+
+// checkImportEmpty refuses databases holding any history. Rolled up positions
+// are history too, and once positions were stored the ids of imported ones no
+// longer start from 1. A ledger of done ranges only was recorded by a fetcher
+// that found nothing yet and is replaced, skipped or failed ranges are gaps in
+// a history the import would lose track of.
+func checkImportEmpty(ex execer) error {
+	const q = /* sql */ `
+		SELECT
+			EXISTS (SELECT 1 FROM positions),
+			EXISTS (SELECT 1 FROM retention_buckets) OR EXISTS (SELECT 1 FROM retention_points),
+			COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'positions'), 0),
+			EXISTS (SELECT 1 FROM block_ranges WHERE status != 'done');
+	`
+	var (
+		positions, rolledUp, gaps bool
+		seq                       int
+	)
+	if err := ex.QueryRow(q).Scan(&positions, &rolledUp, &seq, &gaps); err != nil {
+		return fmt.Errorf("error checking the database is empty: %w", err)
+	}
+
+	switch {
+	case positions:
+		return fmt.Errorf("%w: it holds positions", errImportNotEmpty)
+	case rolledUp:
+		return fmt.Errorf("%w: it holds rolled up positions", errImportNotEmpty)
+	case seq > 0:
+		return fmt.Errorf("%w: positions up to id %d were stored and deleted", errImportNotEmpty, seq)
+	case gaps:
+		return fmt.Errorf("%w: its ledger holds skipped or failed block ranges", errImportNotEmpty)
+	}
+	return nil
+}
+
+// continuePosition computes the position following prev in chain order from
+// an imported record. Records carrying their muscle inputs are recomputed with
+// the configured model and must land where they were stored, the others are
+// taken as they are. Exported positions keep their ids, the ones of raw logs
+// are left 0.
+func (im *importer) continuePosition(prev position, rec importRecord) (position, error) {
+	p := rec.p
+	if rec.stored && p.ID <= 0 {
+		return position{}, fmt.Errorf("%w: invalid position id %d", errInvalidImport, p.ID)
+	}
+	if p.Block < prev.Block || p.Block == prev.Block && p.LogIndex < prev.LogIndex {
+		return position{}, fmt.Errorf(
+			"%w: log %d of block %d comes after log %d of block %d, positions must be in chain order",
+			errInvalidImport, p.LogIndex, p.Block, prev.LogIndex, prev.Block,
+		)
+	}
+
+	if p.LeftMuscle == nil || p.RightMuscle == nil {
+		k := computeKinematics(prev, p)
+		p.Kinematics = &k
+		return p, nil
+	}
+
+	np := updatePosition(im.model, im.arena, p.contractData(), prev)
+	np.ID = p.ID
+	if !rec.stored {
+		return np, nil
+	}
+
+	if p.Model != np.Model || p.ModelVersion != np.ModelVersion {
+		return position{}, fmt.Errorf(
+			"%w: position %d was computed with %s v%d, not the configured %s v%d, recompute the source with the configured model first",
+			errInvalidImport, p.ID, p.Model, p.ModelVersion, np.Model, np.ModelVersion,
+		)
+	}
+	if !sameCoordinate(p.X, np.X) || !sameCoordinate(p.Y, np.Y) || !sameCoordinate(p.Direction, np.Direction) {
+		return position{}, fmt.Errorf(
+			"%w: position %d recomputes to (%g, %g) heading %g, not the stored (%g, %g) heading %g",
+			errInvalidImport, p.ID, np.X, np.Y, np.Direction, p.X, p.Y, p.Direction,
+		)
+	}
+
+	return np, nil
+}
+
+// sameCoordinate reports whether a recomputed value matches a stored one,
+// allowing for the rounding of the export.
+func sameCoordinate(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*max(1, math.Abs(b))
+}
+
+// -----------------------------------------------------------------------------
+// Reading
+
+// importRecord is a position read from an import. Exports carry the position
+// as it was stored, raw logs only the contract data it's computed from.
+type importRecord struct {
+	p      position
+	stored bool
+}
+
+// importReader reads the records of an import in order, io.EOF once they run
+// out.
+type importReader interface {
+	next() (importRecord, error)
+	skipped() int
+}
+
+func newImportReader(r io.Reader, format string) (importReader, error) {
+	switch format {
+	case "ndjson":
+		return &ndjsonImport{dec: json.NewDecoder(r)}, nil
+	case "csv":
+		return newCSVImport(r)
+	case "logs":
+		return newLogsImport(r)
+	}
+	return nil, errInvalidImportFormat
+}
+
+type ndjsonImport struct {
+	dec  *json.Decoder
+	line int
+}
+
+func (im *ndjsonImport) next() (importRecord, error) {
+	var p position
+	if err := im.dec.Decode(&p); err != nil {
+		if errors.Is(err, io.EOF) {
+			return importRecord{}, io.EOF
+		}
+		return importRecord{}, fmt.Errorf("%w: record %d: %v", errInvalidImport, im.line+1, err)
+	}
+	im.line++
+	p.Kinematics, p.Behaviour, p.Anomalies = nil, "", nil
+	return importRecord{p: p, stored: true}, nil
+}
+
+func (im *ndjsonImport) skipped() int { return 0 }
+
+type csvImport struct {
+	r *csv.Reader
+}
+
+func newCSVImport(r io.Reader) (*csvImport, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+
+	// Exports made before log indexes were recorded lack the last column, the
+	// header sets the number of fields of every record
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading the header: %v", errInvalidImport, err)
+	}
+	if !slices.Equal(header, exportCSVHeader) && !slices.Equal(header, exportCSVHeader[:len(exportCSVHeader)-1]) {
+		return nil, fmt.Errorf("%w: the header must be %s", errInvalidImport, strings.Join(exportCSVHeader, ","))
+	}
+	return &csvImport{r: cr}, nil
+}
+
+func (im *csvImport) next() (importRecord, error) {
+	record, err := im.r.Read()
+	if errors.Is(err, io.EOF) {
+		return importRecord{}, io.EOF
+	}
+	line, _ := im.r.FieldPos(0)
+	if err != nil {
+		return importRecord{}, fmt.Errorf("%w: %v", errInvalidImport, err)
+	}
+
+	var errs []error
+	parseInt := func(s string) int {
+		i, err := strconv.Atoi(s)
+		errs = append(errs, err)
+		return i
+	}
+	parseFloat := func(s string) float64 {
+		f, err := strconv.ParseFloat(s, 64)
+		errs = append(errs, err)
+		return f
+	}
+	parseMuscle := func(s string) *int64 {
+		if s == "" {
+			return nil
+		}
+		m, err := strconv.ParseInt(s, 10, 64)
+		errs = append(errs, err)
+		return &m
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, record[3])
+	errs = append(errs, err)
+	collision, err := strconv.ParseBool(record[12])
+	errs = append(errs, err)
+
+	p := position{
+		ID:              parseInt(record[0]),
+		Block:           parseInt(record[1]),
+		TransactionHash: record[2],
+		Timestamp:       ts,
+		X:               parseFloat(record[4]),
+		Y:               parseFloat(record[5]),
+		Direction:       parseFloat(record[6]),
+		Price:           parseFloat(record[7]),
+		LeftMuscle:      parseMuscle(record[8]),
+		RightMuscle:     parseMuscle(record[9]),
+		Model:           record[10],
+		ModelVersion:    parseInt(record[11]),
+		Collision:       collision,
+	}
+	if len(record) == len(exportCSVHeader) {
+		p.LogIndex = parseInt(record[15])
+	}
+	if err := errors.Join(errs...); err != nil {
+		return importRecord{}, fmt.Errorf("%w: line %d: %v", errInvalidImport, line, err)
+	}
+	return importRecord{p: p, stored: true}, nil
+}
+
+func (im *csvImport) skipped() int { return 0 }
+
+// logsImport reads an archive of raw contract logs as returned by
+// eth_getLogs, either as a JSON array or one log per line. The logs are
+// filtered the way the fetcher filters them.
+type logsImport struct {
+	dec         *json.Decoder
+	array       bool
+	abi         abi.ABI
+	logs        int
+	last        *types.Log // the last log that wasn't removed
+	skippedLogs int
+}
+
+func newLogsImport(r io.Reader) (*logsImport, error) {
+	contractAbi, err := parseContractABI()
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	im := &logsImport{dec: json.NewDecoder(br), abi: contractAbi}
+
+	// an array is read element by element rather than all at once
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			break
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			br.ReadByte()
+			continue
+		}
+		if b[0] == '[' {
+			if _, err := im.dec.Token(); err != nil {
+				return nil, fmt.Errorf("%w: %v", errInvalidImport, err)
+			}
+			im.array = true
+		}
+		break
+	}
+	return im, nil
+}
+
+func (im *logsImport) next() (importRecord, error) {
+	for {
+		if im.array && !im.dec.More() {
+			return importRecord{}, io.EOF
+		}
+
+		var vLog types.Log
+		if err := im.dec.Decode(&vLog); err != nil {
+			if errors.Is(err, io.EOF) {
+				return importRecord{}, io.EOF
+			}
+			return importRecord{}, fmt.Errorf("%w: log %d: %v", errInvalidImport, im.logs+1, err)
+		}
+		im.logs++
+
+		// removed logs were reorganised out of the chain
+		if vLog.Removed {
+			im.skippedLogs++
+			continue
+		}
+		if last := im.last; last != nil && (vLog.BlockNumber < last.BlockNumber ||
+			vLog.BlockNumber == last.BlockNumber && vLog.Index <= last.Index) {
+			return importRecord{}, fmt.Errorf(
+				"%w: log %d of block %d comes after log %d of block %d, logs must be in chain order",
+				errInvalidImport, vLog.Index, vLog.BlockNumber, last.Index, last.BlockNumber,
+			)
+		}
+		im.last = &vLog
+
+		if vLog.Address != contractAddress {
+			im.skippedLogs++
+			continue
+		}
+		cd, err := decodeLog(im.abi, vLog)
+		if err != nil || cd.leftMuscle == 0 && cd.rightMuscle == 0 {
+			im.skippedLogs++
+			continue
+		}
+
+		p := position{
+			Block:           cd.block,
+			LogIndex:        cd.logIndex,
+			TransactionHash: cd.transactionHash,
+			Price:           cd.price,
+			Timestamp:       cd.ts,
+			LeftMuscle:      &cd.leftMuscle,
+			RightMuscle:     &cd.rightMuscle,
+		}
+		return importRecord{p: p}, nil
+	}
+}
+
+func (im *logsImport) skipped() int { return im.skippedLogs }
@@ -0,0 +1,64 @@
+package src
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckImportEmpty(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, db *dbManager)
+		empty bool
+	}{
+		{"Empty", func(*testing.T, *dbManager) {}, true},
+		{"DoneLedger", func(t *testing.T, db *dbManager) {
+			if err := db.RecordBlockRange(blockRange{From: initialBlock, To: initialBlock + 10, Status: BlockRangeDone}); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"Positions", func(t *testing.T, db *dbManager) {
+			if _, err := db.SavePosition(benchmarkPosition(0, position{})); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"DeletedPositions", func(t *testing.T, db *dbManager) {
+			if _, err := db.SavePosition(benchmarkPosition(0, position{})); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.writer.Exec(`DELETE FROM positions;`); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"RolledUp", func(t *testing.T, db *dbManager) {
+			const q = /* sql */ `
+				INSERT INTO retention_points
+					(bucket, start_ts, id, blck, transaction_hash, x, y, direction, price, ts, model, model_version, collision)
+				VALUES ('1h', '2025-01-01 00:00:00', 1, 1, '0x1', 0, 0, 0, 1, '2025-01-01 00:00:00', 'legacy', 1, 0);
+			`
+			if _, err := db.writer.Exec(q); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"LedgerGaps", func(t *testing.T, db *dbManager) {
+			if err := db.RecordBlockRange(blockRange{From: initialBlock, To: initialBlock, Status: BlockRangeSkippedInvalid}); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			tt.setup(t, db)
+
+			err := checkImportEmpty(db.writer)
+			if tt.empty && err != nil {
+				t.Errorf("empty database refused: %v", err)
+			}
+			if !tt.empty && !errors.Is(err, errImportNotEmpty) {
+				t.Errorf("got %v, want errImportNotEmpty", err)
+			}
+		})
+	}
+}
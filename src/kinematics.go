@@ -0,0 +1,228 @@
+package src
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// kinematics describes a move relative to the previous position. Rates are 0
+// when the two positions share a timestamp.
+type kinematics struct {
+	StepLength      float64 `json:"stepLength"`      // distance moved since the previous position
+	HeadingChange   float64 `json:"headingChange"`   // signed change in direction in degrees, in (-180, 180]
+	Speed           float64 `json:"speed"`           // step length per second
+	AngularVelocity float64 `json:"angularVelocity"` // heading change in degrees per second
+	PathLength      float64 `json:"pathLength"`      // total distance travelled up to and including this move
+	Displacement    float64 `json:"displacement"`    // straight line distance from the origin
+}
+
+// kinematicsSample is a position's kinematics as a time series entry.
+type kinematicsSample struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	kinematics
+}
+
+// computeKinematics derives the kinematics of the move from prev to p. The
+// zero position is the origin the worm starts from.
+func computeKinematics(prev, p position) kinematics {
+	k := kinematics{
+		StepLength:    math.Hypot(p.X-prev.X, p.Y-prev.Y),
+		HeadingChange: headingChange(prev.Direction, p.Direction),
+		Displacement:  math.Hypot(p.X, p.Y),
+	}
+
+	k.PathLength = k.StepLength
+	if prev.Kinematics != nil {
+		k.PathLength += prev.Kinematics.PathLength
+	}
+
+	if !prev.Timestamp.IsZero() {
+		if dt := p.Timestamp.Sub(prev.Timestamp).Seconds(); dt > 0 {
+			k.Speed = k.StepLength / dt
+			k.AngularVelocity = k.HeadingChange / dt
+		}
+	}
+
+	return k
+}
+
+// headingChange returns the signed smallest turn from one direction to
+// another, in degrees.
+func headingChange(from, to float64) float64 {
+	d := math.Mod(to-from, 360)
+	if d > 180 {
+		d -= 360
+	} else if d <= -180 {
+		d += 360
+	}
+	return d
+}
+
+// kinematicsColumns are the nullable kinematics columns shared by positions and
+// trajectory_points.
+var kinematicsColumns = []string{
+	"step_length",
+	"heading_change",
+	"speed",
+	"angular_velocity",
+	"path_length",
+	"displacement",
+}
+
+// nullKinematics scans nullable kinematics columns, positions stored before the
+// kinematics were computed have none.
+type nullKinematics struct {
+	stepLength      sql.NullFloat64
+	headingChange   sql.NullFloat64
+	speed           sql.NullFloat64
+	angularVelocity sql.NullFloat64
+	pathLength      sql.NullFloat64
+	displacement    sql.NullFloat64
+}
+
+func (n *nullKinematics) dest() []any {
+	return []any{
+		&n.stepLength,
+		&n.headingChange,
+		&n.speed,
+		&n.angularVelocity,
+		&n.pathLength,
+		&n.displacement,
+	}
+}
+
+func (n *nullKinematics) kinematics() *kinematics {
+	if !n.pathLength.Valid {
+		return nil
+	}
+	return &kinematics{
+		StepLength:      n.stepLength.Float64,
+		HeadingChange:   n.headingChange.Float64,
+		Speed:           n.speed.Float64,
+		AngularVelocity: n.angularVelocity.Float64,
+		PathLength:      n.pathLength.Float64,
+		Displacement:    n.displacement.Float64,
+	}
+}
+
+// kinematicsArgs returns the column values of a position's kinematics.
+func kinematicsArgs(k *kinematics) []any {
+	if k == nil {
+		return []any{nil, nil, nil, nil, nil, nil}
+	}
+	return []any{k.StepLength, k.HeadingChange, k.Speed, k.AngularVelocity, k.PathLength, k.Displacement}
+}
+
+// backfillKinematics computes the kinematics of positions stored before they
+// were computed. Positions are replayed in order from the first one missing
+// them so that path lengths accumulate correctly.
+func backfillKinematics(ex execer) error {
+	const batchSize = 1000
+
+	var first sql.NullInt64
+	if err := ex.QueryRow(`SELECT MIN(id) FROM positions WHERE path_length IS NULL;`).Scan(&first); err != nil {
+		return fmt.Errorf("error finding positions missing kinematics: %w", err)
+	}
+	if !first.Valid {
+		return nil
+	}
+
+	// The positions had no log index yet when migration 4 ran, and were all
+	// stored in the order of the chain
+	const source = /* sql */ `(SELECT *, 0 AS log_index FROM positions) AS positions`
+
+	prevQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		WHERE id < ?
+		ORDER BY id DESC
+		LIMIT 1;
+	`
+	prev, err := scanPosition(ex.QueryRow(prevQ, first.Int64))
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error fetching position before missing kinematics: %w", err)
+	}
+
+	batchQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		WHERE id >= ?
+		ORDER BY id ASC
+		LIMIT ?;
+	`
+	updateQ := /* sql */ `
+		UPDATE positions
+		SET step_length = ?, heading_change = ?, speed = ?, angular_velocity = ?,
+			path_length = ?, displacement = ?
+		WHERE id = ?;
+	`
+
+	from := int(first.Int64)
+	for {
+		rows, err := ex.Query(batchQ, from, batchSize)
+		if err != nil {
+			return fmt.Errorf("error fetching positions missing kinematics: %w", err)
+		}
+		ps, err := scanPositions(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(ps) == 0 {
+			return nil
+		}
+
+		for _, p := range ps {
+			k := computeKinematics(prev, p)
+			p.Kinematics = &k
+			if _, err := ex.Exec(updateQ, append(kinematicsArgs(p.Kinematics), p.ID)...); err != nil {
+				return fmt.Errorf("error saving kinematics: %w", err)
+			}
+			prev = p
+		}
+
+		from = prev.ID + 1
+	}
+}
+
+// fetchKinematics returns up to limit kinematics samples of a trajectory
+// version between from and to, in order. A zero from or to leaves that end of
+// the range open.
+func (db *dbManager) fetchKinematics(from, to time.Time, limit, version int) ([]kinematicsSample, error) {
+	source, args, err := db.positionsSource(version)
+	if err != nil {
+		return nil, err
+	}
+
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		WHERE path_length IS NOT NULL
+		AND (? IS NULL OR ts >= ?)
+		AND (? IS NULL OR ts <= ?)
+		ORDER BY ` + chainOrder + `
+		LIMIT ?;
+	`
+
+	args = append(args, nullTime(from), nullTime(from), nullTime(to), nullTime(to), limit)
+	rows, err := db.reader.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching kinematics: %w", err)
+	}
+	defer rows.Close()
+
+	ps, err := scanPositions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]kinematicsSample, 0, len(ps))
+	for _, p := range ps {
+		samples = append(samples, kinematicsSample{ID: p.ID, Timestamp: p.Timestamp, kinematics: *p.Kinematics})
+	}
+
+	return samples, nil
+}
@@ -0,0 +1,306 @@
+package src
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// The ledger records the block ranges the fetcher processed and how each one
+// went. A range recorded over blocks already in the ledger replaces them, and
+// contiguous ranges with the same status are merged, so the ledger stays one
+// row per run of blocks. Blocks between the initial block and the latest one
+// recorded that aren't done are the gaps in the worm's history.
+
+// Statuses of the block ranges in the ledger.
+const (
+	BlockRangeDone           = "done"            // the logs were fetched and ingested
+	BlockRangeSkippedInvalid = "skipped-invalid" // the RPC refused the block as an invalid range
+	BlockRangeFailed         = "failed"          // fetching the range failed
+)
+
+// Status of the gaps that were never recorded.
+const blockRangeMissing = "missing"
+
+// BlockRange is a range of blocks in the ledger, as it's stored.
+type BlockRange = blockRange
+
+var errInvalidLedgerRange = errors.New("invalid block range: must run forward from a block above 0 with a known status")
+
+type blockRange struct {
+	From      int       `json:"from"` // inclusive
+	To        int       `json:"to"`   // inclusive
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"` // why the range isn't done
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (r blockRange) validate() error {
+	if r.From <= 0 || r.To < r.From {
+		return fmt.Errorf("%w: %d-%d", errInvalidLedgerRange, r.From, r.To)
+	}
+	switch r.Status {
+	case BlockRangeDone, BlockRangeSkippedInvalid, BlockRangeFailed:
+		return nil
+	default:
+		return fmt.Errorf("%w: status %q", errInvalidLedgerRange, r.Status)
+	}
+}
+
+// recordBlockRange returns the ranges, in order and without overlaps, with r
+// recorded over them and compacted.
+func recordBlockRange(ranges []blockRange, r blockRange) []blockRange {
+	recorded := make([]blockRange, 0, len(ranges)+2)
+	for _, o := range ranges {
+		if o.To < r.From || o.From > r.To {
+			recorded = append(recorded, o)
+			continue
+		}
+		// keep the parts of o that r doesn't cover
+		if o.From < r.From {
+			left := o
+			left.To = r.From - 1
+			recorded = append(recorded, left)
+		}
+		if o.To > r.To {
+			right := o
+			right.From = r.To + 1
+			recorded = append(recorded, right)
+		}
+	}
+	recorded = append(recorded, r)
+	slices.SortFunc(recorded, func(a, b blockRange) int { return cmp.Compare(a.From, b.From) })
+
+	return compactBlockRanges(recorded)
+}
+
+// compactBlockRanges merges the contiguous ranges with the same status of
+// ranges in order, keeping the error of the latest one updated.
+func compactBlockRanges(ranges []blockRange) []blockRange {
+	compacted := make([]blockRange, 0, len(ranges))
+	for _, r := range ranges {
+		n := len(compacted)
+		if n == 0 || compacted[n-1].Status != r.Status || compacted[n-1].To+1 < r.From {
+			compacted = append(compacted, r)
+			continue
+		}
+		last := &compacted[n-1]
+		last.To = max(last.To, r.To)
+		if r.UpdatedAt.After(last.UpdatedAt) {
+			last.Error, last.UpdatedAt = r.Error, r.UpdatedAt
+		}
+	}
+	return compacted
+}
+
+// coverageGap is a range of blocks up to the latest one recorded that isn't
+// done, either never recorded or recorded with another status.
+type coverageGap struct {
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Blocks int    `json:"blocks"`
+	Status string `json:"status"` // missing when the blocks were never recorded
+	Error  string `json:"error,omitempty"`
+}
+
+// coverageGaps returns the gaps in ranges in order, starting from the initial
+// block.
+func coverageGaps(ranges []blockRange) []coverageGap {
+	gaps := make([]coverageGap, 0)
+	next := initialBlock
+	for _, r := range ranges {
+		if r.From > next {
+			gaps = append(gaps, coverageGap{From: next, To: r.From - 1, Status: blockRangeMissing})
+		}
+		if r.Status != BlockRangeDone {
+			gaps = append(gaps, coverageGap{From: r.From, To: r.To, Status: r.Status, Error: r.Error})
+		}
+		next = max(next, r.To+1)
+	}
+	for i := range gaps {
+		gaps[i].Blocks = gaps[i].To - gaps[i].From + 1
+	}
+	return gaps
+}
+
+// coverage is the ledger of a store with its gaps.
+type coverage struct {
+	Checkpoint int           `json:"checkpoint"` // the latest block recorded
+	Ranges     []blockRange  `json:"ranges"`
+	Gaps       []coverageGap `json:"gaps"`
+}
+
+// Coverage returns the ledger of a store with its gaps.
+func Coverage(store Store) (coverage, error) {
+	ranges, err := store.BlockRanges()
+	if err != nil {
+		return coverage{}, err
+	}
+	c := coverage{Ranges: ranges, Gaps: coverageGaps(ranges)}
+	if len(ranges) > 0 {
+		c.Checkpoint = ranges[len(ranges)-1].To
+	}
+	return c, nil
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+// RecordBlockRange records how a range of blocks went over whatever the ledger
+// held for them.
+func (db *dbManager) RecordBlockRange(r blockRange) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if r.UpdatedAt.IsZero() {
+		r.UpdatedAt = time.Now().UTC()
+	}
+
+	tx, err := db.begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := saveBlockRange(tx, r); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing block range: %w", err)
+	}
+	return nil
+}
+
+// saveBlockRange records a valid range over the ledger.
+func saveBlockRange(ex execer, r blockRange) error {
+	// Only the ranges r overlaps or touches can change
+	neighbours, err := queryBlockRanges(ex, r.From-1, r.To+1)
+	if err != nil {
+		return err
+	}
+	for _, n := range neighbours {
+		if _, err := ex.Exec(`DELETE FROM block_ranges WHERE start_block = ?;`, n.From); err != nil {
+			return fmt.Errorf("error deleting block range: %w", err)
+		}
+	}
+	for _, n := range recordBlockRange(neighbours, r) {
+		if err := insertBlockRange(ex, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BlockRanges returns the ledger, in order.
+func (db *dbManager) BlockRanges() ([]blockRange, error) {
+	return queryBlockRanges(db.reader, 0, -1)
+}
+
+// queryBlockRanges returns the ranges overlapping from and to, in order. A
+// negative to leaves the end open.
+func queryBlockRanges(ex execer, from, to int) ([]blockRange, error) {
+	const q = /* sql */ `
+		SELECT start_block, end_block, status, error, updated_at
+		FROM block_ranges
+		WHERE end_block >= ?1 AND (?2 < 0 OR start_block <= ?2)
+		ORDER BY start_block ASC;
+	`
+	rows, err := ex.Query(q, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching block ranges: %w", err)
+	}
+	defer rows.Close()
+
+	ranges := make([]blockRange, 0)
+	for rows.Next() {
+		var r blockRange
+		if err := rows.Scan(&r.From, &r.To, &r.Status, &r.Error, &r.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning block range: %w", err)
+		}
+		ranges = append(ranges, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating block ranges: %w", err)
+	}
+	return ranges, nil
+}
+
+func insertBlockRange(ex execer, r blockRange) error {
+	const q = /* sql */ `
+		INSERT INTO block_ranges (start_block, end_block, status, error, updated_at)
+		VALUES (?, ?, ?, ?, ?);
+	`
+	if _, err := ex.Exec(q, r.From, r.To, r.Status, r.Error, r.UpdatedAt); err != nil {
+		return fmt.Errorf("error saving block range: %w", err)
+	}
+	return nil
+}
+
+// seedBlockRanges replaces the ledger with a single done range from the initial
+// block up to checkpoint, for histories whose ranges weren't recorded.
+func seedBlockRanges(ex execer, checkpoint int) error {
+	if _, err := ex.Exec(`DELETE FROM block_ranges;`); err != nil {
+		return fmt.Errorf("error clearing block ranges: %w", err)
+	}
+	if checkpoint <= 0 {
+		return nil
+	}
+	r := blockRange{From: min(initialBlock, checkpoint), To: checkpoint, Status: BlockRangeDone, UpdatedAt: time.Now().UTC()}
+	return insertBlockRange(ex, r)
+}
+
+// createBlockRanges replaces blocks_checked with the ledger. The blocks up to
+// the latest one checked are taken as done, the ones skipped before were
+// never recorded.
+func createBlockRanges(ex execer) error {
+	const q = /* sql */ `
+		CREATE TABLE IF NOT EXISTS block_ranges (
+			start_block INTEGER PRIMARY KEY, -- inclusive
+			end_block   INTEGER NOT NULL,    -- inclusive
+			status      TEXT NOT NULL,       -- done, skipped-invalid or failed
+			error       TEXT NOT NULL DEFAULT '',
+			updated_at  TIMESTAMP NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS block_ranges_end ON block_ranges (end_block);
+	`
+	if _, err := ex.Exec(q); err != nil {
+		return fmt.Errorf("error creating block ranges: %w", err)
+	}
+
+	var checkpoint int
+	if err := ex.QueryRow(`SELECT COALESCE(MAX(blck), 0) FROM blocks_checked;`).Scan(&checkpoint); err != nil {
+		return fmt.Errorf("error getting latest block checked: %w", err)
+	}
+	if err := seedBlockRanges(ex, checkpoint); err != nil {
+		return err
+	}
+
+	if _, err := ex.Exec(`DROP TABLE blocks_checked;`); err != nil {
+		return fmt.Errorf("error dropping blocks checked: %w", err)
+	}
+	return nil
+}
+
+// dropBlockRanges puts blocks_checked back with the latest block recorded.
+func dropBlockRanges(ex execer) error {
+	const q = /* sql */ `
+		CREATE TABLE IF NOT EXISTS blocks_checked (
+			blck INTEGER PRIMARY KEY
+		);
+
+		INSERT OR IGNORE INTO blocks_checked (blck) VALUES (0);
+		INSERT OR IGNORE INTO blocks_checked (blck)
+		SELECT end_block FROM block_ranges ORDER BY end_block DESC LIMIT 1;
+
+		DROP TABLE block_ranges;
+	`
+	if _, err := ex.Exec(q); err != nil {
+		return fmt.Errorf("error dropping block ranges: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package src
+
+import (
+	"fmt"
+	"math"
+)
+
+// LocomotionModel turns a pair of muscle activations into a move on the 2d
+// plane. Directions are in degrees, counter-clockwise from the positive x
+// axis. Every model has a name and a version, the version must be bumped
+// whenever the output of the model changes so that stored positions can be
+// traced back to the rule that produced them. The parameters a model was built
+// with are recorded by the trajectories it builds.
+type LocomotionModel interface {
+	Name() string
+	Version() int
+	// Config returns the normalized configuration the model was built with.
+	Config() LocomotionConfig
+	Move(x, y, direction float64, left, right int64) (nx, ny, nDirection float64)
+}
+
+const (
+	LegacyModel            = "legacy"
+	DifferentialDriveModel = "diffdrive"
+	MidpointModel          = "midpoint"
+)
+
+// LocomotionConfig selects and parameterises a locomotion model. Wheelbase and
+// Gain are only used by the differential drive model.
+type LocomotionConfig struct {
+	Model     string  `json:"model"`
+	Wheelbase float64 `json:"wheelbase,omitempty"`
+	Gain      float64 `json:"gain,omitempty"`
+}
+
+// normalized fills in the default model and drops the parameters the model
+// doesn't use, so that equal configurations compare equal.
+func (cfg LocomotionConfig) normalized() LocomotionConfig {
+	if cfg.Model == "" {
+		cfg.Model = LegacyModel
+	}
+	if cfg.Model != DifferentialDriveModel {
+		cfg.Wheelbase, cfg.Gain = 0, 0
+	}
+	return cfg
+}
+
+// DefaultWheelbase makes the differential drive model turn at the same rate as
+// the legacy model, (right-left)/2 degrees per move, when the gain is 1.
+const DefaultWheelbase = 360 / math.Pi
+
+func NewLocomotionModel(cfg LocomotionConfig) (LocomotionModel, error) {
+	switch cfg.Model {
+	case "", LegacyModel:
+		return legacyModel{}, nil
+	case MidpointModel:
+		return midpointModel{}, nil
+	case DifferentialDriveModel:
+		if cfg.Wheelbase <= 0 {
+			return nil, fmt.Errorf("invalid wheelbase %v: must be positive", cfg.Wheelbase)
+		}
+		if cfg.Gain <= 0 {
+			return nil, fmt.Errorf("invalid gain %v: must be positive", cfg.Gain)
+		}
+		return differentialDriveModel{wheelbase: cfg.Wheelbase, gain: cfg.Gain}, nil
+	default:
+		return nil, fmt.Errorf("unknown locomotion model %q", cfg.Model)
+	}
+}
+
+// legacyModel is the original rule: the heading changes by (right-left)/2
+// degrees and the step of (right+left)/2 is taken along the old heading.
+type legacyModel struct{}
+
+func (legacyModel) Name() string { return LegacyModel }
+func (legacyModel) Version() int { return 1 }
+func (legacyModel) Config() LocomotionConfig {
+	return LocomotionConfig{Model: LegacyModel}
+}
+
+func (legacyModel) Move(x, y, direction float64, left, right int64) (float64, float64, float64) {
+	angle := float64(right-left) / 2
+	magnitude := float64(right+left) / 2
+
+	dX := magnitude * math.Cos(direction*math.Pi/180)
+	dY := magnitude * math.Sin(direction*math.Pi/180)
+
+	return x + dX, y + dY, normalizeDirection(direction + angle)
+}
+
+// midpointModel uses the same heading change and step length as the legacy
+// model but takes the step along the average of the old and new headings.
+type midpointModel struct{}
+
+func (midpointModel) Name() string { return MidpointModel }
+func (midpointModel) Version() int { return 1 }
+func (midpointModel) Config() LocomotionConfig {
+	return LocomotionConfig{Model: MidpointModel}
+}
+
+func (midpointModel) Move(x, y, direction float64, left, right int64) (float64, float64, float64) {
+	angle := float64(right-left) / 2
+	magnitude := float64(right+left) / 2
+
+	heading := (direction + angle/2) * math.Pi / 180
+	dX := magnitude * math.Cos(heading)
+	dY := magnitude * math.Sin(heading)
+
+	return x + dX, y + dY, normalizeDirection(direction + angle)
+}
+
+// differentialDriveModel treats the muscles as the speeds of two wheels a
+// wheelbase apart and integrates the resulting arc exactly.
+type differentialDriveModel struct {
+	wheelbase float64
+	gain      float64
+}
+
+func (differentialDriveModel) Name() string { return DifferentialDriveModel }
+func (differentialDriveModel) Version() int { return 1 }
+func (m differentialDriveModel) Config() LocomotionConfig {
+	return LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: m.wheelbase, Gain: m.gain}
+}
+
+func (m differentialDriveModel) Move(x, y, direction float64, left, right int64) (float64, float64, float64) {
+	vl := m.gain * float64(left)
+	vr := m.gain * float64(right)
+
+	distance := (vl + vr) / 2
+	theta := direction * math.Pi / 180
+	dTheta := (vr - vl) / m.wheelbase
+
+	var dX, dY float64
+	if math.Abs(dTheta) < 1e-9 {
+		// Driving straight, the arc radius is infinite
+		dX = distance * math.Cos(theta)
+		dY = distance * math.Sin(theta)
+	} else {
+		radius := distance / dTheta
+		dX = radius * (math.Sin(theta+dTheta) - math.Sin(theta))
+		dY = -radius * (math.Cos(theta+dTheta) - math.Cos(theta))
+	}
+
+	return x + dX, y + dY, normalizeDirection(direction + dTheta*180/math.Pi)
+}
+
+// normalizeDirection wraps a direction in degrees into [0, 360).
+func normalizeDirection(d float64) float64 {
+	d = math.Mod(d, 360)
+	if d < 0 {
+		d += 360
+	}
+	if d >= 360 {
+		d = 0
+	}
+	return d
+}
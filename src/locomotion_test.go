@@ -0,0 +1,108 @@
+package src
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLocomotionModels(t *testing.T) {
+	diffDrive := LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: DefaultWheelbase, Gain: 1}
+	r := 180 / math.Pi // the radius of a quarter turn over 90 at the default wheelbase
+
+	tests := []struct {
+		name                string
+		cfg                 LocomotionConfig
+		x, y, direction     float64
+		left, right         int64
+		wantX, wantY, wantD float64
+	}{
+		{"LegacyDefault", LocomotionConfig{}, 0, 0, 0, 2, 4, 3, 0, 1},
+		{"LegacyOldHeading", LocomotionConfig{Model: LegacyModel}, 1, 1, 90, 0, 180, 1, 91, 180},
+		{"LegacyWrapsHeading", LocomotionConfig{Model: LegacyModel}, 0, 0, 359, 0, 4, 2 * math.Cos(359*math.Pi/180), 2 * math.Sin(359*math.Pi/180), 1},
+		{"LegacyBackwards", LocomotionConfig{Model: LegacyModel}, 0, 0, 0, -4, -2, -3, 0, 1},
+		{"MidpointHeading", LocomotionConfig{Model: MidpointModel}, 0, 0, 0, 0, 180, 90 * math.Sqrt2 / 2, 90 * math.Sqrt2 / 2, 90},
+		{"MidpointStraight", LocomotionConfig{Model: MidpointModel}, 0, 0, 90, 10, 10, 0, 10, 90},
+		{"DiffDriveStraight", diffDrive, 0, 0, 0, 10, 10, 10, 0, 0},
+		{"DiffDriveQuarterTurn", diffDrive, 0, 0, 0, 0, 180, r, r, 90},
+		{"DiffDriveSpin", diffDrive, 5, 5, 90, -90, 90, 5, 5, 180},
+		{"DiffDriveGain", LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: DefaultWheelbase, Gain: 2}, 0, 0, 0, 5, 5, 10, 0, 0},
+		{"DiffDriveWheelbase", LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: 2 * DefaultWheelbase, Gain: 1}, 0, 0, 0, -90, 90, 0, 0, 45},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewLocomotionModel(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			x, y, d := m.Move(tt.x, tt.y, tt.direction, tt.left, tt.right)
+			if math.Abs(x-tt.wantX) > 1e-9 || math.Abs(y-tt.wantY) > 1e-9 || math.Abs(d-tt.wantD) > 1e-9 {
+				t.Errorf("moved to (%v, %v) heading %v, want (%v, %v) heading %v", x, y, d, tt.wantX, tt.wantY, tt.wantD)
+			}
+		})
+	}
+}
+
+// The default wheelbase turns the differential drive at the rate of the
+// legacy model.
+func TestDefaultWheelbase(t *testing.T) {
+	if want := 360 / math.Pi; DefaultWheelbase != want {
+		t.Fatalf("default wheelbase is %v, want %v", DefaultWheelbase, want)
+	}
+
+	drive, err := NewLocomotionModel(LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: DefaultWheelbase, Gain: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range [][2]int64{{0, 10}, {10, 0}, {-30, 45}, {7, 7}, {100, -100}} {
+		_, _, got := drive.Move(0, 0, 30, m[0], m[1])
+		_, _, want := legacyModel{}.Move(0, 0, 30, m[0], m[1])
+		if math.Abs(got-want) > 1e-9 {
+			t.Errorf("muscles %v turn the differential drive to %v, want %v", m, got, want)
+		}
+	}
+}
+
+func TestNewLocomotionModel(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     LocomotionConfig
+		want    LocomotionConfig
+		wantErr bool
+	}{
+		{"DefaultsToLegacy", LocomotionConfig{}, LocomotionConfig{Model: LegacyModel}, false},
+		{"DropsUnusedParams", LocomotionConfig{Model: MidpointModel, Wheelbase: 3, Gain: 2}, LocomotionConfig{Model: MidpointModel}, false},
+		{"KeepsDiffDriveParams", LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: 3, Gain: 2}, LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: 3, Gain: 2}, false},
+		{"ZeroWheelbase", LocomotionConfig{Model: DifferentialDriveModel, Gain: 1}, LocomotionConfig{}, true},
+		{"NegativeGain", LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: 1, Gain: -1}, LocomotionConfig{}, true},
+		{"Unknown", LocomotionConfig{Model: "crawl"}, LocomotionConfig{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewLocomotionModel(tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got model %v, want an error", m.Config())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Config() != tt.want || m.Config() != tt.cfg.normalized() {
+				t.Errorf("model config is %+v, want %+v", m.Config(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDirection(t *testing.T) {
+	for _, tt := range []struct{ d, want float64 }{
+		{0, 0}, {359, 359}, {360, 0}, {725, 5}, {-90, 270}, {-360, 0}, {-1e-20, 0},
+	} {
+		if got := normalizeDirection(tt.d); got != tt.want {
+			t.Errorf("normalizeDirection(%v) = %v, want %v", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package src
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the positions and the ledger in memory, for tests and dry
+// runs. Positions are copied in and out so that callers never share them.
+type memoryStore struct {
+	mu        sync.RWMutex
+	positions []position
+	ranges    []blockRange // in order, without overlaps
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) SavePosition(p position) (position, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p.ID = len(m.positions) + 1
+	m.positions = append(m.positions, clonePosition(p))
+	return p, nil
+}
+
+func (m *memoryStore) LatestPosition() (position, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.positions) == 0 {
+		return position{}, nil
+	}
+	return clonePosition(m.positions[len(m.positions)-1]), nil
+}
+
+func (m *memoryStore) Positions(id, limit int) ([]position, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// ids run from 1 without gaps so they index the slice
+	from := min(max(id, 0), len(m.positions))
+	to := min(from+max(limit, 0), len(m.positions))
+	return clonePositions(m.positions[from:to]), nil
+}
+
+func (m *memoryStore) RecentPositions(limit int) ([]position, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	from := max(len(m.positions)-max(limit, 0), 0)
+	return clonePositions(m.positions[from:]), nil
+}
+
+func (m *memoryStore) HasUpdate(transactionHash string, logIndex int) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.ContainsFunc(m.positions, func(p position) bool {
+		return p.TransactionHash == transactionHash && p.LogIndex == logIndex
+	}), nil
+}
+
+func (m *memoryStore) Sample(count int, method string) ([]position, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	points := make([]pathPoint, 0, len(m.positions))
+	for _, p := range m.positions {
+		points = append(points, pathPoint{ID: p.ID, Timestamp: p.Timestamp, X: p.X, Y: p.Y})
+	}
+
+	indices := samplePath(points, count, method)
+	sample := make([]position, 0, len(indices))
+	for _, i := range indices {
+		sample = append(sample, clonePosition(m.positions[i]))
+	}
+	return sample, nil
+}
+
+func (m *memoryStore) StateAtBlock(block int) (stateAt, error) {
+	at, next, err := m.neighbours(func(p position) bool { return p.Block > block })
+	if err != nil {
+		return stateAt{}, err
+	}
+	return stateAtBlock(block, at, next), nil
+}
+
+func (m *memoryStore) StateAtTime(ts time.Time) (stateAt, error) {
+	at, next, err := m.neighbours(func(p position) bool { return p.Timestamp.After(ts) })
+	if err != nil {
+		return stateAt{}, err
+	}
+	return stateAtTime(ts, at, next), nil
+}
+
+// neighbours returns the last position before the first one that's past a
+// moment, and that one. Positions are stored in the order of the chain, so
+// their blocks and times only grow.
+func (m *memoryStore) neighbours(past func(p position) bool) (position, *position, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.positions), func(i int) bool { return past(m.positions[i]) })
+	if i == 0 {
+		return position{}, nil, errBeforeFirstPosition
+	}
+	at := clonePosition(m.positions[i-1])
+	if i == len(m.positions) {
+		return at, nil, nil
+	}
+	next := clonePosition(m.positions[i])
+	return at, &next, nil
+}
+
+func (m *memoryStore) RecordBlockRange(r blockRange) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if r.UpdatedAt.IsZero() {
+		r.UpdatedAt = time.Now().UTC()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ranges = recordBlockRange(m.ranges, r)
+	return nil
+}
+
+func (m *memoryStore) BlockRanges() ([]blockRange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append(make([]blockRange, 0, len(m.ranges)), m.ranges...), nil
+}
+
+func (m *memoryStore) LatestCheckpoint() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.ranges) == 0 {
+		return 0, nil
+	}
+	return m.ranges[len(m.ranges)-1].To, nil
+}
+
+func (m *memoryStore) Close() error { return nil }
+
+// clonePosition returns a copy of p that shares nothing with it.
+func clonePosition(p position) position {
+	if p.LeftMuscle != nil {
+		left := *p.LeftMuscle
+		p.LeftMuscle = &left
+	}
+	if p.RightMuscle != nil {
+		right := *p.RightMuscle
+		p.RightMuscle = &right
+	}
+	if p.Kinematics != nil {
+		k := *p.Kinematics
+		p.Kinematics = &k
+	}
+	p.Anomalies = slices.Clone(p.Anomalies)
+	return p
+}
+
+func clonePositions(ps []position) []position {
+	clones := make([]position, 0, len(ps))
+	for _, p := range ps {
+		clones = append(clones, clonePosition(p))
+	}
+	return clones
+}
@@ -0,0 +1,361 @@
+package src
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The schema is built by an ordered set of migrations. SQL migrations are
+// embedded from migrations/NNNN_name.up.sql and NNNN_name.down.sql, migrations
+// that need Go are listed in goMigrations. Versions must run from 1 without
+// gaps, every migration is applied in its own transaction and recorded in
+// schema_migrations.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var errSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// migration moves the schema one version up, or back down. A nil down can't be
+// reverted.
+type migration struct {
+	version int
+	name    string
+	up      func(ex execer) error
+	down    func(ex execer) error
+}
+
+var goMigrations = []migration{
+	{
+		version: 2,
+		name:    "legacy_columns",
+		up:      addLegacyColumns,
+		down:    func(execer) error { return nil }, // the columns go with their tables
+	},
+	{
+		version: 4,
+		name:    "backfill_kinematics",
+		up:      backfillKinematics,
+		down:    func(execer) error { return nil },
+	},
+	{
+		version: 7,
+		name:    "block_ranges",
+		up:      createBlockRanges,
+		down:    dropBlockRanges,
+	},
+}
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// loadMigrations returns every migration in version order.
+func loadMigrations() ([]migration, error) {
+	byVersion := make(map[int]*migration)
+	for _, m := range goMigrations {
+		m := m
+		byVersion[m.version] = &m
+	}
+
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+	for _, e := range entries {
+		match := migrationFileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", e.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		b, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", e.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.name, match[2])
+		}
+		exec := execSQL(string(b))
+		if match[3] == "up" {
+			m.up = exec
+		} else {
+			m.down = exec
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == nil {
+			return nil, fmt.Errorf("migration %d %s has no up migration", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("missing migration %d", i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+func execSQL(q string) func(ex execer) error {
+	return func(ex execer) error {
+		_, err := ex.Exec(q)
+		return err
+	}
+}
+
+// migrationStatus is a migration and when it was applied, if it was.
+type migrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+func (db *dbManager) initializeMigrations() error {
+	createMigrations := /* sql */ `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);`
+
+	if _, err := db.writer.Exec(createMigrations); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	return nil
+}
+
+// schemaVersion returns the version of the latest applied migration, 0 for an
+// empty database.
+func (db *dbManager) schemaVersion() (int, error) {
+	var version int
+	if err := db.reader.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations;`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("error getting schema version: %w", err)
+	}
+	return version, nil
+}
+
+// MigrateUp applies the migrations up to version, every migration when version
+// is 0. It refuses to touch a database migrated further than this binary knows.
+func (db *dbManager) MigrateUp(log *zap.Logger, version int) error {
+	migrations, current, err := db.prepareMigrations()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		version = len(migrations)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("unknown migration %d, the latest is %d", version, len(migrations))
+	}
+	if version < current {
+		return fmt.Errorf("already at migration %d, migrate down to revert migrations", current)
+	}
+
+	for _, m := range migrations[current:version] {
+		log.Info("applying migration", zap.Int("version", m.version), zap.String("name", m.name))
+
+		const q = /* sql */ `
+			INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?);
+		`
+		if err := db.migrate(m, m.up, q, m.version, m.name, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the migrations after version, 0 reverting every one and
+// leaving an empty database.
+func (db *dbManager) MigrateDown(log *zap.Logger, version int) error {
+	migrations, current, err := db.prepareMigrations()
+	if err != nil {
+		return err
+	}
+	if version < 0 {
+		return fmt.Errorf("invalid migration %d", version)
+	}
+
+	for i := current - 1; i >= version; i-- {
+		m := migrations[i]
+		if m.down == nil {
+			return fmt.Errorf("migration %d %s can't be reverted", m.version, m.name)
+		}
+
+		log.Info("reverting migration", zap.Int("version", m.version), zap.String("name", m.name))
+
+		const q = /* sql */ `
+			DELETE FROM schema_migrations WHERE version = ?;
+		`
+		if err := db.migrate(m, m.down, q, m.version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus lists every migration this binary knows, and when each was
+// applied.
+func (db *dbManager) MigrationStatus() ([]migrationStatus, error) {
+	migrations, _, err := db.prepareMigrations()
+	if err != nil && !errors.Is(err, errSchemaTooNew) {
+		return nil, err
+	}
+
+	rows, err := db.reader.Query(`SELECT version, name, applied_at FROM schema_migrations ORDER BY version ASC;`)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]migrationStatus)
+	for rows.Next() {
+		var s migrationStatus
+		if err := rows.Scan(&s.Version, &s.Name, &s.AppliedAt); err != nil {
+			return nil, fmt.Errorf("error scanning migration: %w", err)
+		}
+		applied[s.Version] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating migrations: %w", err)
+	}
+
+	statuses := make([]migrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := migrationStatus{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			s.AppliedAt = a.AppliedAt
+			delete(applied, m.version)
+		}
+		statuses = append(statuses, s)
+	}
+
+	// migrations applied by a newer binary
+	for _, s := range applied {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// prepareMigrations returns the known migrations and the current schema
+// version, which has to be one of them.
+func (db *dbManager) prepareMigrations() ([]migration, int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := db.initializeMigrations(); err != nil {
+		return nil, 0, err
+	}
+	current, err := db.schemaVersion()
+	if err != nil {
+		return nil, 0, err
+	}
+	if current > len(migrations) {
+		return migrations, current, fmt.Errorf("%w: at version %d, this binary knows up to %d", errSchemaTooNew, current, len(migrations))
+	}
+	return migrations, current, nil
+}
+
+// migrate runs step of a migration and records it with q in one transaction.
+func (db *dbManager) migrate(m migration, step func(ex execer) error, q string, args ...any) error {
+	tx, err := db.begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Scripts may hold several statements, which can't be prepared
+	if err := step(tx.Tx); err != nil {
+		return fmt.Errorf("error running migration %d %s: %w", m.version, m.name, err)
+	}
+	if _, err := tx.Exec(q, args...); err != nil {
+		return fmt.Errorf("error recording migration %d %s: %w", m.version, m.name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migration %d %s: %w", m.version, m.name, err)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// Go migrations
+
+// addLegacyColumns adds the columns that databases created before migrations
+// were introduced may lack, depending on the version of the tracker that
+// created them.
+func addLegacyColumns(ex execer) error {
+	// Positions stored before locomotion models existed were all produced by
+	// version 1 of the legacy model, which the column defaults reflect.
+	columns := [][2]string{
+		{"model", "TEXT NOT NULL DEFAULT 'legacy'"},
+		{"model_version", "INTEGER NOT NULL DEFAULT 1"},
+		{"collision", "BOOLEAN NOT NULL DEFAULT 0"},
+		// Older positions were stored without their muscle inputs, these are
+		// left NULL until the muscle backfill recovers them.
+		{"left_muscle", "INTEGER"},
+		{"right_muscle", "INTEGER"},
+	}
+	// The kinematics of older positions are computed by migration 4
+	for _, column := range kinematicsColumns {
+		columns = append(columns, [2]string{column, "FLOAT"})
+	}
+	columns = append(columns,
+		[2]string{"behaviour", "TEXT"},
+		[2]string{"anomalies", "TEXT"},
+	)
+
+	for _, c := range columns {
+		if err := addColumnIfMissing(ex, "positions", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	for _, column := range kinematicsColumns {
+		if err := addColumnIfMissing(ex, "trajectory_points", column, "FLOAT"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table.
+func addColumnIfMissing(ex execer, table, column, definition string) error {
+	var exists bool
+	q := /* sql */ `SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?;`
+	if err := ex.QueryRow(q, table, column).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to read %s table info: %w", table, err)
+	}
+	if exists {
+		return nil
+	}
+
+	alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition)
+	if _, err := ex.Exec(alter); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+
+	return nil
+}
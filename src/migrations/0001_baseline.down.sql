@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS heatmap_cells;
+DROP TABLE IF EXISTS positions_rtree;
+DROP TABLE IF EXISTS series_rollups;
+DROP TABLE IF EXISTS behaviour_episodes;
+DROP TABLE IF EXISTS derivations;
+DROP TABLE IF EXISTS trajectory_points;
+DROP TABLE IF EXISTS trajectories;
+DROP TABLE IF EXISTS blocks_checked;
+DROP TABLE IF EXISTS positions;
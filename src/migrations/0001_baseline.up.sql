@@ -0,0 +1,118 @@
+-- The schema as it stood before migrations were introduced. Tables are only
+-- created when missing so that databases created back then are adopted, the
+-- columns they may lack are added by migration 2.
+
+CREATE TABLE IF NOT EXISTS positions (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	blck             INTEGER NOT NULL, -- the block number
+	transaction_hash TEXT NOT NULL, -- the transaction hash
+	x                FLOAT NOT NULL,
+	y                FLOAT NOT NULL,
+	direction        FLOAT NOT NULL,
+	price            FLOAT NOT NULL,
+	ts               TIMESTAMP NOT NULL,
+	model            TEXT NOT NULL DEFAULT 'legacy', -- the locomotion model
+	model_version    INTEGER NOT NULL DEFAULT 1,     -- the locomotion model version
+	collision        BOOLEAN NOT NULL DEFAULT 0,     -- whether the move hit the arena boundary
+	left_muscle      INTEGER, -- NULL when the muscle inputs were never recorded
+	right_muscle     INTEGER,
+	step_length      FLOAT, -- kinematics, NULL until computed
+	heading_change   FLOAT,
+	speed            FLOAT,
+	angular_velocity FLOAT,
+	path_length      FLOAT,
+	displacement     FLOAT,
+	behaviour        TEXT, -- the behavioural state, NULL until labelled
+	anomalies        TEXT  -- comma separated data quality anomalies, NULL when there are none
+);
+
+CREATE TABLE IF NOT EXISTS blocks_checked (
+	blck INTEGER PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS trajectories (
+	version       INTEGER PRIMARY KEY AUTOINCREMENT,
+	model         TEXT NOT NULL,
+	model_version INTEGER NOT NULL,
+	params        TEXT NOT NULL DEFAULT '{}', -- JSON encoded trajectoryParams
+	status        TEXT NOT NULL,
+	error         TEXT NOT NULL DEFAULT '',
+	created_at    TIMESTAMP NOT NULL,
+	activated_at  TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS trajectory_points (
+	version          INTEGER NOT NULL, -- the trajectory version
+	id               INTEGER NOT NULL, -- the positions id
+	x                FLOAT NOT NULL,
+	y                FLOAT NOT NULL,
+	direction        FLOAT NOT NULL,
+	collision        BOOLEAN NOT NULL,
+	model            TEXT NOT NULL,
+	model_version    INTEGER NOT NULL,
+	step_length      FLOAT,
+	heading_change   FLOAT,
+	speed            FLOAT,
+	angular_velocity FLOAT,
+	path_length      FLOAT,
+	displacement     FLOAT,
+	PRIMARY KEY (version, id)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS derivations (
+	name        TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL -- the configuration the derivation was built with
+);
+
+CREATE TABLE IF NOT EXISTS behaviour_episodes (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	state       TEXT NOT NULL,
+	start_id    INTEGER NOT NULL, -- the first position of the episode
+	end_id      INTEGER NOT NULL, -- the last position of the episode
+	start_ts    TIMESTAMP NOT NULL, -- when the first move started
+	end_ts      TIMESTAMP NOT NULL,
+	start_x     FLOAT NOT NULL, -- where the first move started
+	start_y     FLOAT NOT NULL,
+	end_x       FLOAT NOT NULL,
+	end_y       FLOAT NOT NULL,
+	moves       INTEGER NOT NULL,
+	path_length FLOAT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS series_rollups (
+	bucket       TEXT NOT NULL, -- one of the seriesBuckets
+	start_ts     TIMESTAMP NOT NULL,
+	first_id     INTEGER NOT NULL,
+	last_id      INTEGER NOT NULL,
+	open         FLOAT NOT NULL,
+	high         FLOAT NOT NULL,
+	low          FLOAT NOT NULL,
+	close        FLOAT NOT NULL,
+	moves        INTEGER NOT NULL,
+	muscle_moves INTEGER NOT NULL, -- moves that recorded their muscles
+	left_sum     INTEGER NOT NULL,
+	right_sum    INTEGER NOT NULL,
+	distance     FLOAT NOT NULL,
+	start_x      FLOAT NOT NULL,
+	start_y      FLOAT NOT NULL,
+	end_x        FLOAT NOT NULL,
+	end_y        FLOAT NOT NULL,
+	PRIMARY KEY (bucket, start_ts)
+) WITHOUT ROWID;
+
+-- R*Tree coordinates are 32 bit floats rounded outwards, lookups go through
+-- the index and then check the exact coordinates in positions.
+CREATE VIRTUAL TABLE IF NOT EXISTS positions_rtree USING rtree (
+	id,
+	min_x, max_x,
+	min_y, max_y
+);
+
+CREATE TABLE IF NOT EXISTS heatmap_cells (
+	hour    TIMESTAMP NOT NULL,
+	cx      INTEGER NOT NULL, -- floor(x / cell)
+	cy      INTEGER NOT NULL,
+	moves   INTEGER NOT NULL, -- positions in the cell
+	seconds FLOAT NOT NULL,   -- time spent in the cell
+	PRIMARY KEY (hour, cx, cy)
+) WITHOUT ROWID;
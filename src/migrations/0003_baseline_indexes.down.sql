@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS behaviour_episodes_start_ts;
+DROP INDEX IF EXISTS positions_anomalies;
+DROP INDEX IF EXISTS positions_ts;
+DROP INDEX IF EXISTS positions_blck;
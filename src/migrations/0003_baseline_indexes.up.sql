@@ -0,0 +1,20 @@
+-- Range queries on positions are by time and block number, flagged positions
+-- are few so they are indexed on their own
+CREATE INDEX IF NOT EXISTS positions_blck ON positions (blck);
+CREATE INDEX IF NOT EXISTS positions_ts ON positions (ts);
+CREATE INDEX IF NOT EXISTS positions_anomalies ON positions (id) WHERE anomalies IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS behaviour_episodes_start_ts ON behaviour_episodes (start_ts);
+
+-- The fetcher starts from the block after the latest one checked
+INSERT OR IGNORE INTO blocks_checked (blck) VALUES (0);
+
+-- The positions stored before trajectories were versioned become version 1
+INSERT INTO trajectories (model, model_version, status, created_at, activated_at)
+SELECT
+	COALESCE((SELECT model FROM positions ORDER BY id DESC LIMIT 1), 'legacy'),
+	COALESCE((SELECT model_version FROM positions ORDER BY id DESC LIMIT 1), 1),
+	'active',
+	strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'),
+	strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')
+WHERE NOT EXISTS (SELECT 1 FROM trajectories);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS positions_transaction_hash;
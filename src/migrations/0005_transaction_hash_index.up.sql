@@ -0,0 +1,2 @@
+-- Positions are matched with the transactions that carried them by hash
+CREATE INDEX IF NOT EXISTS positions_transaction_hash ON positions (transaction_hash);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS retention_points;
+DROP TABLE IF EXISTS retention_buckets;
@@ -0,0 +1,44 @@
+-- Positions older than the full resolution window are rolled up into the
+-- buckets of the retention tiers, with the same aggregates as series_rollups
+CREATE TABLE IF NOT EXISTS retention_buckets (
+	bucket       TEXT NOT NULL, -- the tier, one of the seriesBuckets
+	start_ts     TIMESTAMP NOT NULL,
+	first_id     INTEGER NOT NULL,
+	last_id      INTEGER NOT NULL,
+	open         FLOAT NOT NULL,
+	high         FLOAT NOT NULL,
+	low          FLOAT NOT NULL,
+	close        FLOAT NOT NULL,
+	moves        INTEGER NOT NULL,
+	muscle_moves INTEGER NOT NULL,
+	left_sum     INTEGER NOT NULL,
+	right_sum    INTEGER NOT NULL,
+	distance     FLOAT NOT NULL,
+	start_x      FLOAT NOT NULL,
+	start_y      FLOAT NOT NULL,
+	end_x        FLOAT NOT NULL,
+	end_y        FLOAT NOT NULL,
+	PRIMARY KEY (bucket, start_ts)
+) WITHOUT ROWID;
+
+-- The positions a rolled up bucket's path was simplified to
+CREATE TABLE IF NOT EXISTS retention_points (
+	bucket           TEXT NOT NULL,
+	start_ts         TIMESTAMP NOT NULL, -- the start of the bucket
+	id               INTEGER NOT NULL,   -- the positions id
+	blck             INTEGER NOT NULL,
+	transaction_hash TEXT NOT NULL,
+	x                FLOAT NOT NULL,
+	y                FLOAT NOT NULL,
+	direction        FLOAT NOT NULL,
+	price            FLOAT NOT NULL,
+	ts               TIMESTAMP NOT NULL,
+	model            TEXT NOT NULL,
+	model_version    INTEGER NOT NULL,
+	collision        BOOLEAN NOT NULL,
+	left_muscle      INTEGER,
+	right_muscle     INTEGER,
+	PRIMARY KEY (bucket, start_ts, id)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS retention_points_id ON retention_points (id);
@@ -0,0 +1,14 @@
+-- The repairs of the block ranges the fetcher skipped or failed, one per range
+-- of the ledger that was picked up
+CREATE TABLE IF NOT EXISTS block_repairs (
+	start_block     INTEGER NOT NULL, -- inclusive
+	end_block       INTEGER NOT NULL, -- inclusive
+	ledger_status   TEXT NOT NULL,    -- the status of the range in the ledger
+	status          TEXT NOT NULL,    -- pending, retrying, repaired, abandoned or superseded
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	recovered       INTEGER NOT NULL DEFAULT 0, -- the updates inserted by the repair
+	error           TEXT NOT NULL DEFAULT '',   -- the error of the latest attempt
+	next_attempt_at TIMESTAMP,                  -- NULL once the range is no longer retried
+	updated_at      TIMESTAMP NOT NULL,
+	PRIMARY KEY (start_block, end_block)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS muscle_backfill_failures;
+DROP TABLE IF EXISTS muscle_backfill;
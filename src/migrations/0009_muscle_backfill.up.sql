@@ -0,0 +1,18 @@
+-- Progress of the muscle backfill, the positions up to last_id were looked at
+CREATE TABLE IF NOT EXISTS muscle_backfill (
+	id         INTEGER PRIMARY KEY CHECK (id = 1),
+	last_id    INTEGER NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+-- The transactions whose muscles the backfill couldn't recover
+CREATE TABLE IF NOT EXISTS muscle_backfill_failures (
+	transaction_hash TEXT PRIMARY KEY,
+	status           TEXT NOT NULL,              -- failed, mismatched or abandoned
+	positions        INTEGER NOT NULL,           -- the positions of the transaction missing muscles
+	updates          INTEGER NOT NULL DEFAULT 0, -- the worm state updates the transaction emitted
+	attempts         INTEGER NOT NULL DEFAULT 0,
+	error            TEXT NOT NULL DEFAULT '',
+	next_attempt_at  TIMESTAMP,                  -- NULL once the transaction is no longer retried
+	updated_at       TIMESTAMP NOT NULL
+);
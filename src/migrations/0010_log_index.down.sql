@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS positions_chain_order;
+
+ALTER TABLE retention_points DROP COLUMN log_index;
+ALTER TABLE positions DROP COLUMN log_index;
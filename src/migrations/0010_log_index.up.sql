@@ -0,0 +1,9 @@
+-- The index of each update's log in its block. Positions are replayed in the
+-- order of the chain, by block and then log index, rather than by id, so that
+-- updates recovered by repairs are stored with new ids after the later ones.
+-- Positions stored before the index was recorded get 0 and keep the order they
+-- were stored in within their block.
+ALTER TABLE positions ADD COLUMN log_index INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE retention_points ADD COLUMN log_index INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS positions_chain_order ON positions (blck, log_index);
@@ -0,0 +1,637 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// muscleSample is a single neural output of the worm.
+type muscleSample struct {
+	ID          int       `json:"id"`
+	Block       int       `json:"blockNumber"`
+	Timestamp   time.Time `json:"timestamp"`
+	LeftMuscle  int64     `json:"leftMuscle"`
+	RightMuscle int64     `json:"rightMuscle"`
+}
+
+// fetchMuscles returns up to limit recorded muscle activations between from
+// and to, in order. A zero from or to leaves that end of the range open.
+// Positions whose muscle inputs were never recorded are skipped.
+func (db *dbManager) fetchMuscles(from, to time.Time, limit int) ([]muscleSample, error) {
+	const q = /* sql */ `
+		SELECT
+			id, blck, ts, left_muscle, right_muscle
+		FROM positions
+		WHERE left_muscle IS NOT NULL
+		AND (?1 IS NULL OR ts >= ?1)
+		AND (?2 IS NULL OR ts <= ?2)
+		ORDER BY id ASC
+		LIMIT ?3;
+	`
+
+	rows, err := db.reader.Query(q, nullTime(from), nullTime(to), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching muscles: %w", err)
+	}
+	defer rows.Close()
+
+	samples := make([]muscleSample, 0)
+	for rows.Next() {
+		var m muscleSample
+		if err := rows.Scan(&m.ID, &m.Block, &m.Timestamp, &m.LeftMuscle, &m.RightMuscle); err != nil {
+			return nil, fmt.Errorf("error scanning muscles: %w", err)
+		}
+		samples = append(samples, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating muscles: %w", err)
+	}
+
+	return samples, nil
+}
+
+// -----------------------------------------------------------------------------
+// Muscle backfill
+
+// The muscle backfill recovers the muscle inputs of positions stored before
+// they were recorded by re-reading the worm state updates of each position's
+// transaction, from the chain or from an archive of raw contract logs. Updates
+// are matched to positions in order. The backfill records how far it got and
+// every transaction it couldn't recover, so it resumes where it stopped and
+// transactions that failed to fetch are retried with their own backoff.
+
+// Statuses of the transactions the backfill couldn't recover.
+const (
+	muscleBackfillFailed     = "failed"     // fetching the transaction failed, retried after its backoff
+	muscleBackfillMismatched = "mismatched" // its updates don't line up with its positions
+	muscleBackfillAbandoned  = "abandoned"  // fetching it failed too many times
+)
+
+const (
+	muscleBackfillBackoff     = time.Minute
+	muscleBackfillMaxBackoff  = 6 * time.Hour
+	muscleBackfillMaxAttempts = 10
+)
+
+var errNotInArchive = errors.New("transaction not in the log archive")
+
+// muscleSource returns the non-zero worm state updates of a transaction, in
+// log order.
+type muscleSource interface {
+	fetchTransaction(ctx context.Context, txHash string) ([]contractData, error)
+}
+
+// logArchive is a muscleSource reading an archive of raw contract logs, as
+// imported by the logs format.
+type logArchive map[string][]contractData
+
+// ReadLogArchive reads an archive of raw contract logs for the muscle backfill.
+func ReadLogArchive(r io.Reader) (logArchive, error) {
+	logs, err := newLogsImport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := make(logArchive)
+	for {
+		rec, err := logs.next()
+		if errors.Is(err, io.EOF) {
+			return archive, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := rec.p
+		archive[p.TransactionHash] = append(archive[p.TransactionHash], contractData{
+			transactionHash: p.TransactionHash,
+			block:           p.Block,
+			leftMuscle:      *p.LeftMuscle,
+			rightMuscle:     *p.RightMuscle,
+			price:           p.Price,
+			ts:              p.Timestamp,
+		})
+	}
+}
+
+func (a logArchive) fetchTransaction(_ context.Context, txHash string) ([]contractData, error) {
+	cds, ok := a[txHash]
+	if !ok {
+		return nil, errNotInArchive
+	}
+	return cds, nil
+}
+
+// muscleBackfillFailure is a transaction whose muscles couldn't be recovered.
+type muscleBackfillFailure struct {
+	TransactionHash string     `json:"transactionHash"`
+	Status          string     `json:"status"`
+	Positions       int        `json:"positions"`
+	Updates         int        `json:"updates"`
+	Attempts        int        `json:"attempts"`
+	Error           string     `json:"error,omitempty"`
+	NextAttemptAt   *time.Time `json:"nextAttemptAt,omitempty"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+// muscleBackfillStatus is how far the backfill got.
+type muscleBackfillStatus struct {
+	LastID   int                     `json:"lastId"`  // the positions up to it were looked at
+	Missing  int                     `json:"missing"` // the positions still missing muscles
+	Failures []muscleBackfillFailure `json:"failures"`
+}
+
+// muscleBackfillResult counts what a backfill pass did.
+type muscleBackfillResult struct {
+	Recovered int // positions whose muscles were recovered
+	Failed    int // positions of transactions that couldn't be fetched
+	Unmatched int // positions of transactions whose updates don't match them
+}
+
+func (r *muscleBackfillResult) add(o muscleBackfillResult) {
+	r.Recovered += o.Recovered
+	r.Failed += o.Failed
+	r.Unmatched += o.Unmatched
+}
+
+// backfillMuscles recovers the muscles of the positions the backfill hasn't
+// looked at yet from the chain, then retries the transactions that failed to
+// fetch as their backoffs run out until none is left or the context is done.
+// The derivations are refreshed once anything was recovered.
+func backfillMuscles(ctx context.Context, log *zap.Logger, source muscleSource, db *dbManager) error {
+	var result muscleBackfillResult
+	defer func() {
+		if result.Recovered > 0 {
+			// The derivations saw these positions without their muscles
+			if err := db.refreshDerivations(); err != nil {
+				log.Error("error refreshing derivations after the muscle backfill", zap.Error(err))
+			}
+		}
+	}()
+
+	lastID, err := db.muscleBackfillProgress()
+	if err != nil {
+		return err
+	}
+	pass, err := db.backfillMusclesAfter(ctx, log, source, lastID, true)
+	result.add(pass)
+	if err != nil {
+		return err
+	}
+	log.Info(
+		"muscle backfill complete",
+		zap.Int("recovered", result.Recovered),
+		zap.Int("failed", result.Failed),
+		zap.Int("unmatched", result.Unmatched),
+	)
+
+	for {
+		retried, next, err := db.retryMuscleBackfill(ctx, log, source, time.Now().UTC())
+		result.add(retried)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+
+		timer := time.NewTimer(time.Until(*next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// BackfillMusclesFromArchive recovers the muscles of every position still
+// missing them from an archive of raw contract logs, including the ones whose
+// transactions failed or didn't match on the chain. Transactions the archive
+// doesn't hold are left as they were. The derivations are refreshed once
+// anything was recovered.
+func (db *dbManager) BackfillMusclesFromArchive(ctx context.Context, log *zap.Logger, archive logArchive) (muscleBackfillResult, error) {
+	result, err := db.backfillMusclesAfter(ctx, log, archive, 0, false)
+	if err != nil {
+		return result, err
+	}
+	if result.Recovered > 0 {
+		return result, db.refreshDerivations()
+	}
+	return result, nil
+}
+
+// backfillMusclesAfter recovers the muscles of the positions after id from
+// source in batches, each batch in its own transaction. With progress set the
+// last position looked at is recorded along with each batch.
+func (db *dbManager) backfillMusclesAfter(ctx context.Context, log *zap.Logger, source muscleSource, id int, progress bool) (muscleBackfillResult, error) {
+	const batchSize = 100
+
+	var result muscleBackfillResult
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		ps, err := db.fetchPositionsMissingMuscles(id, batchSize)
+		if err != nil {
+			return result, err
+		}
+		if len(ps) == 0 {
+			return result, nil
+		}
+		id = ps[len(ps)-1].ID
+
+		// Group the batch by transaction, keeping the positions in id order
+		var hashes []string
+		byTx := make(map[string][]position)
+		for _, p := range ps {
+			if _, ok := byTx[p.TransactionHash]; !ok {
+				hashes = append(hashes, p.TransactionHash)
+			}
+			byTx[p.TransactionHash] = append(byTx[p.TransactionHash], p)
+		}
+
+		// The transactions are fetched before the batch's write transaction
+		// so that the writer isn't held while waiting on the source
+		fetched := make(map[string][]contractData, len(hashes))
+		errs := make(map[string]error)
+		for _, hash := range hashes {
+			cds, err := source.fetchTransaction(ctx, hash)
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			if err != nil {
+				errs[hash] = err
+				continue
+			}
+			fetched[hash] = cds
+		}
+
+		tx, err := db.begin(ctx)
+		if err != nil {
+			return result, fmt.Errorf("error starting transaction: %w", err)
+		}
+		now := time.Now().UTC()
+		var batch muscleBackfillResult
+		for _, hash := range hashes {
+			txPositions := byTx[hash]
+			err := errs[hash]
+			if errors.Is(err, errNotInArchive) {
+				continue
+			}
+			if err == nil {
+				matched, err := saveTransactionMuscles(tx, log, hash, txPositions, fetched[hash], now)
+				if err != nil {
+					tx.Rollback()
+					return result, err
+				}
+				if matched {
+					batch.Recovered += len(txPositions)
+				} else {
+					batch.Unmatched += len(txPositions)
+				}
+				continue
+			}
+
+			log.Warn("error fetching transaction, retrying it later", zap.String("transaction_hash", hash), zap.Error(err))
+			failure := muscleBackfillFailure{TransactionHash: hash, Positions: len(txPositions)}
+			if err := failMuscleBackfill(tx, failure, err, now); err != nil {
+				tx.Rollback()
+				return result, err
+			}
+			batch.Failed += len(txPositions)
+		}
+		if progress {
+			if err := saveMuscleBackfillProgress(tx, id, now); err != nil {
+				tx.Rollback()
+				return result, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return result, fmt.Errorf("error committing muscle backfill: %w", err)
+		}
+		result.add(batch)
+	}
+}
+
+// retryMuscleBackfill fetches the failed transactions that are due again. It
+// returns when the next one is due, nil when none is left to retry.
+func (db *dbManager) retryMuscleBackfill(ctx context.Context, log *zap.Logger, source muscleSource, now time.Time) (muscleBackfillResult, *time.Time, error) {
+	var result muscleBackfillResult
+
+	failures, err := queryMuscleBackfillFailures(db.reader, `
+		SELECT `+muscleBackfillFailureColumns+`
+		FROM muscle_backfill_failures
+		WHERE status = 'failed' AND next_attempt_at <= ?
+		ORDER BY next_attempt_at ASC;
+	`, now)
+	if err != nil {
+		return result, nil, err
+	}
+
+	for _, f := range failures {
+		ps, err := db.fetchTransactionMissingMuscles(f.TransactionHash)
+		if err != nil {
+			return result, nil, err
+		}
+		cds, fetchErr := source.fetchTransaction(ctx, f.TransactionHash)
+		if ctx.Err() != nil {
+			return result, nil, ctx.Err()
+		}
+
+		tx, err := db.begin(ctx)
+		if err != nil {
+			return result, nil, fmt.Errorf("error starting transaction: %w", err)
+		}
+		switch {
+		case len(ps) == 0:
+			// recovered some other way, or rolled up
+			err = clearMuscleBackfillFailure(tx, f.TransactionHash)
+		case fetchErr != nil:
+			log.Warn("error fetching transaction again", zap.String("transaction_hash", f.TransactionHash), zap.Error(fetchErr))
+			f.Positions = len(ps)
+			err = failMuscleBackfill(tx, f, fetchErr, now)
+			result.Failed += len(ps)
+		default:
+			var matched bool
+			matched, err = saveTransactionMuscles(tx, log, f.TransactionHash, ps, cds, now)
+			if matched {
+				result.Recovered += len(ps)
+			} else {
+				result.Unmatched += len(ps)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return result, nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return result, nil, fmt.Errorf("error committing muscle backfill: %w", err)
+		}
+	}
+
+	var next *time.Time
+	const q = /* sql */ `
+		SELECT next_attempt_at
+		FROM muscle_backfill_failures
+		WHERE status = 'failed'
+		ORDER BY next_attempt_at ASC
+		LIMIT 1;
+	`
+	if err := db.reader.QueryRow(q).Scan(&next); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return result, nil, fmt.Errorf("error getting next muscle backfill retry: %w", err)
+	}
+	return result, next, nil
+}
+
+// saveTransactionMuscles saves the muscles of a transaction's positions when
+// its updates line up with them, and otherwise records it as mismatched. It
+// reports whether they matched.
+func saveTransactionMuscles(ex execer, log *zap.Logger, hash string, ps []position, cds []contractData, now time.Time) (bool, error) {
+	if len(cds) != len(ps) {
+		log.Warn(
+			"worm state updates don't match positions, skipping",
+			zap.String("transaction_hash", hash),
+			zap.Int("updates", len(cds)),
+			zap.Int("positions", len(ps)),
+		)
+		const q = /* sql */ `
+			INSERT INTO muscle_backfill_failures (transaction_hash, status, positions, updates, updated_at)
+			VALUES (?1, 'mismatched', ?2, ?3, ?4)
+			ON CONFLICT (transaction_hash) DO UPDATE SET
+				status = 'mismatched',
+				positions = excluded.positions,
+				updates = excluded.updates,
+				error = '',
+				next_attempt_at = NULL,
+				updated_at = excluded.updated_at;
+		`
+		if _, err := ex.Exec(q, hash, len(ps), len(cds), now); err != nil {
+			return false, fmt.Errorf("error saving muscle backfill failure: %w", err)
+		}
+		return false, nil
+	}
+
+	for i, p := range ps {
+		if err := saveMuscles(ex, p.ID, cds[i].leftMuscle, cds[i].rightMuscle); err != nil {
+			return false, err
+		}
+	}
+	return true, clearMuscleBackfillFailure(ex, hash)
+}
+
+// failMuscleBackfill records another failed attempt at fetching a transaction,
+// abandoning it once it's out of attempts.
+func failMuscleBackfill(ex execer, f muscleBackfillFailure, err error, now time.Time) error {
+	f.Attempts++
+	f.Status, f.Error, f.NextAttemptAt, f.UpdatedAt = muscleBackfillFailed, err.Error(), nil, now
+	if f.Attempts >= muscleBackfillMaxAttempts {
+		f.Status = muscleBackfillAbandoned
+	} else {
+		backoff := muscleBackfillBackoff
+		for i := 1; i < f.Attempts && backoff < muscleBackfillMaxBackoff; i++ {
+			backoff *= 2
+		}
+		next := now.Add(min(backoff, muscleBackfillMaxBackoff))
+		f.NextAttemptAt = &next
+	}
+
+	const q = /* sql */ `
+		INSERT INTO muscle_backfill_failures
+			(transaction_hash, status, positions, updates, attempts, error, next_attempt_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (transaction_hash) DO UPDATE SET
+			status = excluded.status,
+			positions = excluded.positions,
+			updates = excluded.updates,
+			attempts = excluded.attempts,
+			error = excluded.error,
+			next_attempt_at = excluded.next_attempt_at,
+			updated_at = excluded.updated_at;
+	`
+	_, err = ex.Exec(q, f.TransactionHash, f.Status, f.Positions, f.Updates, f.Attempts, f.Error, f.NextAttemptAt, f.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("error saving muscle backfill failure: %w", err)
+	}
+	return nil
+}
+
+func clearMuscleBackfillFailure(ex execer, hash string) error {
+	if _, err := ex.Exec(`DELETE FROM muscle_backfill_failures WHERE transaction_hash = ?;`, hash); err != nil {
+		return fmt.Errorf("error clearing muscle backfill failure: %w", err)
+	}
+	return nil
+}
+
+// RetryMuscleBackfill makes the abandoned transactions due again with their
+// attempts reset, the backfill retries them from its next start.
+func (db *dbManager) RetryMuscleBackfill() (int, error) {
+	const q = /* sql */ `
+		UPDATE muscle_backfill_failures
+		SET status = 'failed', attempts = 0, next_attempt_at = ?1, updated_at = ?1
+		WHERE status = 'abandoned';
+	`
+	res, err := db.writer.Exec(q, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("error retrying muscle backfill failures: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error retrying muscle backfill failures: %w", err)
+	}
+	return int(n), nil
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+// fetchPositionsMissingMuscles returns up to limit positions after id that
+// have no recorded muscle inputs.
+func (db *dbManager) fetchPositionsMissingMuscles(id, limit int) ([]position, error) {
+	const q = /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE id > ?
+		AND left_muscle IS NULL
+		ORDER BY id ASC
+		LIMIT ?;
+	`
+
+	rows, err := db.reader.Query(q, id, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching positions missing muscles: %w", err)
+	}
+	defer rows.Close()
+
+	return scanPositions(rows)
+}
+
+// fetchTransactionMissingMuscles returns the positions of a transaction that
+// have no recorded muscle inputs, in order.
+func (db *dbManager) fetchTransactionMissingMuscles(hash string) ([]position, error) {
+	const q = /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE transaction_hash = ?
+		AND left_muscle IS NULL
+		ORDER BY id ASC;
+	`
+
+	rows, err := db.reader.Query(q, hash)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching positions missing muscles: %w", err)
+	}
+	defer rows.Close()
+
+	return scanPositions(rows)
+}
+
+func saveMuscles(ex execer, id int, left, right int64) error {
+	const q = /* sql */ `
+		UPDATE positions
+		SET left_muscle = ?, right_muscle = ?
+		WHERE id = ?;
+	`
+
+	if _, err := ex.Exec(q, left, right, id); err != nil {
+		return fmt.Errorf("error saving muscles: %w", err)
+	}
+
+	return nil
+}
+
+func (db *dbManager) muscleBackfillProgress() (int, error) {
+	var lastID int
+	err := db.reader.QueryRow(`SELECT last_id FROM muscle_backfill WHERE id = 1;`).Scan(&lastID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("error getting muscle backfill progress: %w", err)
+	}
+	return lastID, nil
+}
+
+func saveMuscleBackfillProgress(ex execer, lastID int, now time.Time) error {
+	const q = /* sql */ `
+		INSERT INTO muscle_backfill (id, last_id, updated_at)
+		VALUES (1, ?1, ?2)
+		ON CONFLICT (id) DO UPDATE SET
+			last_id = MAX(last_id, excluded.last_id),
+			updated_at = excluded.updated_at;
+	`
+	if _, err := ex.Exec(q, lastID, now); err != nil {
+		return fmt.Errorf("error saving muscle backfill progress: %w", err)
+	}
+	return nil
+}
+
+const muscleBackfillFailureColumns = /* sql */ `
+	transaction_hash, status, positions, updates, attempts, error,
+	next_attempt_at, updated_at`
+
+func queryMuscleBackfillFailures(ex execer, q string, args ...any) ([]muscleBackfillFailure, error) {
+	rows, err := ex.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching muscle backfill failures: %w", err)
+	}
+	defer rows.Close()
+
+	failures := make([]muscleBackfillFailure, 0)
+	for rows.Next() {
+		var f muscleBackfillFailure
+		err := rows.Scan(
+			&f.TransactionHash,
+			&f.Status,
+			&f.Positions,
+			&f.Updates,
+			&f.Attempts,
+			&f.Error,
+			&f.NextAttemptAt,
+			&f.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning muscle backfill failure: %w", err)
+		}
+		failures = append(failures, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating muscle backfill failures: %w", err)
+	}
+	return failures, nil
+}
+
+// MuscleBackfillStatus returns how far the muscle backfill got and the
+// transactions it couldn't recover.
+func (db *dbManager) MuscleBackfillStatus() (muscleBackfillStatus, error) {
+	lastID, err := db.muscleBackfillProgress()
+	if err != nil {
+		return muscleBackfillStatus{}, err
+	}
+	status := muscleBackfillStatus{LastID: lastID}
+
+	if err := db.reader.QueryRow(`SELECT COUNT(*) FROM positions WHERE left_muscle IS NULL;`).Scan(&status.Missing); err != nil {
+		return muscleBackfillStatus{}, fmt.Errorf("error counting positions missing muscles: %w", err)
+	}
+
+	status.Failures, err = queryMuscleBackfillFailures(db.reader, `
+		SELECT `+muscleBackfillFailureColumns+`
+		FROM muscle_backfill_failures
+		ORDER BY updated_at ASC, transaction_hash ASC;
+	`)
+	if err != nil {
+		return muscleBackfillStatus{}, err
+	}
+	return status, nil
+}
+
+// nullTime maps the zero time to NULL so that it can be used as an open bound.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
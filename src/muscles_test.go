@@ -0,0 +1,120 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// openTestDB returns an empty, migrated file database.
+func openTestDB(t *testing.T) *dbManager {
+	t.Helper()
+
+	db, err := NewDBManager(filepath.Join(t.TempDir(), "worm-tracker.sqlite"))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.MigrateUp(zap.NewNop(), 0); err != nil {
+		t.Fatalf("migrating database: %v", err)
+	}
+	return db
+}
+
+// flakySource serves the updates of its transactions, failing the ones in
+// fail.
+type flakySource struct {
+	updates map[string][]contractData
+	fail    map[string]bool
+}
+
+func (s flakySource) fetchTransaction(_ context.Context, hash string) ([]contractData, error) {
+	if s.fail[hash] {
+		return nil, errors.New("rpc unavailable")
+	}
+	return s.updates[hash], nil
+}
+
+func TestBackfillMuscles(t *testing.T) {
+	db := openTestDB(t)
+
+	// Three transactions of two positions each, stored without muscles
+	source := flakySource{updates: make(map[string][]contractData), fail: map[string]bool{"0x1": true}}
+	for i := 0; i < 6; i++ {
+		cd := benchmarkContractData(i)
+		cd.transactionHash = []string{"0x0", "0x1", "0x2"}[i/2]
+		p := benchmarkPosition(i, position{})
+		p.TransactionHash = cd.transactionHash
+		p.LeftMuscle, p.RightMuscle = nil, nil
+		if _, err := db.SavePosition(p); err != nil {
+			t.Fatal(err)
+		}
+		if i != 5 {
+			source.updates[cd.transactionHash] = append(source.updates[cd.transactionHash], cd)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := db.backfillMusclesAfter(ctx, zap.NewNop(), source, 0, true)
+	if err != nil {
+		t.Fatalf("backfilling muscles: %v", err)
+	}
+	if want := (muscleBackfillResult{Recovered: 2, Failed: 2, Unmatched: 2}); result != want {
+		t.Errorf("backfill result is %+v, want %+v", result, want)
+	}
+
+	status, err := db.MuscleBackfillStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.LastID != 6 || status.Missing != 4 || len(status.Failures) != 2 {
+		t.Fatalf("backfill status is %+v", status)
+	}
+	failed := status.Failures[0]
+	if failed.TransactionHash != "0x1" {
+		failed = status.Failures[1]
+	}
+	if failed.Status != muscleBackfillFailed || failed.Attempts != 1 || failed.NextAttemptAt == nil {
+		t.Errorf("failed transaction is recorded as %+v", failed)
+	}
+
+	// The failed transaction is retried once it's due, the mismatched one
+	// isn't
+	source.fail = nil
+	result, next, err := db.retryMuscleBackfill(ctx, zap.NewNop(), source, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 0 || next == nil {
+		t.Errorf("retried a transaction before it was due: %+v, next %v", result, next)
+	}
+	result, next, err = db.retryMuscleBackfill(ctx, zap.NewNop(), source, next.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 2 || next != nil {
+		t.Errorf("retry recovered %+v, next %v", result, next)
+	}
+
+	// The archive recovers the mismatched transaction
+	archive := logArchive{"0x2": {benchmarkContractData(4), benchmarkContractData(5)}}
+	result, err = db.BackfillMusclesFromArchive(ctx, zap.NewNop(), archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 2 {
+		t.Errorf("archive recovered %+v", result)
+	}
+	status, err = db.MuscleBackfillStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Missing != 0 || len(status.Failures) != 0 {
+		t.Errorf("backfill status is %+v after recovering everything", status)
+	}
+}
@@ -0,0 +1,151 @@
+package src
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// positionQuery selects a page of positions by time and block range. Pages are
+// keyed on the id, which grows with both the time and the block number.
+type positionQuery struct {
+	from, to           time.Time // zero leaves the end of the range open
+	fromBlock, toBlock int       // zero leaves the end of the range open
+	desc               bool
+	limit              int
+	cursor             pageCursor
+}
+
+// pageCursor continues a query from the edge of a previous page, either after
+// or before an id in the query's order.
+type pageCursor struct {
+	ID     int  `json:"id"`
+	Before bool `json:"before,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageCursor(s string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID < 1 {
+		return pageCursor{}, errInvalidCursor
+	}
+	return c, nil
+}
+
+// positionPage is a page of positions in the query's order, with the cursors
+// of the pages either side of it. A cursor is empty when there is no page in
+// that direction.
+type positionPage struct {
+	positions []position
+	next      string
+	prev      string
+}
+
+// fetchPositionPage returns a page of positions of a trajectory version.
+func (db *dbManager) fetchPositionPage(pq positionQuery, version int) (positionPage, error) {
+	source, args, err := db.positionsSource(version)
+	if err != nil {
+		return positionPage{}, err
+	}
+
+	// Pages before the cursor are read in reverse and flipped back
+	var afterID, beforeID any
+	reverse := pq.cursor.Before
+	if pq.cursor.ID != 0 {
+		if pq.desc != pq.cursor.Before {
+			beforeID = pq.cursor.ID
+		} else {
+			afterID = pq.cursor.ID
+		}
+	}
+	order := "ASC"
+	if pq.desc != reverse {
+		order = "DESC"
+	}
+
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		WHERE (? IS NULL OR ts >= ?)
+		AND (? IS NULL OR ts <= ?)
+		AND (? IS NULL OR blck >= ?)
+		AND (? IS NULL OR blck <= ?)
+		AND (? IS NULL OR id > ?)
+		AND (? IS NULL OR id < ?)
+		ORDER BY id ` + order + `
+		LIMIT ?;
+	`
+
+	fromBlock, toBlock := nullBlock(pq.fromBlock), nullBlock(pq.toBlock)
+	args = append(args,
+		nullTime(pq.from), nullTime(pq.from),
+		nullTime(pq.to), nullTime(pq.to),
+		fromBlock, fromBlock,
+		toBlock, toBlock,
+		afterID, afterID,
+		beforeID, beforeID,
+		pq.limit+1,
+	)
+
+	rows, err := db.reader.Query(q, args...)
+	if err != nil {
+		return positionPage{}, fmt.Errorf("error fetching positions: %w", err)
+	}
+	defer rows.Close()
+
+	ps, err := scanPositions(rows)
+	if err != nil {
+		return positionPage{}, err
+	}
+
+	more := len(ps) > pq.limit
+	if more {
+		ps = ps[:pq.limit]
+	}
+	if reverse {
+		for i, j := 0, len(ps)-1; i < j; i, j = i+1, j-1 {
+			ps[i], ps[j] = ps[j], ps[i]
+		}
+	}
+
+	page := positionPage{positions: ps}
+	if len(ps) == 0 {
+		return page, nil
+	}
+
+	// The page in the direction it was read in exists when there were more
+	// rows, the other one when the page was reached through a cursor
+	first, last := ps[0].ID, ps[len(ps)-1].ID
+	hasNext, hasPrev := more, pq.cursor.ID != 0
+	if reverse {
+		hasNext, hasPrev = true, more
+	}
+	if hasNext {
+		page.next = pageCursor{ID: last}.encode()
+	}
+	if hasPrev {
+		page.prev = pageCursor{ID: first, Before: true}.encode()
+	}
+
+	return page, nil
+}
+
+// nullBlock maps block 0 to NULL so that it can be used as an open bound.
+func nullBlock(b int) any {
+	if b == 0 {
+		return nil
+	}
+	return b
+}
@@ -1,50 +1,68 @@
 package src
 
 import (
-	"math"
 	"time"
 )
 
 type position struct {
-	ID              int       `json:"id"`          // set by the DB
-	Block           int       `json:"blockNumber"` // the associated block number that contained the muscle movements
-	TransactionHash string    `json:"transactionHash"`
-	X               float64   `json:"x"`
-	Y               float64   `json:"y"`
-	Direction       float64   `json:"direction"`
-	Price           float64   `json:"price"`
-	Timestamp       time.Time `json:"timestamp"`
+	ID              int         `json:"id"`          // set by the DB
+	Block           int         `json:"blockNumber"` // the associated block number that contained the muscle movements
+	LogIndex        int         `json:"logIndex"`    // the index of the update's log in its block, 0 when it was never recorded
+	TransactionHash string      `json:"transactionHash"`
+	X               float64     `json:"x"`
+	Y               float64     `json:"y"`
+	Direction       float64     `json:"direction"`
+	Price           float64     `json:"price"`
+	Timestamp       time.Time   `json:"timestamp"`
+	Model           string      `json:"model"`        // the locomotion model that produced the position
+	ModelVersion    int         `json:"modelVersion"` // the version of that locomotion model
+	Collision       bool        `json:"collision"`    // whether the move hit the arena boundary
+	LeftMuscle      *int64      `json:"leftMuscle"`   // nil when the muscle inputs were never recorded
+	RightMuscle     *int64      `json:"rightMuscle"`
+	Kinematics      *kinematics `json:"kinematics,omitempty"` // only served on request
+	Behaviour       string      `json:"behaviour,omitempty"`  // the behavioural state of the move, empty until labelled
+	Anomalies       []string    `json:"anomalies,omitempty"`  // the data quality anomalies of the update
 }
 
 // updatePosition takes the contract data and the current position to create a
-// new position object.
-func updatePosition(c contractData, cp position) position {
-
-	angle := float64(c.rightMuscle-c.leftMuscle) / 2
-	magnitude := float64(c.rightMuscle+c.leftMuscle) / 2
-
-	newDirection := cp.Direction + angle
-	if newDirection < 0 {
-		newDirection += 360
-	} else if newDirection >= 360 {
-		newDirection -= 360
-	}
-
-	dX := magnitude * math.Cos(cp.Direction*math.Pi/180)
-	dY := magnitude * math.Sin(cp.Direction*math.Pi/180)
-
-	newX := cp.X + dX
-	newY := cp.Y + dY
+// new position object using the given locomotion model. The move is then
+// constrained to the arena.
+func updatePosition(m LocomotionModel, a *arena, c contractData, cp position) position {
+	newX, newY, newDirection := m.Move(cp.X, cp.Y, cp.Direction, c.leftMuscle, c.rightMuscle)
+	newX, newY, newDirection, collision := a.constrain(newX, newY, newDirection)
 
 	np := position{
 		Block:           c.block,
+		LogIndex:        c.logIndex,
 		TransactionHash: c.transactionHash,
 		X:               newX,
 		Y:               newY,
 		Direction:       newDirection,
 		Price:           c.price,
 		Timestamp:       c.ts,
+		Model:           m.Name(),
+		ModelVersion:    m.Version(),
+		Collision:       collision,
+		LeftMuscle:      &c.leftMuscle,
+		RightMuscle:     &c.rightMuscle,
 	}
 
+	k := computeKinematics(cp, np)
+	np.Kinematics = &k
+
 	return np
 }
+
+// contractData recovers the contract data a stored position was built from. It
+// must only be called on positions with recorded muscle inputs.
+func (p position) contractData() contractData {
+	return contractData{
+		transactionHash: p.TransactionHash,
+		block:           p.Block,
+		logIndex:        p.LogIndex,
+		leftMuscle:      *p.LeftMuscle,
+		rightMuscle:     *p.RightMuscle,
+		price:           p.Price,
+		ts:              p.Timestamp,
+	}
+}
@@ -0,0 +1,686 @@
+package src
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// The repair worker retries the block ranges the ledger holds as skipped or
+// failed, each with its own backoff. The updates it recovers are handed to the
+// worm loop, which stores them with new ids, recomputes every position after
+// them in chain order and records the range as done.
+
+// Statuses of the repairs.
+const (
+	repairPending    = "pending"    // not tried yet
+	repairRetrying   = "retrying"   // tried and failed, tried again after its backoff
+	repairRepaired   = "repaired"   // the range was recovered
+	repairAbandoned  = "abandoned"  // out of attempts, or the range was rolled up
+	repairSuperseded = "superseded" // the range changed in the ledger before it was repaired
+)
+
+var (
+	errRepairRolledUp      = errors.New("the positions around the range were rolled up")
+	errRepairModelMismatch = errors.New("the configured locomotion model or arena differs from the active trajectory's")
+	errInvalidRepair       = errors.New("invalid status: must be pending, retrying, repaired, abandoned or superseded")
+)
+
+var blockRepairsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "worm_tracker_block_repairs_total",
+		Help: "Attempts at repairing block ranges, by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(blockRepairsTotal)
+}
+
+// RepairConfig sets how skipped and failed block ranges are retried.
+type RepairConfig struct {
+	RPC         string        // the endpoint ranges are retried through
+	Interval    time.Duration // time between looks at the ledger, 0 disables repairs
+	Backoff     time.Duration // wait before the second attempt, doubled after every failure
+	MaxBackoff  time.Duration
+	MaxAttempts int // 0 retries for good
+}
+
+func (cfg RepairConfig) validate() error {
+	if cfg.Interval < 0 {
+		return fmt.Errorf("invalid repair interval %v: must not be negative", cfg.Interval)
+	}
+	if cfg.Backoff <= 0 {
+		return fmt.Errorf("invalid repair backoff %v: must be positive", cfg.Backoff)
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		return fmt.Errorf("invalid max repair backoff %v: must be at least the backoff", cfg.MaxBackoff)
+	}
+	if cfg.MaxAttempts < 0 {
+		return fmt.Errorf("invalid max repair attempts %d: must not be negative", cfg.MaxAttempts)
+	}
+	return nil
+}
+
+// backoff returns the wait after a number of failed attempts.
+func (cfg RepairConfig) backoff(attempts int) time.Duration {
+	d := cfg.Backoff
+	for i := 1; i < attempts && d < cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, cfg.MaxBackoff)
+}
+
+// blockRepair is the repair of a skipped or failed range of the ledger.
+type blockRepair struct {
+	From          int        `json:"from"`
+	To            int        `json:"to"`
+	LedgerStatus  string     `json:"ledgerStatus"` // the status of the range in the ledger
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	Recovered     int        `json:"recovered"`       // the updates inserted
+	Error         string     `json:"error,omitempty"` // the error of the latest attempt
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+// repairJob hands the updates recovered from a range to the worm loop.
+type repairJob struct {
+	ctx  context.Context
+	r    blockRange
+	cds  []contractData
+	done chan repairDone
+}
+
+type repairDone struct {
+	recovered int
+	err       error
+}
+
+// repairer retries the skipped and failed ranges of the ledger.
+type repairer struct {
+	log       *zap.Logger
+	db        *dbManager
+	fetcher   *blockFetcher
+	cfg       RepairConfig
+	anomalies AnomalyConfig
+	jobs      chan repairJob
+}
+
+// NewRepairer returns the repairer of the store's ledger, nil when repairs are
+// disabled or the store isn't SQLite.
+func NewRepairer(log *zap.Logger, store Store, cfg RepairConfig, anomalies AnomalyConfig) (*repairer, error) {
+	db, ok := store.(*dbManager)
+	if !ok || cfg.Interval == 0 {
+		return nil, nil
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	fetcher, err := newBlockFetcherAt(log.With(zap.String("worker", "repair")), cfg.RPC)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repairer{
+		log:       log,
+		db:        db,
+		fetcher:   fetcher,
+		cfg:       cfg,
+		anomalies: anomalies,
+		jobs:      make(chan repairJob),
+	}, nil
+}
+
+// Run repairs the ranges that are due every interval until the context is
+// done. The worm loop must be running to take the recovered updates.
+func (rp *repairer) Run(ctx context.Context) {
+	for {
+		if err := rp.RepairDue(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			rp.log.Error("error repairing block ranges", zap.Error(err))
+		}
+
+		timer := time.NewTimer(rp.cfg.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// RepairDue picks up the new skipped and failed ranges of the ledger and tries
+// the repairs that are due, oldest range first.
+func (rp *repairer) RepairDue(ctx context.Context, now time.Time) error {
+	due, err := rp.db.scheduleRepairs(now.UTC())
+	if err != nil {
+		return err
+	}
+
+	for _, rep := range due {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := rp.attempt(ctx, rep, now.UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempt fetches a range again and hands what it recovered to the worm loop,
+// then records how it went. Only errors recording it are returned.
+func (rp *repairer) attempt(ctx context.Context, rep blockRepair, now time.Time) error {
+	log := rp.log.With(zap.Int("from", rep.From), zap.Int("to", rep.To))
+
+	cds, err := rp.fetchRange(ctx, rep.From, rep.To)
+	recovered := 0
+	if err == nil {
+		recovered, err = rp.submit(ctx, blockRange{From: rep.From, To: rep.To}, cds)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// A recomputation reads the positions a repair moves, the range waits for
+	// the next look at the ledger without losing an attempt
+	if errors.Is(err, errRecomputeRunning) {
+		log.Info("recomputation running, postponing repair")
+		return nil
+	}
+	// So does a range the configured model can't be recomputed after until
+	// the trajectory is recomputed with it
+	if errors.Is(err, errRepairModelMismatch) {
+		log.Warn("postponing repair until the trajectory is recomputed", zap.Error(err))
+		return nil
+	}
+
+	rep.Attempts++
+	rep.Error, rep.NextAttemptAt, rep.UpdatedAt = "", nil, now
+	switch {
+	case err == nil:
+		rep.Status, rep.Recovered = repairRepaired, recovered
+		log.Info("block range repaired", zap.Int("recovered", recovered))
+	case errors.Is(err, errRepairRolledUp) || (rp.cfg.MaxAttempts > 0 && rep.Attempts >= rp.cfg.MaxAttempts):
+		rep.Status, rep.Error = repairAbandoned, err.Error()
+		log.Warn("abandoning block range repair", zap.Int("attempts", rep.Attempts), zap.Error(err))
+	default:
+		next := now.Add(rp.cfg.backoff(rep.Attempts))
+		rep.Status, rep.Error, rep.NextAttemptAt = repairRetrying, err.Error(), &next
+		log.Warn("error repairing block range", zap.Int("attempts", rep.Attempts), zap.Time("next_attempt", next), zap.Error(err))
+	}
+	blockRepairsTotal.WithLabelValues(rep.Status).Inc()
+
+	return saveRepair(rp.db.writer, rep)
+}
+
+// fetchRange returns the updates of a range in batches of up to 50 blocks like
+// the fetcher. A batch the RPC refuses as invalid is fetched a block at a
+// time, and the range fails if any block still can't be fetched.
+func (rp *repairer) fetchRange(ctx context.Context, from, to int) ([]contractData, error) {
+	const batchSize = 50
+
+	var cds []contractData
+	for i := from; i <= to; i += batchSize {
+		end := min(i+batchSize-1, to)
+		batch, err := rp.fetcher.fetchBlockRange(ctx, int64(i), int64(end))
+		if errors.Is(err, errInvalidBlockRange) && end > i {
+			batch, err = rp.fetchBlocks(ctx, i, end)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error fetching blocks %d-%d: %w", i, end, err)
+		}
+		cds = append(cds, batch...)
+	}
+	return cds, nil
+}
+
+// fetchBlocks fetches a range a block at a time.
+func (rp *repairer) fetchBlocks(ctx context.Context, from, to int) ([]contractData, error) {
+	var cds []contractData
+	for b := from; b <= to; b++ {
+		batch, err := rp.fetcher.fetchBlockRange(ctx, int64(b), int64(b))
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", b, err)
+		}
+		cds = append(cds, batch...)
+	}
+	return cds, nil
+}
+
+// submit hands the updates recovered from a range to the worm loop and waits
+// for them to be stored. It returns how many were inserted.
+func (rp *repairer) submit(ctx context.Context, r blockRange, cds []contractData) (int, error) {
+	job := repairJob{ctx: ctx, r: r, cds: cds, done: make(chan repairDone, 1)}
+	select {
+	case rp.jobs <- job:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	done := <-job.done
+	return done.recovered, done.err
+}
+
+// -----------------------------------------------------------------------------
+// Applying repairs
+
+// applyRepair stores the updates recovered from a range with new ids and
+// recomputes every position after the first of them in chain order, so the
+// ids of the stored positions never change. Updates already stored, by a batch
+// that overlapped the range, are left out. The range is recorded as done and
+// the derivations rebuilt in the same transaction. It returns the latest
+// position and the number of updates stored. Repairs are refused while the
+// model or arena differ from those the active trajectory was built with, the
+// trajectory would mix them.
+func (db *dbManager) applyRepair(ctx context.Context, r blockRange, cds []contractData, model LocomotionModel, arena *arena, anomalies AnomalyConfig) (position, int, error) {
+	detector, err := NewAnomalyDetector(anomalies)
+	if err != nil {
+		return position{}, 0, err
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return position{}, 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	cds, err = unstoredUpdates(tx, r, cds)
+	if err != nil {
+		return position{}, 0, err
+	}
+	slices.SortStableFunc(cds, func(a, b contractData) int {
+		return cmp.Or(cmp.Compare(a.block, b.block), cmp.Compare(a.logIndex, b.logIndex))
+	})
+
+	var flags []string
+	if len(cds) > 0 {
+		active, err := activeTrajectory(tx)
+		if err != nil {
+			return position{}, 0, err
+		}
+		built, err := active.params()
+		if err != nil {
+			return position{}, 0, err
+		}
+		if built != (trajectoryParams{Locomotion: model.Config(), Arena: arena.cfg}) || active.ModelVersion != model.Version() {
+			return position{}, 0, errRepairModelMismatch
+		}
+
+		prev, err := positionBeforeUpdate(tx, cds[0])
+		if err != nil {
+			return position{}, 0, err
+		}
+		if prev.ID == 0 {
+			var rolledUp bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM retention_buckets);`).Scan(&rolledUp); err != nil {
+				return position{}, 0, fmt.Errorf("error checking for rolled up positions: %w", err)
+			}
+			if rolledUp {
+				return position{}, 0, errRepairRolledUp
+			}
+		}
+
+		// Where the recovered positions land is recomputed with the later ones
+		recovered := make(map[int]bool, len(cds))
+		for _, cd := range cds {
+			id, err := insertPosition(tx, updatePosition(model, arena, cd, prev))
+			if err != nil {
+				return position{}, 0, err
+			}
+			recovered[id] = true
+		}
+
+		if err := primeDetectorBefore(tx, detector, prev); err != nil {
+			return position{}, 0, err
+		}
+		if flags, err = recomputeAfter(ctx, tx, detector, model, arena, prev, recovered); err != nil {
+			return position{}, 0, err
+		}
+	}
+
+	r.Status, r.Error, r.UpdatedAt = BlockRangeDone, "", time.Now().UTC()
+	if err := saveBlockRange(tx, r); err != nil {
+		return position{}, 0, err
+	}
+
+	if len(cds) > 0 {
+		if err := db.rebuildDerivations(tx); err != nil {
+			return position{}, 0, err
+		}
+	}
+
+	latest, err := scanPosition(tx.QueryRow(`SELECT ` + positionColumns + ` FROM positions ORDER BY ` + chainOrderDesc + ` LIMIT 1;`))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return position{}, 0, fmt.Errorf("error getting latest position: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return position{}, 0, fmt.Errorf("error committing repair: %w", err)
+	}
+	countAnomalies(flags)
+
+	return latest, len(cds), nil
+}
+
+// unstoredUpdates leaves out the updates of a range whose transaction already
+// has as many positions stored in it.
+func unstoredUpdates(ex execer, r blockRange, cds []contractData) ([]contractData, error) {
+	const q = /* sql */ `
+		SELECT transaction_hash, COUNT(*)
+		FROM positions
+		WHERE blck BETWEEN ? AND ?
+		GROUP BY transaction_hash;
+	`
+	rows, err := ex.Query(q, r.From, r.To)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching stored updates: %w", err)
+	}
+	defer rows.Close()
+
+	stored := make(map[string]int)
+	for rows.Next() {
+		var (
+			hash  string
+			count int
+		)
+		if err := rows.Scan(&hash, &count); err != nil {
+			return nil, fmt.Errorf("error scanning stored updates: %w", err)
+		}
+		stored[hash] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating stored updates: %w", err)
+	}
+
+	unstored := make([]contractData, 0, len(cds))
+	for _, cd := range cds {
+		if stored[cd.transactionHash] > 0 {
+			stored[cd.transactionHash]--
+			continue
+		}
+		unstored = append(unstored, cd)
+	}
+	return unstored, nil
+}
+
+// positionBeforeUpdate returns the last stored position before an update in
+// chain order, a zero position when there is none. Positions of its block
+// stored without their log index come before it.
+func positionBeforeUpdate(ex execer, cd contractData) (position, error) {
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE (blck, log_index) <= (?, ?)
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	p, err := scanPosition(ex.QueryRow(q, cd.block, cd.logIndex))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return position{}, fmt.Errorf("error fetching position before the repaired updates: %w", err)
+	}
+	return p, nil
+}
+
+// primeDetectorBefore feeds the detector the positions up to last, as prime
+// does with the latest ones.
+func primeDetectorBefore(ex execer, d *anomalyDetector, last position) error {
+	q := /* sql */ `
+		SELECT * FROM (
+			SELECT ` + positionColumns + `
+			FROM positions
+			WHERE ` + chainKey + ` <= (?, ?, ?)
+			ORDER BY ` + chainOrderDesc + `
+			LIMIT ?
+		) ORDER BY ` + chainOrder + `;
+	`
+	rows, err := ex.Query(q, append(last.chainKey(), d.cfg.PriceWindow+1)...)
+	if err != nil {
+		return fmt.Errorf("error fetching positions for anomaly detection: %w", err)
+	}
+	ps, err := scanPositions(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		d.check(p)
+	}
+	return nil
+}
+
+// recomputeAfter recomputes the positions after prev in chain order in place,
+// along with their anomalies. It returns the anomalies flagged on the
+// recovered positions.
+func recomputeAfter(ctx context.Context, ex execer, d *anomalyDetector, model LocomotionModel, arena *arena, prev position, recovered map[int]bool) ([]string, error) {
+	const batchSize = 1000
+
+	const selectQ = /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` > (?, ?, ?)
+		ORDER BY ` + chainOrder + `
+		LIMIT ?;
+	`
+
+	const updateQ = /* sql */ `
+		UPDATE positions
+		SET
+			x = ?,
+			y = ?,
+			direction = ?,
+			collision = ?,
+			model = ?,
+			model_version = ?,
+			step_length = ?,
+			heading_change = ?,
+			speed = ?,
+			angular_velocity = ?,
+			path_length = ?,
+			displacement = ?,
+			anomalies = ?
+		WHERE id = ?;
+	`
+
+	var flags []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		rows, err := ex.Query(selectQ, append(prev.chainKey(), batchSize)...)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching positions to recompute: %w", err)
+		}
+		ps, err := scanPositions(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(ps) == 0 {
+			return flags, nil
+		}
+
+		for _, p := range ps {
+			if p.LeftMuscle == nil || p.RightMuscle == nil {
+				return nil, fmt.Errorf("position %d: %w", p.ID, errMissingMuscles)
+			}
+
+			np := updatePosition(model, arena, p.contractData(), prev)
+			np.ID = p.ID
+			np.Anomalies = d.check(np)
+			if recovered[np.ID] {
+				flags = append(flags, np.Anomalies...)
+			}
+
+			args := []any{np.X, np.Y, np.Direction, np.Collision, np.Model, np.ModelVersion}
+			args = append(args, kinematicsArgs(np.Kinematics)...)
+			if _, err := ex.Exec(updateQ, append(args, joinAnomalies(np.Anomalies), np.ID)...); err != nil {
+				return nil, fmt.Errorf("error saving recomputed position: %w", err)
+			}
+			prev = np
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+const blockRepairColumns = /* sql */ `
+	start_block, end_block, ledger_status, status, attempts, recovered, error,
+	next_attempt_at, updated_at`
+
+func scanBlockRepair(row scanner) (blockRepair, error) {
+	var rep blockRepair
+	err := row.Scan(
+		&rep.From,
+		&rep.To,
+		&rep.LedgerStatus,
+		&rep.Status,
+		&rep.Attempts,
+		&rep.Recovered,
+		&rep.Error,
+		&rep.NextAttemptAt,
+		&rep.UpdatedAt,
+	)
+	return rep, err
+}
+
+func queryBlockRepairs(ex execer, q string, args ...any) ([]blockRepair, error) {
+	rows, err := ex.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching block repairs: %w", err)
+	}
+	defer rows.Close()
+
+	repairs := make([]blockRepair, 0)
+	for rows.Next() {
+		rep, err := scanBlockRepair(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning block repair: %w", err)
+		}
+		repairs = append(repairs, rep)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating block repairs: %w", err)
+	}
+	return repairs, nil
+}
+
+// scheduleRepairs opens a repair for every skipped or failed range of the
+// ledger without one, supersedes the open repairs whose range changed, and
+// returns the repairs due, in block order.
+func (db *dbManager) scheduleRepairs(now time.Time) ([]blockRepair, error) {
+	tx, err := db.begin(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	ranges, err := queryBlockRanges(tx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	gaps := make(map[[2]int]blockRange)
+	for _, r := range ranges {
+		if r.Status != BlockRangeDone {
+			gaps[[2]int{r.From, r.To}] = r
+		}
+	}
+
+	open, err := queryBlockRepairs(tx, `SELECT `+blockRepairColumns+` FROM block_repairs WHERE status IN ('pending', 'retrying');`)
+	if err != nil {
+		return nil, err
+	}
+	for _, rep := range open {
+		if r, ok := gaps[[2]int{rep.From, rep.To}]; ok && r.Status == rep.LedgerStatus {
+			continue
+		}
+		rep.Status, rep.NextAttemptAt, rep.UpdatedAt = repairSuperseded, nil, now
+		if err := saveRepair(tx, rep); err != nil {
+			return nil, err
+		}
+	}
+
+	// Ranges that were repaired or superseded and show up again start over,
+	// abandoned ones stay abandoned
+	const openQ = /* sql */ `
+		INSERT INTO block_repairs (start_block, end_block, ledger_status, status, next_attempt_at, updated_at)
+		VALUES (?1, ?2, ?3, 'pending', ?4, ?4)
+		ON CONFLICT (start_block, end_block) DO UPDATE SET
+			ledger_status = excluded.ledger_status,
+			status = 'pending',
+			attempts = 0,
+			recovered = 0,
+			error = '',
+			next_attempt_at = excluded.next_attempt_at,
+			updated_at = excluded.updated_at
+		WHERE status IN ('repaired', 'superseded')
+		OR (status != 'abandoned' AND ledger_status != excluded.ledger_status);
+	`
+	for _, r := range gaps {
+		if _, err := tx.Exec(openQ, r.From, r.To, r.Status, now); err != nil {
+			return nil, fmt.Errorf("error opening block repair: %w", err)
+		}
+	}
+
+	due, err := queryBlockRepairs(tx, `
+		SELECT `+blockRepairColumns+`
+		FROM block_repairs
+		WHERE status IN ('pending', 'retrying') AND next_attempt_at <= ?
+		ORDER BY start_block ASC;
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing block repairs: %w", err)
+	}
+	return due, nil
+}
+
+func saveRepair(ex execer, rep blockRepair) error {
+	const q = /* sql */ `
+		UPDATE block_repairs
+		SET
+			status = ?,
+			attempts = ?,
+			recovered = ?,
+			error = ?,
+			next_attempt_at = ?,
+			updated_at = ?
+		WHERE start_block = ? AND end_block = ?;
+	`
+	_, err := ex.Exec(q, rep.Status, rep.Attempts, rep.Recovered, rep.Error, rep.NextAttemptAt, rep.UpdatedAt, rep.From, rep.To)
+	if err != nil {
+		return fmt.Errorf("error saving block repair: %w", err)
+	}
+	return nil
+}
+
+// FetchRepairs returns the repairs with a status, every one when it's empty,
+// in block order.
+func (db *dbManager) FetchRepairs(status string) ([]blockRepair, error) {
+	switch status {
+	case "", repairPending, repairRetrying, repairRepaired, repairAbandoned, repairSuperseded:
+	default:
+		return nil, errInvalidRepair
+	}
+
+	return queryBlockRepairs(db.reader, `
+		SELECT `+blockRepairColumns+`
+		FROM block_repairs
+		WHERE ?1 = '' OR status = ?1
+		ORDER BY start_block ASC, end_block ASC;
+	`, status)
+}
@@ -0,0 +1,223 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// repairTestUpdate returns an update recovered by a repair, the log-th one of
+// the i-th block of the made up trajectory.
+func repairTestUpdate(i, log int, hash string) contractData {
+	cd := benchmarkContractData(i)
+	cd.logIndex, cd.transactionHash = log, hash
+	cd.leftMuscle, cd.rightMuscle = int64(log+2), int64(-log)
+	return cd
+}
+
+func TestUnstoredUpdates(t *testing.T) {
+	db := openTestDB(t)
+	a, err := NewArena(ArenaConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two positions of 0xa and one of 0xb in the range, one of 0xc after it
+	var p position
+	for i, hash := range []string{"0xa", "0xa", "0xb", "0xc"} {
+		cd := benchmarkContractData(i)
+		cd.transactionHash = hash
+		if i == 3 {
+			cd.block = initialBlock + 100
+		}
+		if p, err = db.SavePosition(updatePosition(legacyModel{}, a, cd, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cds := []contractData{
+		repairTestUpdate(0, 0, "0xa"),
+		repairTestUpdate(1, 0, "0xa"),
+		repairTestUpdate(1, 1, "0xa"), // a third update of 0xa
+		repairTestUpdate(2, 0, "0xb"),
+		repairTestUpdate(2, 1, "0xc"), // 0xc is only stored outside the range
+		repairTestUpdate(3, 0, "0xd"),
+	}
+	got, err := unstoredUpdates(db.writer, blockRange{From: initialBlock, To: initialBlock + 3}, cds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []contractData{cds[2], cds[4], cds[5]}
+	if len(got) != len(want) {
+		t.Fatalf("got %d unstored updates, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("unstored update %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestApplyRepair(t *testing.T) {
+	db := openTestDB(t)
+	a, err := NewArena(ArenaConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anomalies := AnomalyConfig{MuscleMin: -100, MuscleMax: 100, PriceSigma: 4, PriceWindow: 20}
+
+	// Blocks 0 to 9 were stored but for block 4, and a second update of block
+	// 3 was missed
+	var (
+		p      position
+		stored = make(map[int]int) // the block of each stored id
+	)
+	for i := 0; i < 10; i++ {
+		if i == 4 {
+			continue
+		}
+		if p, err = db.SavePosition(updatePosition(legacyModel{}, a, benchmarkContractData(i), p)); err != nil {
+			t.Fatal(err)
+		}
+		stored[p.ID] = p.Block
+	}
+
+	// The stored update of block 3 comes back along with the missed ones, out
+	// of order
+	recovered := []contractData{
+		repairTestUpdate(4, 1, "0xr2"),
+		benchmarkContractData(3),
+		repairTestUpdate(4, 0, "0xr2"),
+		repairTestUpdate(3, 2, "0xr1"),
+	}
+	r := blockRange{From: initialBlock + 3, To: initialBlock + 4, Status: BlockRangeFailed}
+	latest, n, err := db.applyRepair(context.Background(), r, recovered, legacyModel{}, a, anomalies)
+	if err != nil {
+		t.Fatalf("applying repair: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("stored %d recovered updates, want 3", n)
+	}
+
+	// Replayed in chain order, the positions land where a history without
+	// the gap takes them
+	chain := []contractData{
+		benchmarkContractData(0),
+		benchmarkContractData(1),
+		benchmarkContractData(2),
+		benchmarkContractData(3),
+		repairTestUpdate(3, 2, "0xr1"),
+		repairTestUpdate(4, 0, "0xr2"),
+		repairTestUpdate(4, 1, "0xr2"),
+	}
+	for i := 5; i < 10; i++ {
+		chain = append(chain, benchmarkContractData(i))
+	}
+
+	ps, err := db.RecentPositions(len(chain) + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != len(chain) {
+		t.Fatalf("got %d positions, want %d", len(ps), len(chain))
+	}
+	var want position
+	for i, cd := range chain {
+		want = updatePosition(legacyModel{}, a, cd, want)
+		got := ps[i]
+		if got.Block != want.Block || got.LogIndex != want.LogIndex || got.TransactionHash != want.TransactionHash {
+			t.Fatalf("position %d is log %d of block %d in %s, want log %d of block %d in %s",
+				i, got.LogIndex, got.Block, got.TransactionHash, want.LogIndex, want.Block, want.TransactionHash)
+		}
+		if !sameCoordinate(got.X, want.X) || !sameCoordinate(got.Y, want.Y) || !sameCoordinate(got.Direction, want.Direction) {
+			t.Errorf("position %d is at (%g, %g) heading %g, want (%g, %g) heading %g",
+				i, got.X, got.Y, got.Direction, want.X, want.Y, want.Direction)
+		}
+	}
+	if latest.ID != p.ID || !sameCoordinate(latest.X, want.X) || !sameCoordinate(latest.Y, want.Y) {
+		t.Errorf("latest position is %+v, want id %d at (%g, %g)", latest, p.ID, want.X, want.Y)
+	}
+
+	// The most recent positions are the last ones in chain order, whatever
+	// their ids
+	recent, err := db.fetchRecentPositions(5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, got := range recent {
+		if want := ps[len(ps)-5+i]; got.ID != want.ID {
+			t.Errorf("recent position %d is %d, want %d", i, got.ID, want.ID)
+		}
+	}
+
+	// The stored positions keep their ids, the recovered ones come after
+	byID, err := db.Positions(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range byID {
+		block, ok := stored[got.ID]
+		switch {
+		case ok && got.Block != block:
+			t.Errorf("position %d moved from block %d to block %d", got.ID, block, got.Block)
+		case !ok && got.ID <= p.ID:
+			t.Errorf("recovered position got id %d, not after the stored ones", got.ID)
+		}
+	}
+
+	ranges, err := db.BlockRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, br := range ranges {
+		if br.Status != BlockRangeDone {
+			t.Errorf("blocks %d to %d are %s after the repair", br.From, br.To, br.Status)
+		}
+	}
+}
+
+func TestApplyRepairRefusesAnotherModel(t *testing.T) {
+	db := openTestDB(t)
+	a, err := NewArena(ArenaConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anomalies := AnomalyConfig{MuscleMin: -100, MuscleMax: 100, PriceSigma: 4, PriceWindow: 20}
+
+	var p position
+	for _, i := range []int{0, 1, 3} {
+		if p, err = db.SavePosition(updatePosition(legacyModel{}, a, benchmarkContractData(i), p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The active trajectory was built with a differential drive, the legacy
+	// model can't recompute what follows the recovered update
+	drive, err := NewLocomotionModel(LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: DefaultWheelbase, Gain: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := describeActiveTrajectory(db.writer, drive, trajectoryParams{Locomotion: drive.Config(), Arena: a.cfg}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := blockRange{From: initialBlock + 2, To: initialBlock + 2, Status: BlockRangeFailed}
+	cds := []contractData{benchmarkContractData(2)}
+	if _, _, err := db.applyRepair(context.Background(), r, cds, legacyModel{}, a, anomalies); !errors.Is(err, errRepairModelMismatch) {
+		t.Fatalf("repairing with another model returned %v, want %v", err, errRepairModelMismatch)
+	}
+
+	// Nor can the same model with another gain
+	other, err := NewLocomotionModel(LocomotionConfig{Model: DifferentialDriveModel, Wheelbase: DefaultWheelbase, Gain: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.applyRepair(context.Background(), r, cds, other, a, anomalies); !errors.Is(err, errRepairModelMismatch) {
+		t.Fatalf("repairing with another gain returned %v, want %v", err, errRepairModelMismatch)
+	}
+
+	if _, n, err := db.applyRepair(context.Background(), r, cds, drive, a, anomalies); err != nil || n != 1 {
+		t.Fatalf("repairing with the trajectory's model stored %d updates: %v", n, err)
+	}
+}
@@ -0,0 +1,966 @@
+package src
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Positions older than the full resolution window are rolled up into the
+// buckets of the first retention tier and deleted. A rollup keeps the
+// aggregates of its moves, like the series rollups, along with the positions
+// its path was simplified to. As rollups age they're merged into the buckets
+// of the next, coarser tier, and dropped after the last tier if it has an age.
+
+// The resolution of the positions themselves.
+const resolutionFull = "full"
+
+const (
+	maxPathPositions = 10000 // positions a path is served at full resolution up to
+	maxPathBuckets   = 1000  // buckets an automatic resolution aims to stay under
+)
+
+var errPathTooLarge = errors.New("too many positions for full resolution, narrow the range or pick a coarser resolution")
+
+var positionsRolledUpTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "worm_tracker_positions_rolled_up_total",
+		Help: "Positions rolled up into the retention tiers and deleted.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(positionsRolledUpTotal)
+}
+
+// RetentionConfig sets how long positions are kept at full resolution and the
+// tiers older positions are rolled up into.
+type RetentionConfig struct {
+	FullDays int             // 0 keeps every position
+	Tiers    []RetentionTier // from the finest to the coarsest
+	Points   int             // path points kept per rollup
+	Interval time.Duration   // time between compactions
+}
+
+// RetentionTier keeps rollups of one of the seriesBuckets until they're a
+// number of days old.
+type RetentionTier struct {
+	Bucket string
+	Days   int // 0 keeps the rollups for good, only the last tier may
+}
+
+// ParseRetentionTiers reads tiers written as bucket:days separated by commas,
+// the days of the last tier being optional.
+func ParseRetentionTiers(s string) ([]RetentionTier, error) {
+	var tiers []RetentionTier
+	for _, part := range strings.Split(s, ",") {
+		bucket, days, found := strings.Cut(strings.TrimSpace(part), ":")
+		t := RetentionTier{Bucket: bucket}
+		if found {
+			d, err := strconv.Atoi(days)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention tier %q", part)
+			}
+			t.Days = d
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, nil
+}
+
+func (cfg RetentionConfig) validate() error {
+	if cfg.FullDays < 0 {
+		return fmt.Errorf("invalid full resolution days %d: must not be negative", cfg.FullDays)
+	}
+	if len(cfg.Tiers) == 0 {
+		return fmt.Errorf("invalid retention tiers: at least one is needed")
+	}
+	if cfg.Points < 2 {
+		return fmt.Errorf("invalid points per rollup %d: must be at least 2", cfg.Points)
+	}
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("invalid retention interval %v: must be positive", cfg.Interval)
+	}
+
+	prevSize, prevDays := time.Duration(0), cfg.FullDays
+	for i, t := range cfg.Tiers {
+		size, ok := seriesBuckets[t.Bucket]
+		if !ok {
+			return fmt.Errorf("invalid retention tier %q: must be one of 1m, 5m, 1h or 1d", t.Bucket)
+		}
+		if prevSize > 0 && (size <= prevSize || size%prevSize != 0) {
+			return fmt.Errorf("invalid retention tier %s: must be a multiple of the tier before it", t.Bucket)
+		}
+		last := i == len(cfg.Tiers)-1
+		if t.Days == 0 && !last {
+			return fmt.Errorf("invalid retention tier %s: only the last tier can be kept for good", t.Bucket)
+		}
+		if t.Days != 0 && t.Days <= prevDays {
+			return fmt.Errorf("invalid retention tier %s: must be kept longer than %d days", t.Bucket, prevDays)
+		}
+		prevSize, prevDays = size, t.Days
+	}
+	return nil
+}
+
+// compactJob hands a compaction to the worm loop.
+type compactJob struct {
+	ctx  context.Context
+	now  time.Time
+	done chan error
+}
+
+// retention rolls up and deletes the positions that fell out of the full
+// resolution window.
+type retention struct {
+	log  *zap.Logger
+	db   *dbManager
+	cfg  RetentionConfig
+	jobs chan compactJob
+
+	mu sync.Mutex // held while compacting
+}
+
+// NewRetention returns the retention of the store, nil when every position is
+// kept or the store isn't SQLite.
+func NewRetention(log *zap.Logger, store Store, cfg RetentionConfig) (*retention, error) {
+	db, ok := store.(*dbManager)
+	if !ok || cfg.FullDays == 0 {
+		return nil, nil
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &retention{log: log, db: db, cfg: cfg, jobs: make(chan compactJob)}, nil
+}
+
+// Run compacts straight away and then every interval until the context is
+// done. The worm loop must be running to take the compactions, a compaction
+// that comes up while a recomputation is running waits for the next interval.
+func (rt *retention) Run(ctx context.Context) {
+	for {
+		err := rt.submit(ctx, time.Now())
+		switch {
+		case errors.Is(err, errRecomputeRunning):
+			rt.log.Info("recomputation running, postponing compaction")
+		case err != nil && ctx.Err() == nil:
+			rt.log.Error("error compacting positions", zap.Error(err))
+		}
+
+		timer := time.NewTimer(rt.cfg.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// submit hands a compaction to the worm loop and waits for it.
+func (rt *retention) submit(ctx context.Context, now time.Time) error {
+	job := compactJob{ctx: ctx, now: now, done: make(chan error, 1)}
+	select {
+	case rt.jobs <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-job.done
+}
+
+// compactPaused compacts unless a recomputation is running, its replay reads
+// the positions a roll up deletes. Recomputations wait for the compaction.
+func (rt *retention) compactPaused(ctx context.Context, now time.Time, rc *recomputer) error {
+	if rc != nil {
+		if !rc.pause() {
+			return errRecomputeRunning
+		}
+		defer rc.resume()
+	}
+	return rt.Compact(ctx, now)
+}
+
+// Compact rolls up the positions older than the full resolution window and
+// moves the rollups that aged out of a tier on to the next one. Every batch
+// is committed on its own, so an interrupted compaction resumes where it
+// stopped.
+func (rt *retention) Compact(ctx context.Context, now time.Time) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rolled, err := rt.rollUpPositions(ctx, now)
+	if rolled > 0 {
+		rt.log.Info("positions rolled up", zap.Int("positions", rolled), zap.String("tier", rt.cfg.Tiers[0].Bucket))
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, t := range rt.cfg.Tiers {
+		moved, err := rt.compactTier(ctx, i, now)
+		if moved > 0 {
+			rt.log.Info("rollups compacted", zap.Int("rollups", moved), zap.String("tier", t.Bucket))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollUpPositions rolls the positions before the start of the full resolution
+// window up into the first tier. The latest position is always kept, it's the
+// one the worm loop moves on from. Whole UTC days are rolled up, short of the
+// day of the latest position, so that no bucket of the series or the heatmap
+// holds both rolled up and kept positions.
+func (rt *retention) rollUpPositions(ctx context.Context, now time.Time) (int, error) {
+	tier := rt.cfg.Tiers[0]
+	latest, err := rt.db.LatestPosition()
+	if err != nil {
+		return 0, err
+	}
+	day := seriesBuckets["1d"]
+	cutoff := now.UTC().AddDate(0, 0, -rt.cfg.FullDays).Truncate(day)
+	if latestDay := latest.Timestamp.UTC().Truncate(day); latestDay.Before(cutoff) {
+		cutoff = latestDay
+	}
+
+	// Positions are rolled up in chain order so the ones kept always follow
+	// each other, even around timestamps that went backwards
+	const cutoffQ = /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ts < ?
+		AND ` + chainKey + ` < (SELECT blck, log_index, id FROM positions ORDER BY ` + chainOrderDesc + ` LIMIT 1)
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	last, err := scanPosition(rt.db.reader.QueryRow(cutoffQ, cutoff))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error finding positions to roll up: %w", err)
+	}
+
+	// The rollups start where the latest rolled up position left the worm
+	const prevQ = /* sql */ `
+		SELECT end_x, end_y
+		FROM retention_buckets
+		ORDER BY start_ts DESC
+		LIMIT 1;
+	`
+	var prev position
+	if err := rt.db.reader.QueryRow(prevQ).Scan(&prev.X, &prev.Y); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("error fetching latest rollup: %w", err)
+	}
+
+	rolled := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return rolled, err
+		}
+
+		n, rolledUp, err := rt.rollUpBatch(ctx, tier.Bucket, last, prev)
+		if err != nil {
+			return rolled, err
+		}
+		if n == 0 {
+			return rolled, nil
+		}
+		rolled += n
+		positionsRolledUpTotal.Add(float64(n))
+		prev = rolledUp
+	}
+}
+
+// rollUpBatch rolls the next batch of positions up to last into the rollups
+// of a tier and deletes them, in a transaction. It returns the number of
+// positions rolled up and the last one.
+func (rt *retention) rollUpBatch(ctx context.Context, bucket string, last, prev position) (int, position, error) {
+	const batchSize = 2000
+
+	tx, err := rt.db.begin(ctx)
+	if err != nil {
+		return 0, position{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` <= (?, ?, ?)
+		ORDER BY ` + chainOrder + `
+		LIMIT ?;
+	`
+	rows, err := tx.Query(q, append(last.chainKey(), batchSize)...)
+	if err != nil {
+		return 0, position{}, fmt.Errorf("error fetching positions to roll up: %w", err)
+	}
+	ps, err := scanPositions(rows)
+	rows.Close()
+	if err != nil {
+		return 0, position{}, err
+	}
+	if len(ps) == 0 {
+		return 0, prev, nil
+	}
+
+	var rollups []*rollup
+	byStart := make(map[time.Time]*rollup)
+	for _, p := range ps {
+		start := p.Timestamp.UTC().Truncate(seriesBuckets[bucket])
+		r, ok := byStart[start]
+		if !ok {
+			if r, err = loadRollup(tx, bucket, start); err != nil {
+				return 0, position{}, err
+			}
+			if r == nil {
+				r = &rollup{seriesBucket: newSeriesBucket(bucket, prev, p)}
+			}
+			byStart[start] = r
+			rollups = append(rollups, r)
+		}
+		r.addPosition(p, rt.cfg.Points)
+		prev = p
+	}
+
+	for _, r := range rollups {
+		r.simplify(rt.cfg.Points)
+		if err := saveRollup(tx, *r); err != nil {
+			return 0, position{}, err
+		}
+	}
+
+	// Aggregate derivations keep what they took from the positions, rebuilds
+	// included, the ones pointing at them are cleaned up along with them
+	const rolledUpQ = /* sql */ `SELECT id FROM positions WHERE ` + chainKey + ` <= (?, ?, ?)`
+	for _, table := range []string{"positions_rtree", "trajectory_points", "positions"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE id IN (`+rolledUpQ+`);`, prev.chainKey()...); err != nil {
+			return 0, position{}, fmt.Errorf("error deleting rolled up positions from %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, position{}, fmt.Errorf("error committing rollups: %w", err)
+	}
+	return len(ps), prev, nil
+}
+
+// compactTier merges the rollups of the tier older than its days into the
+// next tier, or drops them when it's the last tier. It returns the number of
+// rollups moved on.
+func (rt *retention) compactTier(ctx context.Context, i int, now time.Time) (int, error) {
+	const batchSize = 500
+
+	tier := rt.cfg.Tiers[i]
+	if tier.Days == 0 {
+		return 0, nil
+	}
+	horizon := now.UTC().AddDate(0, 0, -tier.Days)
+
+	if i == len(rt.cfg.Tiers)-1 {
+		horizon = horizon.Truncate(seriesBuckets[tier.Bucket])
+		return deleteRollups(rt.db.writer, tier.Bucket, horizon)
+	}
+
+	next := rt.cfg.Tiers[i+1]
+	horizon = horizon.Truncate(seriesBuckets[next.Bucket])
+
+	moved := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+
+		n, err := rt.compactBatch(ctx, tier.Bucket, next.Bucket, horizon, batchSize)
+		if err != nil {
+			return moved, err
+		}
+		if n == 0 {
+			return moved, nil
+		}
+		moved += n
+	}
+}
+
+// compactBatch merges the next batch of rollups of a tier starting before the
+// horizon into the next tier, in a transaction.
+func (rt *retention) compactBatch(ctx context.Context, bucket, next string, horizon time.Time, limit int) (int, error) {
+	tx, err := rt.db.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	children, err := queryRollups(tx, bucket, time.Time{}, horizon.Add(-time.Nanosecond), limit)
+	if err != nil {
+		return 0, err
+	}
+	if len(children) == 0 {
+		return 0, nil
+	}
+
+	var parents []*rollup
+	byStart := make(map[time.Time]*rollup)
+	for _, c := range children {
+		start := c.Start.Truncate(seriesBuckets[next])
+		p, ok := byStart[start]
+		if !ok {
+			if p, err = loadRollup(tx, next, start); err != nil {
+				return 0, err
+			}
+			if p == nil {
+				p = coarsen(nil, c, next, rt.cfg.Points)
+			} else {
+				coarsen(p, c, next, rt.cfg.Points)
+			}
+			byStart[start] = p
+			parents = append(parents, p)
+		} else {
+			coarsen(p, c, next, rt.cfg.Points)
+		}
+
+		if err := deleteRollup(tx, bucket, c.Start); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, p := range parents {
+		p.simplify(rt.cfg.Points)
+		if err := saveRollup(tx, *p); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing rollups: %w", err)
+	}
+	return len(children), nil
+}
+
+// -----------------------------------------------------------------------------
+// Rollups
+
+// rollup is a bucket of a retention tier, the aggregates of its moves and the
+// positions its path was simplified to.
+type rollup struct {
+	seriesBucket
+	Points []position `json:"points"`
+}
+
+// rollupChunk is how many times the points to keep a rollup collects before
+// it's simplified, bounding the memory big buckets take.
+const rollupChunk = 8
+
+func (r *rollup) addPosition(p position, points int) {
+	r.add(p)
+	p.Kinematics, p.Behaviour, p.Anomalies = nil, "", nil
+	r.Points = append(r.Points, p)
+	if len(r.Points) >= rollupChunk*points {
+		r.simplify(points)
+	}
+}
+
+// simplify keeps up to n of the rollup's points, chosen by
+// Ramer–Douglas–Peucker.
+func (r *rollup) simplify(n int) {
+	slices.SortFunc(r.Points, func(a, b position) int {
+		return cmp.Or(cmp.Compare(a.Block, b.Block), cmp.Compare(a.LogIndex, b.LogIndex), cmp.Compare(a.ID, b.ID))
+	})
+
+	path := make([]pathPoint, len(r.Points))
+	for i, p := range r.Points {
+		path[i] = pathPoint{ID: p.ID, Timestamp: p.Timestamp, X: p.X, Y: p.Y}
+	}
+	kept := make([]position, 0, n)
+	for _, i := range samplePath(path, n, sampleRDP) {
+		kept = append(kept, r.Points[i])
+	}
+	r.Points = kept
+}
+
+// coarsen merges a rollup into the rollup of a coarser bucket it falls in,
+// starting that rollup from it when parent is nil. Rollups must be merged in
+// order.
+func coarsen(parent *rollup, r rollup, bucket string, points int) *rollup {
+	if parent == nil {
+		start := r.Start.Truncate(seriesBuckets[bucket])
+		parent = &rollup{seriesBucket: r.seriesBucket}
+		parent.Bucket, parent.Start, parent.End = bucket, start, start.Add(seriesBuckets[bucket])
+		parent.Points = slices.Clone(r.Points)
+		return parent
+	}
+
+	parent.merge(r.seriesBucket)
+	parent.Points = append(parent.Points, r.Points...)
+	if len(parent.Points) >= rollupChunk*points {
+		parent.simplify(points)
+	}
+	return parent
+}
+
+// -----------------------------------------------------------------------------
+// Tiered paths
+
+// tieredPath is the path of the worm over a time range. Each part of the
+// range is read from the finest tier holding it, at the requested resolution
+// or coarser where only coarser rollups are left.
+type tieredPath struct {
+	Resolution string     `json:"resolution"`
+	Rollups    []rollup   `json:"rollups"`   // oldest first, each carrying its own bucket
+	Positions  []position `json:"positions"` // the part held at full resolution, when it's requested
+}
+
+// fetchTieredPath returns the path between from and to at a resolution, full
+// or one of the seriesBuckets. An empty resolution picks the finest one that
+// keeps the path small. Rolled up buckets keep up to points path points.
+func (db *dbManager) fetchTieredPath(from, to time.Time, resolution string, points int) (tieredPath, error) {
+	var (
+		positions int
+		buckets   int
+	)
+	const countQ = /* sql */ `
+		SELECT
+			(SELECT COUNT(*) FROM positions WHERE (?1 IS NULL OR ts >= ?1) AND (?2 IS NULL OR ts <= ?2)),
+			(SELECT COUNT(*) FROM retention_buckets WHERE (?3 IS NULL OR start_ts >= ?3) AND (?2 IS NULL OR start_ts <= ?2));
+	`
+	// rollups starting before from can still hold positions after it
+	rollupFrom := from
+	if !from.IsZero() {
+		rollupFrom = from.UTC().Truncate(24 * time.Hour)
+	}
+	if err := db.reader.QueryRow(countQ, nullTime(from), nullTime(to), nullTime(rollupFrom)).Scan(&positions, &buckets); err != nil {
+		return tieredPath{}, fmt.Errorf("error counting path: %w", err)
+	}
+
+	if resolution == "" {
+		var err error
+		if resolution, err = db.pathResolution(from, to, positions, buckets); err != nil {
+			return tieredPath{}, err
+		}
+	}
+	if resolution == resolutionFull && positions > maxPathPositions {
+		return tieredPath{}, errPathTooLarge
+	}
+
+	path := tieredPath{Resolution: resolution, Rollups: make([]rollup, 0), Positions: make([]position, 0)}
+
+	tiers, err := db.retentionTiers()
+	if err != nil {
+		return tieredPath{}, err
+	}
+	for _, tier := range tiers {
+		rs, err := queryRollups(db.reader, tier, from, to, -1)
+		if err != nil {
+			return tieredPath{}, err
+		}
+		// rollups are only merged into coarser ones, never split
+		if resolution != resolutionFull && seriesBuckets[tier] < seriesBuckets[resolution] {
+			rs = coarsenAll(rs, resolution, points)
+		}
+		path.Rollups = append(path.Rollups, rs...)
+	}
+
+	if resolution == resolutionFull {
+		if path.Positions, err = db.fetchPositionsBetween(from, to); err != nil {
+			return tieredPath{}, err
+		}
+		stripKinematics(path.Positions)
+	} else {
+		rs, err := db.rollUpPositionsBetween(from, to, resolution, points)
+		if err != nil {
+			return tieredPath{}, err
+		}
+		path.Rollups = append(path.Rollups, rs...)
+	}
+
+	slices.SortStableFunc(path.Rollups, func(a, b rollup) int { return a.Start.Compare(b.Start) })
+	for i := range path.Rollups {
+		path.Rollups[i].setMeans()
+	}
+	return path, nil
+}
+
+// pathResolution picks full resolution when the range is held in full and
+// small enough, and otherwise the finest bucket that keeps the number of
+// buckets under maxPathBuckets.
+func (db *dbManager) pathResolution(from, to time.Time, positions, buckets int) (string, error) {
+	if buckets == 0 && positions <= maxPathPositions {
+		return resolutionFull, nil
+	}
+
+	// Open ends of the range stop at the ends of the stored history
+	if from.IsZero() {
+		const q = /* sql */ `
+			SELECT start_ts FROM (SELECT start_ts FROM retention_buckets ORDER BY start_ts ASC LIMIT 1)
+			UNION ALL
+			SELECT ts FROM (SELECT ts FROM positions ORDER BY ` + chainOrder + ` LIMIT 1)
+			LIMIT 1;
+		`
+		if err := db.reader.QueryRow(q).Scan(&from); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("error getting start of path: %w", err)
+		}
+	}
+	if to.IsZero() {
+		const q = /* sql */ `SELECT ts FROM positions ORDER BY ` + chainOrderDesc + ` LIMIT 1;`
+		if err := db.reader.QueryRow(q).Scan(&to); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("error getting end of path: %w", err)
+		}
+	}
+
+	span := to.Sub(from)
+	for _, bucket := range []string{"1m", "5m", "1h"} {
+		if span/seriesBuckets[bucket] <= maxPathBuckets {
+			return bucket, nil
+		}
+	}
+	return "1d", nil
+}
+
+// coarsenAll merges rollups, in order, into the rollups of a coarser bucket.
+func coarsenAll(rs []rollup, bucket string, points int) []rollup {
+	var (
+		out     []rollup
+		current *rollup
+	)
+	for _, r := range rs {
+		if current != nil && !current.contains(position{Timestamp: r.Start}) {
+			current.simplify(points)
+			out = append(out, *current)
+			current = nil
+		}
+		current = coarsen(current, r, bucket, points)
+	}
+	if current != nil {
+		current.simplify(points)
+		out = append(out, *current)
+	}
+	return out
+}
+
+// rollUpPositionsBetween rolls the positions between from and to up into
+// buckets as they're read.
+func (db *dbManager) rollUpPositionsBetween(from, to time.Time, bucket string, points int) ([]rollup, error) {
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE (?1 IS NULL OR ts >= ?1)
+		AND (?2 IS NULL OR ts <= ?2)
+		ORDER BY ` + chainOrder + `;
+	`
+	rows, err := db.reader.Query(q, nullTime(from), nullTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching positions to roll up: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		rollups []*rollup
+		prev    *position
+	)
+	byStart := make(map[time.Time]*rollup)
+	for rows.Next() {
+		p, err := scanPosition(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning position: %w", err)
+		}
+		if prev == nil {
+			if prev, err = db.positionBefore(p); err != nil {
+				return nil, err
+			}
+		}
+
+		start := p.Timestamp.UTC().Truncate(seriesBuckets[bucket])
+		r, ok := byStart[start]
+		if !ok {
+			r = &rollup{seriesBucket: newSeriesBucket(bucket, *prev, p)}
+			byStart[start] = r
+			rollups = append(rollups, r)
+		}
+		r.addPosition(p, points)
+		prev = &p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating positions: %w", err)
+	}
+
+	out := make([]rollup, 0, len(rollups))
+	for _, r := range rollups {
+		r.simplify(points)
+		out = append(out, *r)
+	}
+	return out, nil
+}
+
+// positionBefore returns the position before p, a zero position when there is
+// none.
+func (db *dbManager) positionBefore(p position) (*position, error) {
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` < (?, ?, ?)
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	prev, err := scanPosition(db.reader.QueryRow(q, p.chainKey()...))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error fetching previous position: %w", err)
+	}
+	return &prev, nil
+}
+
+// fetchPositionsBetween returns the positions between from and to, in order.
+func (db *dbManager) fetchPositionsBetween(from, to time.Time) ([]position, error) {
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE (?1 IS NULL OR ts >= ?1)
+		AND (?2 IS NULL OR ts <= ?2)
+		ORDER BY ` + chainOrder + `;
+	`
+	rows, err := db.reader.Query(q, nullTime(from), nullTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching positions: %w", err)
+	}
+	defer rows.Close()
+
+	return scanPositions(rows)
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+// rollupPointColumns reads the points of rollups with the columns of
+// positions.
+const rollupPointColumns = /* sql */ `
+	id, blck, log_index, transaction_hash, x, y, direction, price, ts, model,
+	model_version, collision, left_muscle, right_muscle, NULL, NULL, NULL, NULL, NULL,
+	NULL, NULL, NULL`
+
+// historySource reads the positions along with the points kept of rolled up
+// ones. The compound select takes its column names from positions.
+const historySource = /* sql */ `(
+	SELECT ` + positionColumns + `
+	FROM positions
+	UNION ALL
+	SELECT ` + rollupPointColumns + `
+	FROM retention_points
+) AS positions`
+
+// lastRolledUp returns the last rolled up position as its point was kept, the
+// zero position when none was. Rollups always keep the last point of their
+// path.
+func lastRolledUp(ex execer) (position, error) {
+	const q = /* sql */ `
+		SELECT ` + rollupPointColumns + `
+		FROM retention_points
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	p, err := scanPosition(ex.QueryRow(q))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return position{}, fmt.Errorf("error getting last rolled up position: %w", err)
+	}
+	return p, nil
+}
+
+// rolledUpBucket reports whether the bucket of a size holding p is not after
+// the one holding the last rolled up position. Rebuilt derivations keep what
+// they counted in those buckets rather than count it again.
+func rolledUpBucket(last, p position, size time.Duration) bool {
+	return last.ID != 0 && !p.Timestamp.UTC().Truncate(size).After(last.Timestamp.UTC().Truncate(size))
+}
+
+// retentionTiers returns the buckets rollups are stored at, finest first.
+func (db *dbManager) retentionTiers() ([]string, error) {
+	rows, err := db.reader.Query(`SELECT DISTINCT bucket FROM retention_buckets;`)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching retention tiers: %w", err)
+	}
+	defer rows.Close()
+
+	var tiers []string
+	for rows.Next() {
+		var bucket string
+		if err := rows.Scan(&bucket); err != nil {
+			return nil, fmt.Errorf("error scanning retention tier: %w", err)
+		}
+		tiers = append(tiers, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating retention tiers: %w", err)
+	}
+
+	slices.SortFunc(tiers, func(a, b string) int { return cmp.Compare(seriesBuckets[a], seriesBuckets[b]) })
+	return tiers, nil
+}
+
+// queryRollups returns up to limit rollups of a bucket size overlapping from
+// and to with their points, in order. A zero from or to leaves that end of the
+// range open, a negative limit returns them all.
+func queryRollups(ex execer, bucket string, from, to time.Time, limit int) ([]rollup, error) {
+	if !from.IsZero() {
+		from = from.UTC().Truncate(seriesBuckets[bucket])
+	}
+
+	const bucketsQ = /* sql */ `
+		SELECT ` + seriesColumns + `
+		FROM retention_buckets
+		WHERE bucket = ?1
+		AND (?2 IS NULL OR start_ts >= ?2)
+		AND (?3 IS NULL OR start_ts <= ?3)
+		ORDER BY start_ts ASC
+		LIMIT ?4;
+	`
+	rows, err := ex.Query(bucketsQ, bucket, nullTime(from), nullTime(to), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s rollups: %w", bucket, err)
+	}
+	rollups := make([]rollup, 0)
+	for rows.Next() {
+		b, err := scanSeriesBucket(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning rollup: %w", err)
+		}
+		rollups = append(rollups, rollup{seriesBucket: b, Points: make([]position, 0)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rollups: %w", err)
+	}
+	if len(rollups) == 0 {
+		return rollups, nil
+	}
+
+	const pointsQ = /* sql */ `
+		SELECT start_ts, ` + rollupPointColumns + `
+		FROM retention_points
+		WHERE bucket = ? AND start_ts >= ? AND start_ts <= ?
+		ORDER BY start_ts ASC, ` + chainOrder + `;
+	`
+	rows, err = ex.Query(pointsQ, bucket, rollups[0].Start, rollups[len(rollups)-1].Start)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s rollup points: %w", bucket, err)
+	}
+	defer rows.Close()
+
+	byStart := make(map[time.Time]*rollup, len(rollups))
+	for i := range rollups {
+		byStart[rollups[i].Start] = &rollups[i]
+	}
+	for rows.Next() {
+		var start time.Time
+		p, err := scanPosition(prefixScanner{row: rows, dest: &start})
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rollup point: %w", err)
+		}
+		if r, ok := byStart[start.UTC()]; ok {
+			r.Points = append(r.Points, p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rollup points: %w", err)
+	}
+
+	return rollups, nil
+}
+
+// prefixScanner scans a leading column into dest before the rest of the row.
+type prefixScanner struct {
+	row  scanner
+	dest any
+}
+
+func (s prefixScanner) Scan(dest ...any) error {
+	return s.row.Scan(append([]any{s.dest}, dest...)...)
+}
+
+// loadRollup returns the rollup of a bucket size starting at start, nil when
+// there is none.
+func loadRollup(ex execer, bucket string, start time.Time) (*rollup, error) {
+	rs, err := queryRollups(ex, bucket, start, start, 1)
+	if err != nil || len(rs) == 0 {
+		return nil, err
+	}
+	return &rs[0], nil
+}
+
+func saveRollup(ex execer, r rollup) error {
+	if err := saveBucket(ex, "retention_buckets", r.seriesBucket); err != nil {
+		return err
+	}
+
+	if _, err := ex.Exec(`DELETE FROM retention_points WHERE bucket = ? AND start_ts = ?;`, r.Bucket, r.Start); err != nil {
+		return fmt.Errorf("error deleting %s rollup points: %w", r.Bucket, err)
+	}
+
+	const q = /* sql */ `
+		INSERT INTO retention_points
+			(bucket, start_ts, id, blck, log_index, transaction_hash, x, y, direction, price,
+			ts, model, model_version, collision, left_muscle, right_muscle)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	for _, p := range r.Points {
+		_, err := ex.Exec(q,
+			r.Bucket,
+			r.Start,
+			p.ID,
+			p.Block,
+			p.LogIndex,
+			p.TransactionHash,
+			p.X,
+			p.Y,
+			p.Direction,
+			p.Price,
+			p.Timestamp,
+			p.Model,
+			p.ModelVersion,
+			p.Collision,
+			p.LeftMuscle,
+			p.RightMuscle,
+		)
+		if err != nil {
+			return fmt.Errorf("error saving %s rollup point: %w", r.Bucket, err)
+		}
+	}
+	return nil
+}
+
+func deleteRollup(ex execer, bucket string, start time.Time) error {
+	for _, table := range []string{"retention_buckets", "retention_points"} {
+		if _, err := ex.Exec(`DELETE FROM `+table+` WHERE bucket = ? AND start_ts = ?;`, bucket, start); err != nil {
+			return fmt.Errorf("error deleting %s rollup: %w", bucket, err)
+		}
+	}
+	return nil
+}
+
+// deleteRollups drops the rollups of a bucket size starting before a time and
+// returns how many there were.
+func deleteRollups(ex execer, bucket string, before time.Time) (int, error) {
+	if _, err := ex.Exec(`DELETE FROM retention_points WHERE bucket = ? AND start_ts < ?;`, bucket, before); err != nil {
+		return 0, fmt.Errorf("error dropping %s rollup points: %w", bucket, err)
+	}
+	res, err := ex.Exec(`DELETE FROM retention_buckets WHERE bucket = ? AND start_ts < ?;`, bucket, before)
+	if err != nil {
+		return 0, fmt.Errorf("error dropping %s rollups: %w", bucket, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error dropping %s rollups: %w", bucket, err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,204 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// derivedRows returns the rows of a query yielding one text column.
+func derivedRows(t *testing.T, db *dbManager, q string) []string {
+	t.Helper()
+
+	rows, err := db.reader.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRebuildKeepsRolledUpHistory(t *testing.T) {
+	db := openTestDB(t)
+	a, err := NewArena(ArenaConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	heatmap, err := NewHeatmapOccupancy(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	behaviours, err := NewBehaviourClassifier(BehaviourConfig{PauseThreshold: 0.5, TurnAngle: 30, ReversalAngle: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []derivation{NewSeriesRollups(), heatmap, behaviours} {
+		if err := db.Derive(zap.NewNop(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Three days of positions, half an hour apart
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var p position
+	for i := 0; i < 3*48; i++ {
+		cd := benchmarkContractData(i)
+		cd.ts = start.Add(time.Duration(i) * 30 * time.Minute)
+		if p, err = db.SavePosition(updatePosition(legacyModel{}, a, cd, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queries := map[string]string{
+		"series": /* sql */ `
+			SELECT bucket || ' ' || start_ts || ' ' || first_id || ' ' || last_id || ' ' || moves || ' ' ||
+				printf('%.6f %.6f %.6f %.6f %.6f', distance, start_x, start_y, end_x, end_y)
+			FROM series_rollups
+			ORDER BY bucket, start_ts;
+		`,
+		"heatmap": /* sql */ `
+			SELECT hour || ' ' || cx || ' ' || cy || ' ' || moves || ' ' || printf('%.6f', seconds)
+			FROM heatmap_cells
+			ORDER BY hour, cx, cy;
+		`,
+		"behaviours": /* sql */ `
+			SELECT state || ' ' || start_id || ' ' || end_id || ' ' || start_ts || ' ' || end_ts || ' ' ||
+				moves || ' ' || printf('%.6f', path_length)
+			FROM behaviour_episodes
+			ORDER BY start_ts, start_id;
+		`,
+	}
+	want := make(map[string][]string)
+	for name, q := range queries {
+		want[name] = derivedRows(t, db, q)
+	}
+
+	// The first two days are rolled up
+	rt, err := NewRetention(zap.NewNop(), db, RetentionConfig{
+		FullDays: 1,
+		Tiers:    []RetentionTier{{Bucket: "1h", Days: 90}, {Bucket: "1d"}},
+		Points:   4,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Compact(context.Background(), start.Add(3*24*time.Hour)); err != nil {
+		t.Fatalf("compacting: %v", err)
+	}
+	last, err := lastRolledUp(db.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(2*24*time.Hour - 30*time.Minute); !last.Timestamp.Equal(want) {
+		t.Fatalf("last rolled up position is at %v, want %v", last.Timestamp, want)
+	}
+
+	if err := db.refreshDerivations(); err != nil {
+		t.Fatalf("rebuilding derivations: %v", err)
+	}
+	for name, q := range queries {
+		got := derivedRows(t, db, q)
+		if len(got) != len(want[name]) {
+			t.Errorf("%s has %d rows after the rebuild, want %d", name, len(got), len(want[name]))
+			continue
+		}
+		for i := range got {
+			if got[i] != want[name][i] {
+				t.Errorf("%s row %d is %q after the rebuild, want %q", name, i, got[i], want[name][i])
+			}
+		}
+	}
+
+	// A moment of the rolled up days is read from the kept points
+	at, err := db.fetchStateAtTime(start.Add(24*time.Hour), 0)
+	if err != nil {
+		t.Fatalf("fetching state of a rolled up moment: %v", err)
+	}
+	if at.Position.Timestamp.After(start.Add(24*time.Hour)) || at.Next == nil || at.Next.Timestamp.After(last.Timestamp) {
+		t.Errorf("state of a rolled up moment is %+v", at)
+	}
+
+	// A new cell size moves the rolled up cells whole
+	moves := `SELECT CAST(SUM(moves) AS TEXT) FROM heatmap_cells;`
+	before := derivedRows(t, db, moves)
+	coarser, err := NewHeatmapOccupancy(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Derive(zap.NewNop(), coarser); err != nil {
+		t.Fatal(err)
+	}
+	if after := derivedRows(t, db, moves); after[0] != before[0] {
+		t.Errorf("heatmap counts %s moves with a new cell size, want %s", after[0], before[0])
+	}
+}
+
+func TestCompactionWaitsForRecomputation(t *testing.T) {
+	db := openTestDB(t)
+	a, err := NewArena(ArenaConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three days of positions, half an hour apart
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var p position
+	for i := 0; i < 3*48; i++ {
+		cd := benchmarkContractData(i)
+		cd.ts = start.Add(time.Duration(i) * 30 * time.Minute)
+		if p, err = db.SavePosition(updatePosition(legacyModel{}, a, cd, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rt, err := NewRetention(zap.NewNop(), db, RetentionConfig{
+		FullDays: 1,
+		Tiers:    []RetentionTier{{Bucket: "1h"}},
+		Points:   4,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := NewRecomputer(zap.NewNop(), db, LocomotionConfig{}, a)
+	count := `SELECT CAST(COUNT(*) AS TEXT) FROM positions;`
+	now := start.Add(3 * 24 * time.Hour)
+
+	// A recomputation is replaying the positions
+	if !rc.pause() {
+		t.Fatal("recomputer is already paused")
+	}
+	if err := rt.compactPaused(context.Background(), now, rc); !errors.Is(err, errRecomputeRunning) {
+		t.Fatalf("compacting during a recomputation returned %v, want %v", err, errRecomputeRunning)
+	}
+	if got := derivedRows(t, db, count); got[0] != "144" {
+		t.Fatalf("%s positions are left after a refused compaction, want 144", got[0])
+	}
+	rc.resume()
+
+	if err := rt.compactPaused(context.Background(), now, rc); err != nil {
+		t.Fatalf("compacting: %v", err)
+	}
+	if got := derivedRows(t, db, count); got[0] != "48" {
+		t.Errorf("%s positions are left after the compaction, want 48", got[0])
+	}
+	if !rc.pause() {
+		t.Error("recomputations are still refused after the compaction")
+	}
+}
@@ -0,0 +1,358 @@
+package src
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// The methods /worm/historical can downsample the path with.
+const (
+	sampleRDP  = "rdp"  // Ramer–Douglas–Peucker
+	sampleVW   = "vw"   // Visvalingam–Whyatt
+	sampleLTTB = "lttb" // Largest-Triangle-Three-Buckets
+	sampleTime = "time" // evenly spaced in time
+	sampleID   = "id"   // evenly spaced ids
+)
+
+var sampleMethods = []string{sampleRDP, sampleVW, sampleLTTB, sampleTime, sampleID}
+
+// pathPoint is the subset of a position the sampling methods work with.
+type pathPoint struct {
+	ID        int
+	Timestamp time.Time
+	X         float64
+	Y         float64
+}
+
+// samplePath returns the indices of count points of the path chosen by method,
+// in order. Count must be at least 2, the first and last points are always kept
+// and paths of up to count points are kept whole.
+func samplePath(points []pathPoint, count int, method string) []int {
+	if len(points) <= count {
+		all := make([]int, len(points))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	switch method {
+	case sampleRDP:
+		return sampleRamerDouglasPeucker(points, count)
+	case sampleVW:
+		return sampleVisvalingamWhyatt(points, count)
+	case sampleLTTB:
+		return sampleLargestTriangle(points, count)
+	case sampleTime:
+		return sampleTimeUniform(points, count)
+	default:
+		return sampleIDUniform(points, count)
+	}
+}
+
+func sampleIDUniform(points []pathPoint, count int) []int {
+	indices := make([]int, 0, count)
+	for i := 0; i < count; i++ {
+		indices = append(indices, int(math.Round(float64(i)*float64(len(points)-1)/float64(count-1))))
+	}
+	return indices
+}
+
+// sampleTimeUniform keeps the point nearest to each of count evenly spaced
+// times. Bursts of positions close together in time can share a nearest point,
+// so fewer than count points may be returned.
+func sampleTimeUniform(points []pathPoint, count int) []int {
+	start, end := points[0].Timestamp, points[len(points)-1].Timestamp
+	span := end.Sub(start)
+
+	indices := make([]int, 0, count)
+	for i := 0; i < count; i++ {
+		at := start.Add(time.Duration(float64(span) * float64(i) / float64(count-1)))
+		j := sort.Search(len(points), func(k int) bool { return !points[k].Timestamp.Before(at) })
+		if j == len(points) || (j > 0 && at.Sub(points[j-1].Timestamp) < points[j].Timestamp.Sub(at)) {
+			j--
+		}
+		if len(indices) > 0 && indices[len(indices)-1] >= j {
+			continue
+		}
+		indices = append(indices, j)
+	}
+	return indices
+}
+
+// sampleRamerDouglasPeucker runs the Ramer–Douglas–Peucker algorithm top down
+// until count points are kept: the segment whose furthest point is furthest
+// from it is split at that point first.
+func sampleRamerDouglasPeucker(points []pathPoint, count int) []int {
+	keep := []int{0, len(points) - 1}
+
+	segments := &segmentHeap{}
+	split := func(from, to int) {
+		if to-from < 2 {
+			return
+		}
+		best, dist := from+1, -1.0
+		for i := from + 1; i < to; i++ {
+			if d := segmentDistance(points[i], points[from], points[to]); d > dist {
+				best, dist = i, d
+			}
+		}
+		heap.Push(segments, segment{from: from, to: to, split: best, dist: dist})
+	}
+
+	split(0, len(points)-1)
+	for len(keep) < count && segments.Len() > 0 {
+		s := heap.Pop(segments).(segment)
+		keep = append(keep, s.split)
+		split(s.from, s.split)
+		split(s.split, s.to)
+	}
+
+	sort.Ints(keep)
+	return keep
+}
+
+// sampleVisvalingamWhyatt repeatedly drops the point whose triangle with its
+// neighbours has the smallest area until count points are left.
+func sampleVisvalingamWhyatt(points []pathPoint, count int) []int {
+	n := len(points)
+	prev, next := make([]int, n), make([]int, n)
+	for i := range points {
+		prev[i], next[i] = i-1, i+1
+	}
+
+	area := func(i int) float64 {
+		return triangleArea(points[prev[i]], points[i], points[next[i]])
+	}
+
+	// Areas are stored with a version so that stale entries are skipped
+	// instead of being removed from the heap
+	versions := make([]int, n)
+	areas := &segmentHeap{min: true}
+	for i := 1; i < n-1; i++ {
+		heap.Push(areas, segment{split: i, dist: area(i)})
+	}
+
+	removed := make([]bool, n)
+	for left := n; left > count && areas.Len() > 0; {
+		s := heap.Pop(areas).(segment)
+		if removed[s.split] || s.version != versions[s.split] {
+			continue
+		}
+
+		i := s.split
+		removed[i] = true
+		left--
+		p, nx := prev[i], next[i]
+		next[p], prev[nx] = nx, p
+
+		// A neighbour's effective area never drops below that of the point
+		// removed, so that points are removed in order
+		for _, j := range []int{p, nx} {
+			if j == 0 || j == n-1 {
+				continue
+			}
+			versions[j]++
+			heap.Push(areas, segment{split: j, version: versions[j], dist: math.Max(area(j), s.dist)})
+		}
+	}
+
+	keep := make([]int, 0, count)
+	for i := range points {
+		if !removed[i] {
+			keep = append(keep, i)
+		}
+	}
+	return keep
+}
+
+// sampleLargestTriangle runs Largest-Triangle-Three-Buckets over the path: the
+// points between the first and last are split into count-2 buckets, and from
+// each the point forming the largest triangle with the previously kept point
+// and the centroid of the next bucket is kept.
+func sampleLargestTriangle(points []pathPoint, count int) []int {
+	n := len(points)
+	buckets := count - 2
+	size := float64(n-2) / float64(buckets)
+	bucket := func(b int) (int, int) {
+		return 1 + int(float64(b)*size), 1 + int(float64(b+1)*size)
+	}
+
+	keep := make([]int, 0, count)
+	keep = append(keep, 0)
+	a := 0
+	for b := 0; b < buckets; b++ {
+		from, to := bucket(b)
+
+		// the centroid of the next bucket, or the last point
+		var next pathPoint
+		if b+1 < buckets {
+			nf, nt := bucket(b + 1)
+			for _, p := range points[nf:nt] {
+				next.X += p.X
+				next.Y += p.Y
+			}
+			next.X /= float64(nt - nf)
+			next.Y /= float64(nt - nf)
+		} else {
+			next = points[n-1]
+		}
+
+		best, bestArea := from, -1.0
+		for i := from; i < to; i++ {
+			if area := triangleArea(points[a], points[i], next); area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+		keep = append(keep, best)
+		a = best
+	}
+
+	return append(keep, n-1)
+}
+
+// segmentDistance returns the distance from p to the segment from a to b.
+func segmentDistance(p, a, b pathPoint) float64 {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	lengthSq := dx*dx + dy*dy
+	if lengthSq == 0 {
+		return math.Hypot(p.X-a.X, p.Y-a.Y)
+	}
+	t := math.Max(0, math.Min(1, ((p.X-a.X)*dx+(p.Y-a.Y)*dy)/lengthSq))
+	return math.Hypot(p.X-(a.X+t*dx), p.Y-(a.Y+t*dy))
+}
+
+func triangleArea(a, b, c pathPoint) float64 {
+	return math.Abs((b.X-a.X)*(c.Y-a.Y)-(c.X-a.X)*(b.Y-a.Y)) / 2
+}
+
+// segment is an entry of the sampling heaps, ordered by dist.
+type segment struct {
+	from, to int
+	split    int
+	version  int
+	dist     float64
+}
+
+// segmentHeap is a max heap of segments, or a min heap when min is set.
+type segmentHeap struct {
+	items []segment
+	min   bool
+}
+
+func (h *segmentHeap) Len() int { return len(h.items) }
+func (h *segmentHeap) Less(i, j int) bool {
+	if h.min {
+		return h.items[i].dist < h.items[j].dist
+	}
+	return h.items[i].dist > h.items[j].dist
+}
+func (h *segmentHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *segmentHeap) Push(x any)    { h.items = append(h.items, x.(segment)) }
+func (h *segmentHeap) Pop() any {
+	s := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return s
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+// sampleSource returns the FROM clause positions are sampled from. Samples of
+// the active trajectory also cover the points kept of rolled up positions.
+func (db *dbManager) sampleSource(version int) (string, []any, error) {
+	source, args, err := db.positionsSource(version)
+	if err != nil || source != "positions" {
+		return source, args, err
+	}
+	return historySource, nil, nil
+}
+
+// fetchPath returns the whole path of a trajectory version, in order.
+func (db *dbManager) fetchPath(version int) ([]pathPoint, error) {
+	source, args, err := db.sampleSource(version)
+	if err != nil {
+		return nil, err
+	}
+
+	q := /* sql */ `
+		SELECT id, ts, x, y
+		FROM ` + source + `
+		ORDER BY ` + chainOrder + `;
+	`
+
+	rows, err := db.reader.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching path: %w", err)
+	}
+	defer rows.Close()
+
+	points := make([]pathPoint, 0)
+	for rows.Next() {
+		var p pathPoint
+		if err := rows.Scan(&p.ID, &p.Timestamp, &p.X, &p.Y); err != nil {
+			return nil, fmt.Errorf("error scanning path point: %w", err)
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating path: %w", err)
+	}
+
+	return points, nil
+}
+
+// fetchPositionsByID returns the positions of a trajectory version with the
+// given ids, in order.
+func (db *dbManager) fetchPositionsByID(ids []int, version int) ([]position, error) {
+	source, args, err := db.sampleSource(version)
+	if err != nil {
+		return nil, err
+	}
+
+	idsJSON, err := json.Marshal(ids)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding ids: %w", err)
+	}
+
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM ` + source + `
+		WHERE id IN (SELECT value FROM json_each(?))
+		ORDER BY ` + chainOrder + `;
+	`
+
+	rows, err := db.reader.Query(q, append(args, string(idsJSON))...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching positions by id: %w", err)
+	}
+	defer rows.Close()
+
+	return scanPositions(rows)
+}
+
+// Sample returns count positions of the active trajectory chosen by one of the
+// sampleMethods, rolled up positions included.
+func (db *dbManager) Sample(count int, method string) ([]position, error) {
+	return db.fetchSample(count, method, 0)
+}
+
+// fetchSample returns count positions of a trajectory version chosen by one of
+// the sampleMethods.
+func (db *dbManager) fetchSample(count int, method string, version int) ([]position, error) {
+	points, err := db.fetchPath(version)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := samplePath(points, count, method)
+	ids := make([]int, 0, len(indices))
+	for _, i := range indices {
+		ids = append(ids, points[i].ID)
+	}
+
+	return db.fetchPositionsByID(ids, version)
+}
@@ -0,0 +1,338 @@
+package src
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// seriesBuckets are the bucket sizes the series rollups are kept at.
+var seriesBuckets = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// seriesBucket aggregates the moves whose positions fall in a bucket of time.
+// The start coordinates are where the worm was before the bucket's first move.
+type seriesBucket struct {
+	Bucket          string    `json:"bucket"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	FirstID         int       `json:"firstId"`
+	LastID          int       `json:"lastId"`
+	Open            float64   `json:"open"`
+	High            float64   `json:"high"`
+	Low             float64   `json:"low"`
+	Close           float64   `json:"close"`
+	Moves           int       `json:"moves"`
+	MeanMuscle      *float64  `json:"meanMuscle"` // null when no move in the bucket recorded its muscles
+	MeanLeftMuscle  *float64  `json:"meanLeftMuscle"`
+	MeanRightMuscle *float64  `json:"meanRightMuscle"`
+	Distance        float64   `json:"distance"`
+	StartX          float64   `json:"startX"`
+	StartY          float64   `json:"startY"`
+	EndX            float64   `json:"endX"`
+	EndY            float64   `json:"endY"`
+
+	muscleMoves       int
+	leftSum, rightSum int64
+}
+
+// newSeriesBucket starts the bucket containing p, which moved from prev.
+func newSeriesBucket(bucket string, prev, p position) seriesBucket {
+	start := p.Timestamp.UTC().Truncate(seriesBuckets[bucket])
+	return seriesBucket{
+		Bucket:  bucket,
+		Start:   start,
+		End:     start.Add(seriesBuckets[bucket]),
+		FirstID: p.ID,
+		Open:    p.Price,
+		High:    p.Price,
+		Low:     p.Price,
+		StartX:  prev.X,
+		StartY:  prev.Y,
+	}
+}
+
+// contains reports whether p falls in the bucket.
+func (b *seriesBucket) contains(p position) bool {
+	return !p.Timestamp.Before(b.Start) && p.Timestamp.Before(b.End)
+}
+
+func (b *seriesBucket) add(p position) {
+	b.LastID = p.ID
+	b.High = max(b.High, p.Price)
+	b.Low = min(b.Low, p.Price)
+	b.Close = p.Price
+	b.Moves++
+	if p.LeftMuscle != nil && p.RightMuscle != nil {
+		b.muscleMoves++
+		b.leftSum += *p.LeftMuscle
+		b.rightSum += *p.RightMuscle
+	}
+	if p.Kinematics != nil {
+		b.Distance += p.Kinematics.StepLength
+	}
+	b.EndX, b.EndY = p.X, p.Y
+}
+
+// merge adds the moves of a later bucket that falls in b.
+func (b *seriesBucket) merge(o seriesBucket) {
+	b.FirstID = min(b.FirstID, o.FirstID)
+	b.LastID = max(b.LastID, o.LastID)
+	b.High = max(b.High, o.High)
+	b.Low = min(b.Low, o.Low)
+	b.Close = o.Close
+	b.Moves += o.Moves
+	b.muscleMoves += o.muscleMoves
+	b.leftSum += o.leftSum
+	b.rightSum += o.rightSum
+	b.Distance += o.Distance
+	b.EndX, b.EndY = o.EndX, o.EndY
+}
+
+// setMeans sets the mean muscles from the sums.
+func (b *seriesBucket) setMeans() {
+	b.MeanLeftMuscle, b.MeanRightMuscle, b.MeanMuscle = nil, nil, nil
+	if b.muscleMoves > 0 {
+		n := float64(b.muscleMoves)
+		left, right := float64(b.leftSum)/n, float64(b.rightSum)/n
+		mean := (left + right) / 2
+		b.MeanLeftMuscle, b.MeanRightMuscle, b.MeanMuscle = &left, &right, &mean
+	}
+}
+
+// seriesRollups keeps the series_rollups table of per-bucket aggregates up to
+// date so that series requests don't have to scan the positions.
+type seriesRollups struct{}
+
+func NewSeriesRollups() *seriesRollups {
+	return &seriesRollups{}
+}
+
+func (s *seriesRollups) name() string { return "series" }
+
+func (s *seriesRollups) fingerprint() string { return "v1" }
+
+func (s *seriesRollups) apply(ex execer, p position) error {
+	prevQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` < (?, ?, ?)
+		ORDER BY ` + chainOrderDesc + `
+		LIMIT 1;
+	`
+	prev, err := scanPosition(ex.QueryRow(prevQ, p.chainKey()...))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error fetching previous position: %w", err)
+	}
+
+	for bucket := range seriesBuckets {
+		b := newSeriesBucket(bucket, prev, p)
+		q := /* sql */ `
+			SELECT ` + seriesColumns + `
+			FROM series_rollups
+			WHERE bucket = ? AND start_ts = ?;
+		`
+		existing, err := scanSeriesBucket(ex.QueryRow(q, bucket, b.Start))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error fetching %s rollup: %w", bucket, err)
+		}
+		if err == nil {
+			b = existing
+		}
+
+		b.add(p)
+		if err := saveSeriesBucket(ex, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuild rolls the positions up again. The buckets of rolled up positions
+// are kept, their moves are gone.
+func (s *seriesRollups) rebuild(ex execer) error {
+	const batchSize = 1000
+
+	last, err := lastRolledUp(ex)
+	if err != nil {
+		return err
+	}
+	for bucket, size := range seriesBuckets {
+		q := `DELETE FROM series_rollups WHERE bucket = ? AND start_ts > ?;`
+		if _, err := ex.Exec(q, bucket, last.Timestamp.UTC().Truncate(size)); err != nil {
+			return fmt.Errorf("error deleting rollups: %w", err)
+		}
+	}
+
+	batchQ := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` > (?, ?, ?)
+		ORDER BY ` + chainOrder + `
+		LIMIT ?;
+	`
+
+	prev := last
+	current := make(map[string]*seriesBucket)
+	for {
+		rows, err := ex.Query(batchQ, append(prev.chainKey(), batchSize)...)
+		if err != nil {
+			return fmt.Errorf("error fetching positions to roll up: %w", err)
+		}
+		ps, err := scanPositions(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(ps) == 0 {
+			break
+		}
+
+		for _, p := range ps {
+			for bucket, size := range seriesBuckets {
+				if rolledUpBucket(last, p, size) {
+					continue
+				}
+				b := current[bucket]
+				if b != nil && !b.contains(p) {
+					if err := saveSeriesBucket(ex, *b); err != nil {
+						return err
+					}
+					b = nil
+				}
+				if b == nil {
+					nb := newSeriesBucket(bucket, prev, p)
+					b = &nb
+					current[bucket] = b
+				}
+				b.add(p)
+			}
+			prev = p
+		}
+	}
+
+	for _, b := range current {
+		if err := saveSeriesBucket(ex, *b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const seriesColumns = /* sql */ `
+	bucket, start_ts, first_id, last_id, open, high, low, close, moves,
+	muscle_moves, left_sum, right_sum, distance, start_x, start_y, end_x, end_y`
+
+func scanSeriesBucket(row scanner) (seriesBucket, error) {
+	var b seriesBucket
+	if err := row.Scan(
+		&b.Bucket,
+		&b.Start,
+		&b.FirstID,
+		&b.LastID,
+		&b.Open,
+		&b.High,
+		&b.Low,
+		&b.Close,
+		&b.Moves,
+		&b.muscleMoves,
+		&b.leftSum,
+		&b.rightSum,
+		&b.Distance,
+		&b.StartX,
+		&b.StartY,
+		&b.EndX,
+		&b.EndY,
+	); err != nil {
+		return seriesBucket{}, err
+	}
+
+	b.Start = b.Start.UTC()
+	b.End = b.Start.Add(seriesBuckets[b.Bucket])
+	b.setMeans()
+	return b, nil
+}
+
+func saveSeriesBucket(ex execer, b seriesBucket) error {
+	return saveBucket(ex, "series_rollups", b)
+}
+
+// saveBucket saves a bucket to series_rollups or a table with the same
+// columns.
+func saveBucket(ex execer, table string, b seriesBucket) error {
+	q := /* sql */ `
+		INSERT OR REPLACE INTO ` + table + `
+			(bucket, start_ts, first_id, last_id, open, high, low, close, moves,
+			muscle_moves, left_sum, right_sum, distance, start_x, start_y, end_x, end_y)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	_, err := ex.Exec(q,
+		b.Bucket,
+		b.Start,
+		b.FirstID,
+		b.LastID,
+		b.Open,
+		b.High,
+		b.Low,
+		b.Close,
+		b.Moves,
+		b.muscleMoves,
+		b.leftSum,
+		b.rightSum,
+		b.Distance,
+		b.StartX,
+		b.StartY,
+		b.EndX,
+		b.EndY,
+	)
+	if err != nil {
+		return fmt.Errorf("error saving %s rollup: %w", b.Bucket, err)
+	}
+	return nil
+}
+
+// fetchSeries returns up to limit buckets of the given size overlapping from
+// and to, in order. A zero from or to leaves that end of the range open.
+func (db *dbManager) fetchSeries(bucket string, from, to time.Time, limit int) ([]seriesBucket, error) {
+	if !from.IsZero() {
+		from = from.UTC().Truncate(seriesBuckets[bucket])
+	}
+
+	const q = /* sql */ `
+		SELECT ` + seriesColumns + `
+		FROM series_rollups
+		WHERE bucket = ?1
+		AND (?2 IS NULL OR start_ts >= ?2)
+		AND (?3 IS NULL OR start_ts <= ?3)
+		ORDER BY start_ts ASC
+		LIMIT ?4;
+	`
+
+	rows, err := db.reader.Query(q, bucket, nullTime(from), nullTime(to), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching series: %w", err)
+	}
+	defer rows.Close()
+
+	series := make([]seriesBucket, 0)
+	for rows.Next() {
+		b, err := scanSeriesBucket(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning series bucket: %w", err)
+		}
+		series = append(series, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating series: %w", err)
+	}
+
+	return series, nil
+}
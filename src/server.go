@@ -1,9 +1,17 @@
 package src
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"math"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/v5/middleware"
@@ -11,18 +19,62 @@ import (
 )
 
 type server struct {
-	log    *zap.Logger
-	port   string
-	router *chi.Mux
-	db     *dbManager
+	log        *zap.Logger
+	port       string
+	router     *chi.Mux
+	store      Store
+	db         *dbManager // nil unless the store is SQLite, the routes querying it directly are disabled then
+	arena      *arena
+	recomputer *recomputer
+	importer   *importer
+	snapshots  *snapshotter // nil when snapshots aren't configured
+	adminToken string       // admin routes are disabled when empty
+
+	locomotionCache *resultCache[locomotionParams, locomotionStats]
+	behaviourCache  *resultCache[behaviourSummaryParams, []behaviourWindow]
+	priceCache      *resultCache[priceParams, priceStats]
+	spectrumCache   *resultCache[spectrumParams, spectrumStats]
+	sampleCache     *resultCache[sampleParams, []position]
+	pathCache       *resultCache[pathParams, tieredPath]
+}
+
+// ServerConfig sets where the server listens and who may use the admin routes.
+type ServerConfig struct {
+	Port       string
+	AdminToken string // admin routes are disabled when empty
+}
+
+// ServerDeps are what the server answers from. Trajectories, imports and
+// snapshots are only supported by the SQLite store, the recomputer, importer
+// and snapshotter are nil with any other or when they're disabled.
+type ServerDeps struct {
+	Store       Store
+	Arena       *arena
+	Recomputer  *recomputer
+	Importer    *importer
+	Snapshotter *snapshotter
 }
 
-func NewServer(log *zap.Logger, port string, db *dbManager) *server {
+func NewServer(log *zap.Logger, cfg ServerConfig, deps ServerDeps) *server {
+	db, _ := deps.Store.(*dbManager)
 	return &server{
-		log:    log,
-		port:   port,
-		router: chi.NewRouter(),
-		db:     db,
+		log:        log,
+		port:       cfg.Port,
+		router:     chi.NewRouter(),
+		store:      deps.Store,
+		db:         db,
+		arena:      deps.Arena,
+		recomputer: deps.Recomputer,
+		importer:   deps.Importer,
+		snapshots:  deps.Snapshotter,
+		adminToken: cfg.AdminToken,
+
+		locomotionCache: newResultCache[locomotionParams, locomotionStats](32),
+		behaviourCache:  newResultCache[behaviourSummaryParams, []behaviourWindow](32),
+		priceCache:      newResultCache[priceParams, priceStats](32),
+		spectrumCache:   newResultCache[spectrumParams, spectrumStats](32),
+		sampleCache:     newResultCache[sampleParams, []position](32),
+		pathCache:       newResultCache[pathParams, tieredPath](32),
 	}
 }
 
@@ -45,12 +97,58 @@ func (s *server) Start() error {
 	s.router.Route("/worm", func(r chi.Router) {
 		r.Get("/positions", s.positions)
 		r.Get("/historical", s.historicalPositions)
+		r.Get("/at", s.stateAt)
+		r.Get("/arena", s.arenaGeometry)
+		r.Get("/coverage", s.coverage)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireSQLite)
+
+			r.Get("/muscles", s.muscles)
+			r.Get("/trajectories", s.trajectories)
+			r.Get("/kinematics", s.kinematics)
+			r.Get("/behaviours", s.behaviours)
+			r.Get("/behaviours/summary", s.behaviourSummary)
+			r.Get("/series", s.series)
+			r.Get("/path", s.path)
+			r.Get("/heatmap", s.heatmap)
+			r.Get("/anomalies", s.anomalies)
+			r.Get("/export", s.export)
+			r.Get("/repairs", s.repairs)
+
+			r.Route("/spatial", func(r chi.Router) {
+				r.Get("/bbox", s.positionsInBox)
+				r.Get("/radius", s.positionsNear)
+				r.Get("/revisits", s.revisits)
+			})
+
+			r.Route("/analytics", func(r chi.Router) {
+				r.Get("/locomotion", s.locomotionAnalytics)
+				r.Get("/price", s.priceAnalytics)
+				r.Get("/spectrum", s.spectrumAnalytics)
+			})
+		})
+	})
+
+	// -------------------------------------------------------------------------
+	// Admin Routes
+	s.router.Route("/admin", func(r chi.Router) {
+		r.Use(s.requireAdmin, s.requireSQLite)
+		r.Post("/recompute", s.recompute)
+		r.Post("/snapshot", s.snapshot)
+		r.Post("/import", s.importPositions)
 	})
 
 	return http.ListenAndServe(":"+s.port, s.router)
 }
 
 func (s *server) positions(w http.ResponseWriter, r *http.Request) {
+	// Without an id the positions are paged through by range
+	if !r.URL.Query().Has("id") {
+		s.requireSQLite(http.HandlerFunc(s.positionPage)).ServeHTTP(w, r)
+		return
+	}
+
 	// Parse the ?id= query parameter from the URL
 	idStr := r.URL.Query().Get("id")
 	id, err := strconv.Atoi(idStr)
@@ -59,12 +157,44 @@ func (s *server) positions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	positions, err := s.db.fetchPositions(id)
+	version, err := parseVersionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withKinematics, err := parseBoolParam(r, "kinematics")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the SQLite store keeps the other trajectory versions
+	var positions []position
+	switch {
+	case version == 0:
+		positions, err = s.store.Positions(id, 100)
+	case s.db != nil:
+		positions, err = s.db.fetchPositions(id, version, 100)
+	default:
+		err = errNotSupported
+	}
+	if errors.Is(err, errTrajectoryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
 	if err != nil {
 		s.log.Error("failed to fetch positions", zap.Error(err))
 		http.Error(w, "failed to fetch positions", http.StatusInternalServerError)
 		return
 	}
+	if !withKinematics {
+		stripKinematics(positions)
+	}
 
 	// Encode the positions as a JSON response
 	w.Header().Set("Content-Type", "application/json")
@@ -74,34 +204,235 @@ func (s *server) positions(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// positionPage returns a page of the positions between the from and to
+// timestamps and the fromBlock and toBlock block numbers, in ?order=. The
+// pages either side are linked from the Link header.
+func (s *server) positionPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		pq  positionQuery
+		err error
+	)
+	if pq.from, err = parseTimeParam(r, "from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pq.to, err = parseTimeParam(r, "to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pq.fromBlock, err = parseIntParam(r, "fromBlock", 0, 1, math.MaxInt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pq.toBlock, err = parseIntParam(r, "toBlock", 0, 1, math.MaxInt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pq.limit, err = parseLimitParam(r, 100, 1000); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Query().Get("order") {
+	case "", "asc":
+	case "desc":
+		pq.desc = true
+	default:
+		http.Error(w, "invalid order: must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		if pq.cursor, err = decodePageCursor(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	version, err := parseVersionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withKinematics, err := parseBoolParam(r, "kinematics")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.db.fetchPositionPage(pq, version)
+	if errors.Is(err, errTrajectoryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log.Error("failed to fetch positions", zap.Error(err))
+		http.Error(w, "failed to fetch positions", http.StatusInternalServerError)
+		return
+	}
+	if !withKinematics {
+		stripKinematics(page.positions)
+	}
+
+	var links []string
+	for _, l := range []struct{ rel, cursor string }{{"next", page.next}, {"prev", page.prev}} {
+		if l.cursor == "" {
+			continue
+		}
+		q := r.URL.Query()
+		q.Set("cursor", l.cursor)
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, q.Encode(), l.rel))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page.positions); err != nil {
+		http.Error(w, "failed to encode positions", http.StatusInternalServerError)
+		return
+	}
+}
+
+// stateAt returns where the worm was at ?block= or ?ts=, the position in
+// effect then along with the next update and a position interpolated between
+// the two.
+func (s *server) stateAt(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Has("block") == q.Has("ts") {
+		http.Error(w, "exactly one of block or ts is required", http.StatusBadRequest)
+		return
+	}
+
+	version, err := parseVersionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the SQLite store keeps the other trajectory versions
+	var state stateAt
+	if q.Has("block") {
+		block, perr := parseIntParam(r, "block", 0, 0, math.MaxInt)
+		if perr != nil {
+			http.Error(w, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case version == 0:
+			state, err = s.store.StateAtBlock(block)
+		case s.db != nil:
+			state, err = s.db.fetchStateAtBlock(block, version)
+		default:
+			err = errNotSupported
+		}
+	} else {
+		ts, perr := parseTimeParam(r, "ts")
+		if perr != nil {
+			http.Error(w, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case version == 0:
+			state, err = s.store.StateAtTime(ts)
+		case s.db != nil:
+			state, err = s.db.fetchStateAtTime(ts, version)
+		default:
+			err = errNotSupported
+		}
+	}
+	if errors.Is(err, errTrajectoryNotFound) || errors.Is(err, errBeforeFirstPosition) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		s.log.Error("failed to fetch state", zap.Error(err))
+		http.Error(w, "failed to fetch state", http.StatusInternalServerError)
+		return
+	}
+
+	state.Position.Kinematics = nil
+	if state.Next != nil {
+		state.Next.Kinematics = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		http.Error(w, "failed to encode state", http.StatusInternalServerError)
+		return
+	}
+}
+
 // historicalPositions returns two fields that contains slices of positions:
-//   - recent: contains the 100 most recent positions where the last position is the most recent.
-//   - historical: contains a sampled set of 400 positions from the entire history.
+//   - recent: contains the 100 most recent positions in the order of the chain, the last one being the latest.
+//   - historical: contains a sample of ?count= positions (400 by default) from the entire history,
+//     chosen by ?method=. Samples are cached until new positions arrive.
 func (s *server) historicalPositions(w http.ResponseWriter, r *http.Request) {
 	const lastN = 100
-	const sampleN = 400
 
-	latestPosition, err := s.db.getLatestPosition()
+	version, err := parseVersionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withKinematics, err := parseBoolParam(r, "kinematics")
 	if err != nil {
-		s.log.Error("failed to fetch latest position", zap.Error(err))
-		http.Error(w, "failed to fetch latest position", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := sampleParams{method: r.URL.Query().Get("method"), version: version}
+	if params.method == "" {
+		params.method = sampleID
+	}
+	if !slices.Contains(sampleMethods, params.method) {
+		http.Error(w, fmt.Sprintf("invalid method: must be one of %s", strings.Join(sampleMethods, ", ")), http.StatusBadRequest)
+		return
+	}
+	if params.count, err = parseIntParam(r, "count", 400, 2, 10000); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	last100, err := s.db.fetchPositions(latestPosition.ID - lastN)
+	// Only the SQLite store keeps the other trajectory versions
+	var last100 []position
+	switch {
+	case version == 0:
+		last100, err = s.store.RecentPositions(lastN)
+	case s.db != nil:
+		last100, err = s.db.fetchRecentPositions(lastN, version)
+	default:
+		err = errNotSupported
+	}
+	if errors.Is(err, errTrajectoryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
 	if err != nil {
 		s.log.Error("failed to fetch recent positions", zap.Error(err))
 		http.Error(w, "failed to fetch recent positions", http.StatusInternalServerError)
 		return
 	}
 
-	historical, err := s.db.fetchSample(sampleN)
+	historical, err := s.sample(params)
 	if err != nil {
 		s.log.Error("failed to fetch historical positions", zap.Error(err))
 		http.Error(w, "failed to fetch historical positions", http.StatusInternalServerError)
 		return
 	}
 
+	if !withKinematics {
+		stripKinematics(last100)
+		stripKinematics(historical)
+	}
+
 	type resp struct {
 		Recent     []position `json:"recent"`
 		Historical []position `json:"historical"`
@@ -115,3 +446,1128 @@ func (s *server) historicalPositions(w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+// sample returns a sample of the positions. Samples of the SQLite store are
+// cached until its positions change, the other stores only sample the active
+// trajectory.
+func (s *server) sample(params sampleParams) ([]position, error) {
+	if s.db == nil {
+		return s.store.Sample(params.count, params.method)
+	}
+
+	state, err := s.db.getPositionsState()
+	if err != nil {
+		return nil, err
+	}
+
+	historical, ok := s.sampleCache.get(state, params)
+	if !ok {
+		historical, err = s.db.fetchSample(params.count, params.method, params.version)
+		if err != nil {
+			return nil, err
+		}
+		s.sampleCache.put(state, params, historical)
+	}
+	// the cached sample is shared between requests
+	return slices.Clone(historical), nil
+}
+
+// arenaGeometry returns the shape, size and boundary behaviour of the arena so
+// that frontends can draw it. The arena is centred on the origin.
+func (s *server) arenaGeometry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.arena.cfg); err != nil {
+		http.Error(w, "failed to encode arena", http.StatusInternalServerError)
+		return
+	}
+}
+
+// coverage returns the ledger of block ranges the fetcher processed and the
+// gaps in it, the blocks up to the latest one recorded that aren't done.
+func (s *server) coverage(w http.ResponseWriter, r *http.Request) {
+	c, err := Coverage(s.store)
+	if err != nil {
+		s.log.Error("failed to fetch coverage", zap.Error(err))
+		http.Error(w, "failed to fetch coverage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		http.Error(w, "failed to encode coverage", http.StatusInternalServerError)
+		return
+	}
+}
+
+// repairs returns the repairs of the skipped and failed block ranges, those
+// with a ?status= when it's given.
+func (s *server) repairs(w http.ResponseWriter, r *http.Request) {
+	repairs, err := s.db.FetchRepairs(r.URL.Query().Get("status"))
+	if errors.Is(err, errInvalidRepair) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.log.Error("failed to fetch repairs", zap.Error(err))
+		http.Error(w, "failed to fetch repairs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(repairs); err != nil {
+		http.Error(w, "failed to encode repairs", http.StatusInternalServerError)
+		return
+	}
+}
+
+// muscles returns the raw muscle activations as a time series. The optional
+// from and to parameters bound the series by timestamp and limit caps the
+// number of samples returned.
+func (s *server) muscles(w http.ResponseWriter, r *http.Request) {
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 1000, 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	samples, err := s.db.fetchMuscles(from, to, limit)
+	if err != nil {
+		s.log.Error("failed to fetch muscles", zap.Error(err))
+		http.Error(w, "failed to fetch muscles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(samples); err != nil {
+		http.Error(w, "failed to encode muscles", http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseTimeParam reads a timestamp query parameter given either as RFC 3339 or
+// as UNIX seconds. A missing parameter returns the zero time.
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	t, err := ParseTime(r.URL.Query().Get(name))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s", name)
+	}
+	return t, nil
+}
+
+// ParseTime reads a timestamp given either as RFC 3339 or as UNIX seconds. An
+// empty string returns the zero time.
+func ParseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// parseLimitParam reads the ?limit= query parameter, falling back to def when
+// it's missing and capping it at max.
+func parseLimitParam(r *http.Request, def, max int) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("invalid limit")
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit, nil
+}
+
+// trajectories lists every trajectory version, the active one is served by
+// default and the others can be requested with ?version=.
+func (s *server) trajectories(w http.ResponseWriter, r *http.Request) {
+	trajectories, err := s.db.fetchTrajectories()
+	if err != nil {
+		s.log.Error("failed to fetch trajectories", zap.Error(err))
+		http.Error(w, "failed to fetch trajectories", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(trajectories); err != nil {
+		http.Error(w, "failed to encode trajectories", http.StatusInternalServerError)
+		return
+	}
+}
+
+// kinematics returns the per-move kinematics as a time series. It takes the
+// same from, to and limit parameters as /worm/muscles along with ?version=.
+func (s *server) kinematics(w http.ResponseWriter, r *http.Request) {
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 1000, 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, err := parseVersionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	samples, err := s.db.fetchKinematics(from, to, limit, version)
+	if errors.Is(err, errTrajectoryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log.Error("failed to fetch kinematics", zap.Error(err))
+		http.Error(w, "failed to fetch kinematics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(samples); err != nil {
+		http.Error(w, "failed to encode kinematics", http.StatusInternalServerError)
+		return
+	}
+}
+
+// locomotionAnalytics returns the mean squared displacement, diffusion
+// estimates, straightness and turning angle distribution of the trajectory
+// between from and to. Results are cached until new positions arrive.
+func (s *server) locomotionAnalytics(w http.ResponseWriter, r *http.Request) {
+	var (
+		params locomotionParams
+		err    error
+	)
+	if params.from, err = parseTimeParam(r, "from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.to, err = parseTimeParam(r, "to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.window, err = parseIntParam(r, "window", 50, 2, 10000); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.maxLag, err = parseIntParam(r, "maxLag", 100, 1, 500); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.bins, err = parseIntParam(r, "bins", 36, 1, 360); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := s.db.getPositionsState()
+	if err != nil {
+		s.log.Error("failed to fetch positions state", zap.Error(err))
+		http.Error(w, "failed to compute locomotion analytics", http.StatusInternalServerError)
+		return
+	}
+
+	stats, ok := s.locomotionCache.get(state, params)
+	if !ok {
+		t, err := s.db.fetchTrack(params.from, params.to)
+		if err != nil {
+			s.log.Error("failed to fetch track", zap.Error(err))
+			http.Error(w, "failed to compute locomotion analytics", http.StatusInternalServerError)
+			return
+		}
+		stats = analyzeLocomotion(t, params)
+		s.locomotionCache.put(state, params, stats)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, "failed to encode locomotion analytics", http.StatusInternalServerError)
+		return
+	}
+}
+
+// spectrumAnalytics returns the power spectra and peak frequencies of the
+// muscle activations between from and to, resampled every ?interval= and split
+// into windows of ?window= samples. Results are cached until new positions
+// arrive.
+func (s *server) spectrumAnalytics(w http.ResponseWriter, r *http.Request) {
+	var (
+		params spectrumParams
+		err    error
+	)
+	if params.from, err = parseTimeParam(r, "from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.to, err = parseTimeParam(r, "to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("interval"); v != "" {
+		params.interval, err = time.ParseDuration(v)
+		if err != nil || params.interval < time.Millisecond {
+			http.Error(w, "invalid interval: must be a duration of at least 1ms", http.StatusBadRequest)
+			return
+		}
+	}
+	if params.window, err = parseIntParam(r, "window", 128, minSpectrumWindow, 8192); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.window&(params.window-1) != 0 {
+		http.Error(w, "invalid window: must be a power of two", http.StatusBadRequest)
+		return
+	}
+	if params.peaks, err = parseIntParam(r, "peaks", 3, 1, 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := s.db.getPositionsState()
+	if err != nil {
+		s.log.Error("failed to fetch positions state", zap.Error(err))
+		http.Error(w, "failed to compute spectrum analytics", http.StatusInternalServerError)
+		return
+	}
+
+	stats, ok := s.spectrumCache.get(state, params)
+	if !ok {
+		t, err := s.db.fetchTrack(params.from, params.to)
+		if err != nil {
+			s.log.Error("failed to fetch track", zap.Error(err))
+			http.Error(w, "failed to compute spectrum analytics", http.StatusInternalServerError)
+			return
+		}
+		stats = analyzeSpectrum(t, params)
+		s.spectrumCache.put(state, params, stats)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, "failed to encode spectrum analytics", http.StatusInternalServerError)
+		return
+	}
+}
+
+// positionsInBox returns the positions inside the bounding box given by minX,
+// minY, maxX and maxY, in order.
+func (s *server) positionsInBox(w http.ResponseWriter, r *http.Request) {
+	var bounds [4]float64
+	for i, name := range []string{"minX", "minY", "maxX", "maxY"} {
+		v, err := parseFloatParam(r, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bounds[i] = v
+	}
+	if bounds[0] > bounds[2] || bounds[1] > bounds[3] {
+		http.Error(w, "invalid bounding box: min must not exceed max", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 1000, 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	positions, err := s.db.fetchPositionsInBox(bounds[0], bounds[1], bounds[2], bounds[3], limit)
+	if err != nil {
+		s.log.Error("failed to fetch positions in box", zap.Error(err))
+		http.Error(w, "failed to fetch positions", http.StatusInternalServerError)
+		return
+	}
+	stripKinematics(positions)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(positions); err != nil {
+		http.Error(w, "failed to encode positions", http.StatusInternalServerError)
+		return
+	}
+}
+
+// positionsNear returns the positions within ?r= of the point (x, y), nearest
+// first.
+func (s *server) positionsNear(w http.ResponseWriter, r *http.Request) {
+	x, err := parseFloatParam(r, "x")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	y, err := parseFloatParam(r, "y")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	radius, err := parseFloatParam(r, "r")
+	if err != nil || radius <= 0 {
+		http.Error(w, "invalid r: must be positive", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 1000, 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	positions, err := s.db.fetchPositionsNear(x, y, radius, limit)
+	if err != nil {
+		s.log.Error("failed to fetch positions near point", zap.Error(err))
+		http.Error(w, "failed to fetch positions", http.StatusInternalServerError)
+		return
+	}
+	stripKinematics(positions)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(positions); err != nil {
+		http.Error(w, "failed to encode positions", http.StatusInternalServerError)
+		return
+	}
+}
+
+// revisits lists the times between from and to when the worm came back within
+// ?d= of a place it had visited at least ?minMoves= moves earlier.
+func (s *server) revisits(w http.ResponseWriter, r *http.Request) {
+	distance, err := parseFloatParam(r, "d")
+	if err != nil || distance <= 0 {
+		http.Error(w, "invalid d: must be positive", http.StatusBadRequest)
+		return
+	}
+	minMoves, err := parseIntParam(r, "minMoves", 10, 1, 1000000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 100, 1000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	revisits, err := s.db.fetchRevisits(distance, minMoves, from, to, limit)
+	if err != nil {
+		s.log.Error("failed to fetch revisits", zap.Error(err))
+		http.Error(w, "failed to fetch revisits", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(revisits); err != nil {
+		http.Error(w, "failed to encode revisits", http.StatusInternalServerError)
+		return
+	}
+}
+
+// heatmap returns a 2d histogram of where the worm spent its moves, or its time
+// with ?weight=time, between from and to. The grid is JSON by default and a
+// PNG with ?format=png.
+func (s *server) heatmap(w http.ResponseWriter, r *http.Request) {
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h := s.db.heatmap()
+	if h == nil {
+		http.Error(w, "heatmap not configured", http.StatusNotFound)
+		return
+	}
+	cell := 10 * h.cell
+	if r.URL.Query().Get("cell") != "" {
+		if cell, err = parseFloatParam(r, "cell"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	weight := r.URL.Query().Get("weight")
+	if weight == "" {
+		weight = "moves"
+	}
+	if weight != "moves" && weight != "time" {
+		http.Error(w, "invalid weight: must be moves or time", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "png" {
+		http.Error(w, "invalid format: must be json or png", http.StatusBadRequest)
+		return
+	}
+	scale, err := parseIntParam(r, "scale", 0, 1, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grid, err := s.db.fetchHeatmap(cell, weight, from, to)
+	if errors.Is(err, errInvalidHeatmapCell) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errHeatmapTooLarge) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		s.log.Error("failed to fetch heatmap", zap.Error(err))
+		http.Error(w, "failed to fetch heatmap", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "png" {
+		// By default cells are scaled up to make the image about 512 pixels
+		// across
+		if scale == 0 {
+			scale = max(1, min(64, 512/max(1, grid.Columns, grid.Rows)))
+		}
+		if grid.Columns*grid.Rows*scale*scale > maxHeatmapCells {
+			http.Error(w, errHeatmapTooLarge.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		if err := png.Encode(w, grid.render(scale)); err != nil {
+			http.Error(w, "failed to encode heatmap", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(grid); err != nil {
+		http.Error(w, "failed to encode heatmap", http.StatusInternalServerError)
+		return
+	}
+}
+
+// series returns price candles and movement aggregates per ?bucket= of time
+// between from and to, read from the rollups kept by the series derivation.
+func (s *server) series(w http.ResponseWriter, r *http.Request) {
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = "1h"
+	}
+	if _, ok := seriesBuckets[bucket]; !ok {
+		http.Error(w, "invalid bucket: must be one of 1m, 5m, 1h or 1d", http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 1000, 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := s.db.fetchSeries(bucket, from, to, limit)
+	if err != nil {
+		s.log.Error("failed to fetch series", zap.Error(err))
+		http.Error(w, "failed to fetch series", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(series); err != nil {
+		http.Error(w, "failed to encode series", http.StatusInternalServerError)
+		return
+	}
+}
+
+type pathParams struct {
+	from       time.Time
+	to         time.Time
+	resolution string
+	points     int
+}
+
+// path returns the path of the worm between from and to at a ?resolution= of
+// full or one of the series buckets, picked from the range when it's left out.
+// Parts of the range that were rolled up are served from the finest retention
+// tier holding them. Results are cached until the positions change.
+func (s *server) path(w http.ResponseWriter, r *http.Request) {
+	var (
+		params pathParams
+		err    error
+	)
+	if params.from, err = parseTimeParam(r, "from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.to, err = parseTimeParam(r, "to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params.resolution = r.URL.Query().Get("resolution")
+	if _, ok := seriesBuckets[params.resolution]; !ok && params.resolution != "" && params.resolution != resolutionFull {
+		http.Error(w, "invalid resolution: must be full, 1m, 5m, 1h or 1d", http.StatusBadRequest)
+		return
+	}
+	if params.points, err = parseIntParam(r, "points", 16, 2, 1000); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := s.db.getPositionsState()
+	if err != nil {
+		s.log.Error("failed to fetch positions state", zap.Error(err))
+		http.Error(w, "failed to fetch path", http.StatusInternalServerError)
+		return
+	}
+
+	path, ok := s.pathCache.get(state, params)
+	if !ok {
+		path, err = s.db.fetchTieredPath(params.from, params.to, params.resolution, params.points)
+		if errors.Is(err, errPathTooLarge) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			s.log.Error("failed to fetch path", zap.Error(err))
+			http.Error(w, "failed to fetch path", http.StatusInternalServerError)
+			return
+		}
+		s.pathCache.put(state, params, path)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(path); err != nil {
+		http.Error(w, "failed to encode path", http.StatusInternalServerError)
+		return
+	}
+}
+
+type sampleParams struct {
+	method  string
+	count   int
+	version int
+}
+
+// priceAnalytics correlates the price returns with the muscle asymmetry, step
+// length and heading change of the moves between from and to, at lags of up to
+// maxLag moves and over rolling windows. Results are cached until new positions
+// arrive.
+func (s *server) priceAnalytics(w http.ResponseWriter, r *http.Request) {
+	var (
+		params priceParams
+		err    error
+	)
+	if params.from, err = parseTimeParam(r, "from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.to, err = parseTimeParam(r, "to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.window, err = parseIntParam(r, "window", 100, 3, 10000); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.maxLag, err = parseIntParam(r, "maxLag", 10, 0, 100); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.lag, err = parseIntParam(r, "lag", 0, -params.maxLag, params.maxLag); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := s.db.getPositionsState()
+	if err != nil {
+		s.log.Error("failed to fetch positions state", zap.Error(err))
+		http.Error(w, "failed to compute price analytics", http.StatusInternalServerError)
+		return
+	}
+
+	stats, ok := s.priceCache.get(state, params)
+	if !ok {
+		t, err := s.db.fetchTrack(params.from, params.to)
+		if err != nil {
+			s.log.Error("failed to fetch track", zap.Error(err))
+			http.Error(w, "failed to compute price analytics", http.StatusInternalServerError)
+			return
+		}
+		stats = analyzePrice(t, params)
+		s.priceCache.put(state, params, stats)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, "failed to encode price analytics", http.StatusInternalServerError)
+		return
+	}
+}
+
+// behaviours returns the behavioural episodes that started between from and
+// to, optionally only those in the given ?state=.
+func (s *server) behaviours(w http.ResponseWriter, r *http.Request) {
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 1000, 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	if state != "" && !slices.Contains(behaviours, state) {
+		http.Error(w, fmt.Sprintf("invalid state: must be one of %s", strings.Join(behaviours, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	episodes, err := s.db.fetchEpisodes(from, to, state, limit)
+	if err != nil {
+		s.log.Error("failed to fetch behaviours", zap.Error(err))
+		http.Error(w, "failed to fetch behaviours", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(episodes); err != nil {
+		http.Error(w, "failed to encode behaviours", http.StatusInternalServerError)
+		return
+	}
+}
+
+// anomalies returns the positions whose updates were flagged with data quality
+// anomalies between ?from= and ?to=, only those of ?type= when set.
+func (s *server) anomalies(w http.ResponseWriter, r *http.Request) {
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimitParam(r, 1000, 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind := r.URL.Query().Get("type")
+	if kind != "" && !slices.Contains(anomalyTypes, kind) {
+		http.Error(w, fmt.Sprintf("invalid type: must be one of %s", strings.Join(anomalyTypes, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	positions, err := s.db.fetchAnomalies(from, to, kind, limit)
+	if err != nil {
+		s.log.Error("failed to fetch anomalies", zap.Error(err))
+		http.Error(w, "failed to fetch anomalies", http.StatusInternalServerError)
+		return
+	}
+	stripKinematics(positions)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(positions); err != nil {
+		http.Error(w, "failed to encode anomalies", http.StatusInternalServerError)
+		return
+	}
+}
+
+type behaviourSummaryParams struct {
+	from   time.Time
+	to     time.Time
+	window time.Duration
+}
+
+// behaviourSummary returns the time spent in each behavioural state per
+// ?window= of time between from and to. Results are cached until new positions
+// arrive.
+func (s *server) behaviourSummary(w http.ResponseWriter, r *http.Request) {
+	var (
+		params = behaviourSummaryParams{window: time.Hour}
+		err    error
+	)
+	if params.from, err = parseTimeParam(r, "from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.to, err = parseTimeParam(r, "to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("window"); v != "" {
+		params.window, err = time.ParseDuration(v)
+		if err != nil || params.window < time.Minute {
+			http.Error(w, "invalid window: must be a duration of at least 1m", http.StatusBadRequest)
+			return
+		}
+	}
+
+	state, err := s.db.getPositionsState()
+	if err != nil {
+		s.log.Error("failed to fetch positions state", zap.Error(err))
+		http.Error(w, "failed to summarize behaviours", http.StatusInternalServerError)
+		return
+	}
+
+	summary, ok := s.behaviourCache.get(state, params)
+	if !ok {
+		t, err := s.db.fetchTrack(params.from, params.to)
+		if err != nil {
+			s.log.Error("failed to fetch track", zap.Error(err))
+			http.Error(w, "failed to summarize behaviours", http.StatusInternalServerError)
+			return
+		}
+		summary = summarizeBehaviours(t, params.window)
+		s.behaviourCache.put(state, params, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		http.Error(w, "failed to encode behaviour summary", http.StatusInternalServerError)
+		return
+	}
+}
+
+// recompute starts replaying the stored muscle inputs into a new trajectory
+// version. The model defaults to the configured one and can be overridden with
+// ?model=&wheelbase=&gain= to build a trajectory for comparison, only
+// trajectories built with the configured model can be activated.
+func (s *server) recompute(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	cfg := LocomotionConfig{Model: q.Get("model")}
+	if cfg.Model != "" {
+		cfg.Wheelbase, cfg.Gain = s.recomputer.cfg.Wheelbase, s.recomputer.cfg.Gain
+		if cfg.Wheelbase == 0 {
+			cfg.Wheelbase = DefaultWheelbase
+		}
+		if cfg.Gain == 0 {
+			cfg.Gain = 1
+		}
+	}
+	for name, dst := range map[string]*float64{"wheelbase": &cfg.Wheelbase, "gain": &cfg.Gain} {
+		if v := q.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s", name), http.StatusBadRequest)
+				return
+			}
+			*dst = f
+		}
+	}
+
+	activate := true
+	if v := q.Get("activate"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid activate", http.StatusBadRequest)
+			return
+		}
+		activate = b
+	}
+
+	t, err := s.recomputer.Start(cfg, activate)
+	if err != nil {
+		switch {
+		case errors.Is(err, errRecomputeRunning):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errModelNotConfigured), errors.Is(err, errMissingMuscles):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			s.log.Error("failed to start recomputation", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		http.Error(w, "failed to encode trajectory", http.StatusInternalServerError)
+		return
+	}
+}
+
+// export streams the positions between from and to in the ?format= asked for,
+// as a download.
+func (s *server) export(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, errInvalidExportFormat.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, err := parseVersionParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, _, err = s.db.positionsSource(version)
+	if errors.Is(err, errTrajectoryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log.Error("failed to export positions", zap.Error(err))
+		http.Error(w, "failed to export positions", http.StatusInternalServerError)
+		return
+	}
+
+	ew := &exportWriter{ResponseWriter: w, contentType: contentType, filename: "worm-positions." + format}
+	summary, err := s.db.Export(r.Context(), ew, format, from, to, version)
+	switch {
+	case err == nil:
+		ew.start()
+	case !ew.started:
+		s.log.Error("failed to export positions", zap.Error(err))
+		http.Error(w, "failed to export positions", http.StatusInternalServerError)
+	default:
+		// The response is under way, aborting it tells the client the
+		// export is incomplete
+		if r.Context().Err() == nil {
+			s.log.Error("failed to export positions", zap.Int("exported", summary.Positions), zap.Error(err))
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// exportWriter sets the headers of an export download once the export starts
+// writing, errors before that are answered as they are.
+type exportWriter struct {
+	http.ResponseWriter
+	contentType, filename string
+	started               bool
+}
+
+func (e *exportWriter) start() {
+	if e.started {
+		return
+	}
+	e.started = true
+	e.Header().Set("Content-Type", e.contentType)
+	e.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, e.filename))
+	e.WriteHeader(http.StatusOK)
+}
+
+func (e *exportWriter) Write(b []byte) (int, error) {
+	e.start()
+	return e.ResponseWriter.Write(b)
+}
+
+func (s *server) snapshot(w http.ResponseWriter, r *http.Request) {
+	if s.snapshots == nil {
+		http.Error(w, errSnapshotsDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	snap, err := s.snapshots.Snapshot(r.Context())
+	if err != nil {
+		if errors.Is(err, errSnapshotRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		s.log.Error("failed to take snapshot", zap.Error(err))
+		http.Error(w, "failed to take snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		http.Error(w, "failed to encode snapshot", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *server) importPositions(w http.ResponseWriter, r *http.Request) {
+	opts := ImportOptions{Format: r.URL.Query().Get("format")}
+	if opts.Format == "" {
+		opts.Format = "ndjson"
+	}
+	var err error
+	if opts.Checkpoint, err = parseIntParam(r, "checkpoint", 0, 0, math.MaxInt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Positions, err = parseIntParam(r, "positions", 0, 0, math.MaxInt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.importer.Submit(r.Context(), r.Body, opts)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidImportFormat):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errImportNotEmpty):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errInvalidImport):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			s.log.Error("failed to import positions", zap.Error(err))
+			http.Error(w, "failed to import positions", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "failed to encode import", http.StatusInternalServerError)
+		return
+	}
+}
+
+// requireAdmin only lets requests carrying the admin token as a bearer token
+// through. Admin routes don't exist when no token is configured.
+func (s *server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireSQLite only lets requests through when the store is SQLite, the routes
+// it guards query the database directly.
+func (s *server) requireSQLite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.db == nil {
+			http.Error(w, errNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseVersionParam reads the ?version= query parameter, 0 meaning the active
+// trajectory.
+func parseVersionParam(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid version")
+	}
+	return version, nil
+}
+
+// parseBoolParam reads an optional boolean query parameter, false when missing.
+func parseBoolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s", name)
+	}
+	return b, nil
+}
+
+// stripKinematics drops the kinematics of positions that were not asked for
+// them, keeping the default responses unchanged.
+func stripKinematics(ps []position) {
+	for i := range ps {
+		ps[i].Kinematics = nil
+	}
+}
+
+// parseIntParam reads an optional integer query parameter, falling back to def
+// when it's missing and rejecting values outside [min, max].
+func parseIntParam(r *http.Request, name string, def, min, max int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < min || i > max {
+		return 0, fmt.Errorf("invalid %s: must be between %d and %d", name, min, max)
+	}
+	return i, nil
+}
+
+// parseFloatParam reads a required float query parameter.
+func parseFloatParam(r *http.Request, name string) (float64, error) {
+	f, err := strconv.ParseFloat(r.URL.Query().Get(name), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return f, nil
+}
@@ -0,0 +1,500 @@
+package src
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Snapshots are consistent copies of the database written with VACUUM INTO
+// while the tracker keeps running. Each one is listed with its checksum in the
+// manifest of the snapshot directory, and older ones are pruned by the
+// retention rules once a new one is written.
+
+const snapshotManifestName = "manifest.json"
+
+var (
+	errSnapshotsDisabled = errors.New("snapshots are not configured")
+	errSnapshotRunning   = errors.New("a snapshot is already being taken")
+	errSnapshotNotFound  = errors.New("snapshot not found")
+	errSnapshotCorrupt   = errors.New("snapshot is corrupt")
+)
+
+var snapshotsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "worm_tracker_snapshots_total",
+		Help: "Database snapshots taken, by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(snapshotsTotal)
+}
+
+// SnapshotConfig sets where snapshots are written, how often and how many are
+// kept.
+type SnapshotConfig struct {
+	Dir       string        // snapshots are disabled when empty
+	Interval  time.Duration // 0 only takes snapshots on demand
+	Keep      int           // number of latest snapshots kept
+	KeepDaily int           // number of days whose last snapshot is kept on top of those
+}
+
+// snapshot is a manifest entry.
+type snapshot struct {
+	File          string    `json:"file"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	SchemaVersion int       `json:"schemaVersion"`
+	LatestID      int       `json:"latestId"`    // the latest position in the snapshot
+	LatestBlock   int       `json:"latestBlock"` // the latest block checked in the snapshot
+}
+
+type snapshotManifest struct {
+	Snapshots []snapshot `json:"snapshots"` // oldest first
+}
+
+// snapshotter writes snapshots of the database, one at a time.
+type snapshotter struct {
+	log *zap.Logger
+	db  *dbManager
+	cfg SnapshotConfig
+
+	mu sync.Mutex // held while a snapshot is written
+}
+
+// NewSnapshotter returns the snapshotter of the store, nil when snapshots
+// aren't configured or the store isn't SQLite.
+func NewSnapshotter(log *zap.Logger, store Store, cfg SnapshotConfig) (*snapshotter, error) {
+	db, ok := store.(*dbManager)
+	if !ok || cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating snapshot directory: %w", err)
+	}
+	return &snapshotter{log: log, db: db, cfg: cfg}, nil
+}
+
+func (cfg SnapshotConfig) validate() error {
+	if cfg.Interval < 0 {
+		return fmt.Errorf("invalid snapshot interval %v: must not be negative", cfg.Interval)
+	}
+	if cfg.Keep < 1 {
+		return fmt.Errorf("invalid snapshots to keep %d: must be at least 1", cfg.Keep)
+	}
+	if cfg.KeepDaily < 0 {
+		return fmt.Errorf("invalid daily snapshots to keep %d: must not be negative", cfg.KeepDaily)
+	}
+	return nil
+}
+
+// Run takes a snapshot every interval until the context is done. The first one
+// is due an interval after the latest snapshot in the manifest, so restarts
+// don't skip or repeat snapshots.
+func (s *snapshotter) Run(ctx context.Context) {
+	if s.cfg.Interval == 0 {
+		return
+	}
+
+	next := time.Now()
+	if m, err := readSnapshotManifest(s.cfg.Dir); err != nil {
+		s.log.Error("error reading snapshot manifest", zap.Error(err))
+	} else if n := len(m.Snapshots); n > 0 {
+		next = m.Snapshots[n-1].CreatedAt.Add(s.cfg.Interval)
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if _, err := s.Snapshot(ctx); err != nil {
+			s.log.Error("error taking snapshot", zap.Error(err))
+		}
+		next = time.Now().Add(s.cfg.Interval)
+	}
+}
+
+// Snapshot writes a snapshot of the database, adds it to the manifest and
+// prunes the snapshots the retention rules no longer keep.
+func (s *snapshotter) Snapshot(ctx context.Context) (snapshot, error) {
+	if !s.mu.TryLock() {
+		return snapshot{}, errSnapshotRunning
+	}
+	defer s.mu.Unlock()
+
+	snap, err := s.write(ctx)
+	if err != nil {
+		snapshotsTotal.WithLabelValues("error").Inc()
+		return snapshot{}, err
+	}
+	snapshotsTotal.WithLabelValues("ok").Inc()
+	s.log.Info("snapshot taken", zap.String("file", snap.File), zap.Int64("size", snap.Size), zap.Int("latest_id", snap.LatestID))
+
+	return snap, nil
+}
+
+func (s *snapshotter) write(ctx context.Context) (snapshot, error) {
+	createdAt := time.Now().UTC()
+	name := "worm-tracker-" + createdAt.Format("20060102T150405.000Z") + ".sqlite"
+	path := filepath.Join(s.cfg.Dir, name)
+
+	// VACUUM INTO refuses to overwrite a file, a leftover of a failed snapshot
+	// would block it
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return snapshot{}, fmt.Errorf("error removing partial snapshot: %w", err)
+	}
+	if err := s.db.vacuumInto(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return snapshot{}, err
+	}
+
+	snap, err := inspectSnapshot(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return snapshot{}, err
+	}
+	snap.File, snap.CreatedAt = name, createdAt
+
+	if err := syncFile(tmp); err != nil {
+		os.Remove(tmp)
+		return snapshot{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return snapshot{}, fmt.Errorf("error moving snapshot into place: %w", err)
+	}
+
+	m, err := readSnapshotManifest(s.cfg.Dir)
+	if err != nil {
+		return snapshot{}, err
+	}
+	m.Snapshots = append(m.Snapshots, snap)
+
+	kept, pruned := s.cfg.retain(m.Snapshots)
+	m.Snapshots = kept
+	if err := writeSnapshotManifest(s.cfg.Dir, m); err != nil {
+		return snapshot{}, err
+	}
+
+	// Files are removed once the manifest no longer lists them
+	for _, p := range pruned {
+		if err := os.Remove(filepath.Join(s.cfg.Dir, p.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.log.Error("error removing pruned snapshot", zap.String("file", p.File), zap.Error(err))
+		}
+	}
+
+	return snap, nil
+}
+
+// retain splits snapshots, oldest first, into those the retention rules keep
+// and those they prune. The latest Keep snapshots are kept, as well as the
+// last snapshot of each of the latest KeepDaily days that have one.
+func (cfg SnapshotConfig) retain(snapshots []snapshot) ([]snapshot, []snapshot) {
+	keep := make([]bool, len(snapshots))
+	days := make(map[string]bool)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if len(snapshots)-i <= cfg.Keep {
+			keep[i] = true
+		}
+		day := snapshots[i].CreatedAt.UTC().Format(time.DateOnly)
+		if !days[day] && len(days) < cfg.KeepDaily {
+			days[day] = true
+			keep[i] = true
+		}
+	}
+
+	var kept, pruned []snapshot
+	for i, snap := range snapshots {
+		if keep[i] {
+			kept = append(kept, snap)
+		} else {
+			pruned = append(pruned, snap)
+		}
+	}
+	return kept, pruned
+}
+
+// inspectSnapshot checksums a snapshot file and checks its integrity, reading
+// what it holds.
+func inspectSnapshot(path string) (snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return snapshot{}, fmt.Errorf("error opening snapshot: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return snapshot{}, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	snap := snapshot{File: filepath.Base(path), Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&immutable=1")
+	if err != nil {
+		return snapshot{}, fmt.Errorf("error opening snapshot: %w", err)
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.QueryRow(`PRAGMA integrity_check;`).Scan(&integrity); err != nil {
+		return snapshot{}, fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+	}
+	if integrity != "ok" {
+		return snapshot{}, fmt.Errorf("%w: %s", errSnapshotCorrupt, integrity)
+	}
+
+	// Snapshots taken before the ledger still have blocks_checked
+	latestBlockQ := /* sql */ `SELECT COALESCE(MAX(end_block), 0) FROM block_ranges`
+	var ledger int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'block_ranges';`).Scan(&ledger); err != nil {
+		return snapshot{}, fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+	}
+	if ledger == 0 {
+		latestBlockQ = /* sql */ `SELECT COALESCE(MAX(blck), 0) FROM blocks_checked`
+	}
+
+	q := /* sql */ `
+		SELECT
+			(SELECT COALESCE(MAX(version), 0) FROM schema_migrations),
+			(SELECT COALESCE(MAX(id), 0) FROM positions),
+			(` + latestBlockQ + `);
+	`
+	if err := db.QueryRow(q).Scan(&snap.SchemaVersion, &snap.LatestID, &snap.LatestBlock); err != nil {
+		return snapshot{}, fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+	}
+
+	return snap, nil
+}
+
+// verifySnapshot checks a snapshot file against its manifest entry.
+func verifySnapshot(dir string, snap snapshot) error {
+	got, err := inspectSnapshot(filepath.Join(dir, snap.File))
+	if err != nil {
+		return err
+	}
+	if got.Size != snap.Size || got.SHA256 != snap.SHA256 {
+		return fmt.Errorf("%w: checksum mismatch, expected %s got %s", errSnapshotCorrupt, snap.SHA256, got.SHA256)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if got.SchemaVersion > len(migrations) {
+		return fmt.Errorf("%w: snapshot at version %d, this binary knows up to %d", errSchemaTooNew, got.SchemaVersion, len(migrations))
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// Manifest
+
+func readSnapshotManifest(dir string) (snapshotManifest, error) {
+	var m snapshotManifest
+	b, err := os.ReadFile(filepath.Join(dir, snapshotManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("error reading snapshot manifest: %w", err)
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("error decoding snapshot manifest: %w", err)
+	}
+	return m, nil
+}
+
+// writeSnapshotManifest replaces the manifest atomically.
+func writeSnapshotManifest(dir string, m snapshotManifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding snapshot manifest: %w", err)
+	}
+
+	path := filepath.Join(dir, snapshotManifestName)
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return fmt.Errorf("error writing snapshot manifest: %w", err)
+	}
+	if err := syncFile(path + ".tmp"); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error moving snapshot manifest into place: %w", err)
+	}
+	return syncFile(dir)
+}
+
+// find returns the manifest entry of a snapshot file, the latest
+// snapshot when name is empty.
+func (m snapshotManifest) find(name string) (snapshot, error) {
+	if len(m.Snapshots) == 0 {
+		return snapshot{}, errSnapshotNotFound
+	}
+	if name == "" {
+		return m.Snapshots[len(m.Snapshots)-1], nil
+	}
+	for _, snap := range m.Snapshots {
+		if snap.File == name {
+			return snap, nil
+		}
+	}
+	return snapshot{}, fmt.Errorf("%w: %s", errSnapshotNotFound, name)
+}
+
+// syncFile flushes a file or directory to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing %s: %w", path, err)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// Restore
+
+// ListSnapshots returns the snapshots of the manifest in dir, oldest first.
+func ListSnapshots(dir string) ([]snapshot, error) {
+	m, err := readSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	return m.Snapshots, nil
+}
+
+// RestoreSnapshot verifies a snapshot of the manifest in dir and swaps it in
+// for the database at DB_PATH, the latest snapshot when name is empty. The
+// replaced database is kept next to it with a .pre-restore suffix. It must
+// only be used while the tracker is stopped.
+func RestoreSnapshot(log *zap.Logger, dir, name string) error {
+	m, err := readSnapshotManifest(dir)
+	if err != nil {
+		return err
+	}
+	snap, err := m.find(name)
+	if err != nil {
+		return err
+	}
+
+	log.Info("verifying snapshot", zap.String("file", snap.File), zap.String("sha256", snap.SHA256))
+	if err := verifySnapshot(dir, snap); err != nil {
+		return err
+	}
+
+	dbPath := dbPathFromEnv()
+	restoring := dbPath + ".restoring"
+	if err := copyFile(filepath.Join(dir, snap.File), restoring); err != nil {
+		os.Remove(restoring)
+		return err
+	}
+
+	// The write-ahead log and shared memory files belong to the replaced
+	// database, they move with it so that it stays readable
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		aside := dbPath + ".pre-restore" + suffix
+		if err := os.Remove(aside); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing previous %s: %w", aside, err)
+		}
+		if err := os.Rename(dbPath+suffix, aside); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error moving %s aside: %w", dbPath+suffix, err)
+		}
+	}
+	if err := os.Rename(restoring, dbPath); err != nil {
+		return fmt.Errorf("error moving snapshot into place: %w", err)
+	}
+	if err := syncFile(filepath.Dir(dbPath)); err != nil {
+		return err
+	}
+
+	log.Info("snapshot restored",
+		zap.String("file", snap.File),
+		zap.String("path", dbPath),
+		zap.Int("latest_id", snap.LatestID),
+		zap.Int("latest_block", snap.LatestBlock),
+	)
+	return nil
+}
+
+// copyFile copies a file and flushes the copy to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", dst, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("error copying %s: %w", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("error syncing %s: %w", dst, err)
+	}
+	return out.Close()
+}
+
+// -----------------------------------------------------------------------------
+// Storage
+
+// vacuumInto writes a consistent copy of the database to path. It only reads
+// the database, so it runs on a connection of the reader pool and ingestion
+// carries on while it's written, but VACUUM INTO counts as a write to
+// query_only connections, which the connection stops being meanwhile.
+func (db *dbManager) vacuumInto(ctx context.Context, path string) error {
+	conn, err := db.reader.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `PRAGMA query_only = false;`); err != nil {
+		return fmt.Errorf("error preparing snapshot: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, `VACUUM INTO ?;`, path)
+
+	// A connection left writable must not go back to the pool
+	if _, qerr := conn.ExecContext(context.Background(), `PRAGMA query_only = true;`); qerr != nil {
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+
+	if err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package src
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// spatialIndex keeps an R*Tree of the positions so that they can be looked up
+// by location.
+type spatialIndex struct{}
+
+func NewSpatialIndex() *spatialIndex {
+	return &spatialIndex{}
+}
+
+func (s *spatialIndex) name() string { return "spatial" }
+
+func (s *spatialIndex) fingerprint() string { return "v1" }
+
+func (s *spatialIndex) apply(ex execer, p position) error {
+	const q = /* sql */ `
+		INSERT INTO positions_rtree (id, min_x, max_x, min_y, max_y) VALUES (?1, ?2, ?2, ?3, ?3);
+	`
+	if _, err := ex.Exec(q, p.ID, p.X, p.Y); err != nil {
+		return fmt.Errorf("error indexing position: %w", err)
+	}
+	return nil
+}
+
+func (s *spatialIndex) rebuild(ex execer) error {
+	if _, err := ex.Exec(`DELETE FROM positions_rtree;`); err != nil {
+		return fmt.Errorf("error deleting spatial index: %w", err)
+	}
+
+	const q = /* sql */ `
+		INSERT INTO positions_rtree (id, min_x, max_x, min_y, max_y)
+		SELECT id, x, x, y, y FROM positions;
+	`
+	if _, err := ex.Exec(q); err != nil {
+		return fmt.Errorf("error indexing positions: %w", err)
+	}
+	return nil
+}
+
+// fetchPositionsInBox returns up to limit positions inside the bounding box, in
+// order.
+func (db *dbManager) fetchPositionsInBox(minX, minY, maxX, maxY float64, limit int) ([]position, error) {
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE id IN (
+			SELECT id
+			FROM positions_rtree
+			WHERE max_x >= ?1 AND min_x <= ?3
+			AND max_y >= ?2 AND min_y <= ?4
+		)
+		AND x BETWEEN ?1 AND ?3
+		AND y BETWEEN ?2 AND ?4
+		ORDER BY id ASC
+		LIMIT ?5;
+	`
+
+	rows, err := db.reader.Query(q, minX, minY, maxX, maxY, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching positions in box: %w", err)
+	}
+	defer rows.Close()
+
+	return scanPositions(rows)
+}
+
+// fetchPositionsNear returns up to limit positions within radius of (x, y),
+// nearest first.
+func (db *dbManager) fetchPositionsNear(x, y, radius float64, limit int) ([]position, error) {
+	q := /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE id IN (
+			SELECT id
+			FROM positions_rtree
+			WHERE max_x >= ?1 - ?3 AND min_x <= ?1 + ?3
+			AND max_y >= ?2 - ?3 AND min_y <= ?2 + ?3
+		)
+		AND (x - ?1) * (x - ?1) + (y - ?2) * (y - ?2) <= ?3 * ?3
+		ORDER BY (x - ?1) * (x - ?1) + (y - ?2) * (y - ?2) ASC, id ASC
+		LIMIT ?4;
+	`
+
+	rows, err := db.reader.Query(q, x, y, radius, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching positions near point: %w", err)
+	}
+	defer rows.Close()
+
+	return scanPositions(rows)
+}
+
+// revisitPoint is a place and time the worm was at.
+type revisitPoint struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	X         float64   `json:"x"`
+	Y         float64   `json:"y"`
+}
+
+// revisit is the worm coming back within a distance of a place it visited
+// earlier. Only the first position of a run of revisiting positions is
+// reported, along with the first visit to the place.
+type revisit struct {
+	revisitPoint
+	Earlier  revisitPoint `json:"earlier"`
+	Distance float64      `json:"distance"`
+	Elapsed  float64      `json:"elapsed"` // seconds since the earlier visit
+	Moves    int          `json:"moves"`   // moves since the earlier visit
+}
+
+// fetchRevisits returns up to limit revisits between from and to, in order. A
+// position only counts as a revisit of places at least minMoves moves older,
+// so that the worm isn't seen revisiting the places it just left.
+func (db *dbManager) fetchRevisits(distance float64, minMoves int, from, to time.Time, limit int) ([]revisit, error) {
+	const batchSize = 1000
+
+	const q = /* sql */ `
+		WITH candidates AS (
+			SELECT a.id, a.ts, a.x, a.y, (
+				SELECT p.id
+				FROM positions_rtree AS r
+				JOIN positions AS p ON p.id = r.id
+				WHERE r.max_x >= a.x - ?1 AND r.min_x <= a.x + ?1
+				AND r.max_y >= a.y - ?1 AND r.min_y <= a.y + ?1
+				AND r.id < a.id - ?2
+				AND (p.x - a.x) * (p.x - a.x) + (p.y - a.y) * (p.y - a.y) <= ?1 * ?1
+				ORDER BY p.id ASC
+				LIMIT 1
+			) AS earlier_id
+			FROM positions AS a
+			WHERE a.id > ?3
+			AND (?4 IS NULL OR a.ts >= ?4)
+			AND (?5 IS NULL OR a.ts <= ?5)
+			ORDER BY a.id ASC
+			LIMIT ?6
+		)
+		SELECT c.id, c.ts, c.x, c.y, b.id, b.ts, b.x, b.y
+		FROM candidates AS c
+		LEFT JOIN positions AS b ON b.id = c.earlier_id
+		ORDER BY c.id ASC;
+	`
+
+	revisits := make([]revisit, 0)
+	lastID, revisiting := 0, false
+	for len(revisits) < limit {
+		rows, err := db.reader.Query(q, distance, minMoves, lastID, nullTime(from), nullTime(to), batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching revisits: %w", err)
+		}
+
+		var scanned int
+		for rows.Next() {
+			var (
+				v                  revisit
+				earlierID          sql.NullInt64
+				earlierTS          sql.NullTime
+				earlierX, earlierY sql.NullFloat64
+			)
+			if err := rows.Scan(&v.ID, &v.Timestamp, &v.X, &v.Y, &earlierID, &earlierTS, &earlierX, &earlierY); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning revisit: %w", err)
+			}
+			scanned++
+			lastID = v.ID
+
+			if !earlierID.Valid {
+				revisiting = false
+				continue
+			}
+			if revisiting {
+				continue
+			}
+			revisiting = true
+
+			v.Earlier = revisitPoint{ID: int(earlierID.Int64), Timestamp: earlierTS.Time, X: earlierX.Float64, Y: earlierY.Float64}
+			v.Distance = math.Hypot(v.X-v.Earlier.X, v.Y-v.Earlier.Y)
+			v.Elapsed = v.Timestamp.Sub(v.Earlier.Timestamp).Seconds()
+			v.Moves = v.ID - v.Earlier.ID
+			revisits = append(revisits, v)
+			if len(revisits) == limit {
+				break
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error iterating revisits: %w", err)
+		}
+		if scanned < batchSize {
+			break
+		}
+	}
+
+	return revisits, nil
+}
@@ -0,0 +1,263 @@
+package src
+
+import (
+	"math"
+	"math/cmplx"
+	"sort"
+	"time"
+)
+
+type spectrumParams struct {
+	from     time.Time
+	to       time.Time
+	interval time.Duration // resampling interval, 0 picks the median time between moves
+	window   int           // samples per FFT window, a power of two
+	peaks    int           // number of peak frequencies to report
+}
+
+type spectrumStats struct {
+	From        *time.Time                `json:"from"`
+	To          *time.Time                `json:"to"`
+	Points      int                       `json:"points"`
+	Truncated   bool                      `json:"truncated"`
+	Interval    float64                   `json:"interval"`   // seconds between resampled values
+	SampleRate  float64                   `json:"sampleRate"` // Hz
+	Samples     int                       `json:"samples"`
+	Window      int                       `json:"window"` // samples per window, smaller than asked for on short ranges
+	Frequencies []float64                 `json:"frequencies"`
+	Spectra     map[string]muscleSpectrum `json:"spectra"`
+}
+
+// muscleSpectrum is the Welch power spectrum of a muscle series: the mean of
+// the periodograms of Hann windowed, half overlapping windows with their mean
+// removed.
+type muscleSpectrum struct {
+	Power   []float64        `json:"power"`
+	Peaks   []spectralPeak   `json:"peaks"`
+	Windows []spectrumWindow `json:"windows"`
+}
+
+type spectralPeak struct {
+	Frequency float64 `json:"frequency"` // Hz
+	Period    float64 `json:"period"`    // seconds
+	Power     float64 `json:"power"`
+}
+
+// spectrumWindow is the dominant frequency of a single window, to show how the
+// rhythm changes over time.
+type spectrumWindow struct {
+	From              time.Time `json:"from"`
+	To                time.Time `json:"to"`
+	DominantFrequency float64   `json:"dominantFrequency"`
+	DominantPower     float64   `json:"dominantPower"`
+}
+
+const (
+	// minSpectrumWindow is the shortest window a spectrum is computed over.
+	minSpectrumWindow = 8
+	// maxSpectrumSamples caps the resampled series, longer ones are resampled at
+	// a coarser interval.
+	maxSpectrumSamples = 1 << 20
+)
+
+func analyzeSpectrum(t track, params spectrumParams) spectrumStats {
+	stats := spectrumStats{
+		Points:      len(t.points),
+		Truncated:   t.truncated,
+		Frequencies: make([]float64, 0),
+		Spectra:     make(map[string]muscleSpectrum),
+	}
+	if len(t.points) > 0 {
+		stats.From, stats.To = &t.points[0].Timestamp, &t.points[len(t.points)-1].Timestamp
+	}
+
+	var muscles []trackPoint
+	for _, p := range t.points {
+		if p.HasMuscles {
+			muscles = append(muscles, p)
+		}
+	}
+
+	interval := params.interval
+	if interval == 0 {
+		interval = medianInterval(muscles)
+	}
+	if interval <= 0 {
+		return stats
+	}
+	if span := muscles[len(muscles)-1].Timestamp.Sub(muscles[0].Timestamp); span/interval >= maxSpectrumSamples {
+		interval = span/maxSpectrumSamples + 1
+	}
+	stats.Interval = interval.Seconds()
+	stats.SampleRate = 1 / stats.Interval
+
+	start, left, right := resample(muscles, interval)
+	stats.Samples = len(left)
+
+	window := params.window
+	for window > len(left) {
+		window /= 2
+	}
+	if window < minSpectrumWindow {
+		return stats
+	}
+	stats.Window = window
+
+	for k := 0; k <= window/2; k++ {
+		stats.Frequencies = append(stats.Frequencies, float64(k)*stats.SampleRate/float64(window))
+	}
+
+	for name, series := range map[string][]float64{"left": left, "right": right} {
+		stats.Spectra[name] = welch(series, window, start, interval, stats.Frequencies, params.peaks)
+	}
+
+	return stats
+}
+
+// medianInterval returns the median time between consecutive points.
+func medianInterval(points []trackPoint) time.Duration {
+	if len(points) < 2 {
+		return 0
+	}
+	gaps := make([]time.Duration, 0, len(points)-1)
+	for i := 1; i < len(points); i++ {
+		gaps = append(gaps, points[i].Timestamp.Sub(points[i-1].Timestamp))
+	}
+	sort.Slice(gaps, func(a, b int) bool { return gaps[a] < gaps[b] })
+	return gaps[len(gaps)/2]
+}
+
+// resample linearly interpolates the muscle activations onto a uniform grid
+// starting at the first point, returning the grid's start.
+func resample(points []trackPoint, interval time.Duration) (time.Time, []float64, []float64) {
+	if len(points) < 2 {
+		return time.Time{}, nil, nil
+	}
+
+	start := points[0].Timestamp
+	n := int(points[len(points)-1].Timestamp.Sub(start)/interval) + 1
+	left, right := make([]float64, 0, n), make([]float64, 0, n)
+
+	j := 0
+	for i := 0; i < n; i++ {
+		at := start.Add(time.Duration(i) * interval)
+		for j+1 < len(points)-1 && !points[j+1].Timestamp.After(at) {
+			j++
+		}
+		a, b := points[j], points[j+1]
+
+		var f float64
+		if span := b.Timestamp.Sub(a.Timestamp); span > 0 {
+			f = math.Min(float64(at.Sub(a.Timestamp))/float64(span), 1)
+		}
+		left = append(left, float64(a.LeftMuscle)+f*float64(b.LeftMuscle-a.LeftMuscle))
+		right = append(right, float64(a.RightMuscle)+f*float64(b.RightMuscle-a.RightMuscle))
+	}
+
+	return start, left, right
+}
+
+func welch(series []float64, window int, start time.Time, interval time.Duration, frequencies []float64, peaks int) muscleSpectrum {
+	s := muscleSpectrum{Power: make([]float64, window/2+1), Peaks: make([]spectralPeak, 0), Windows: make([]spectrumWindow, 0)}
+
+	hann := make([]float64, window)
+	var norm float64
+	for i := range hann {
+		hann[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(window-1))
+		norm += hann[i] * hann[i]
+	}
+
+	var count int
+	for i := 0; i+window <= len(series); i += window / 2 {
+		power := periodogram(series[i:i+window], hann, norm)
+		for k := range power {
+			s.Power[k] += power[k]
+		}
+		count++
+
+		w := spectrumWindow{
+			From: start.Add(time.Duration(i) * interval),
+			To:   start.Add(time.Duration(i+window-1) * interval),
+		}
+		// the zero frequency is left out, it's only what remains of the mean
+		for k := 1; k < len(power); k++ {
+			if power[k] > w.DominantPower {
+				w.DominantFrequency, w.DominantPower = frequencies[k], power[k]
+			}
+		}
+		s.Windows = append(s.Windows, w)
+	}
+	for k := range s.Power {
+		s.Power[k] /= float64(count)
+	}
+
+	// Peaks are the local maxima of the averaged spectrum
+	for k := 1; k < len(s.Power); k++ {
+		if s.Power[k] <= s.Power[k-1] || (k+1 < len(s.Power) && s.Power[k] < s.Power[k+1]) {
+			continue
+		}
+		s.Peaks = append(s.Peaks, spectralPeak{Frequency: frequencies[k], Period: 1 / frequencies[k], Power: s.Power[k]})
+	}
+	sort.SliceStable(s.Peaks, func(a, b int) bool { return s.Peaks[a].Power > s.Peaks[b].Power })
+	if len(s.Peaks) > peaks {
+		s.Peaks = s.Peaks[:peaks]
+	}
+
+	return s
+}
+
+// periodogram returns the one-sided power spectrum of a window after removing
+// its mean and applying the taper.
+func periodogram(values, taper []float64, norm float64) []float64 {
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	x := make([]complex128, len(values))
+	for i, v := range values {
+		x[i] = complex((v-mean)*taper[i], 0)
+	}
+	fft(x)
+
+	n := len(values)
+	power := make([]float64, n/2+1)
+	for k := range power {
+		power[k] = cmplx.Abs(x[k]) * cmplx.Abs(x[k]) / norm
+		if k > 0 && k < n/2 {
+			power[k] *= 2 // fold in the negative frequencies
+		}
+	}
+	return power
+}
+
+// fft computes the discrete Fourier transform of x in place. The length of x
+// must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+
+	// Bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// statements runs queries on a pool as statements prepared once, each pooled
+// connection preparing a statement the first time it runs it. Queries are
+// keyed on their text, so they must be single statements that don't embed
+// values. It satisfies execer.
+type statements struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStatements(db *sql.DB) *statements {
+	return &statements{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// prepared returns the statement of a query, nil when it isn't prepared yet.
+func (s *statements) prepared(q string) *sql.Stmt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stmts[q]
+}
+
+func (s *statements) prepare(q string) (*sql.Stmt, error) {
+	if stmt := s.prepared(q); stmt != nil {
+		return stmt, nil
+	}
+
+	stmt, err := s.db.Prepare(q)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.stmts[q]; ok {
+		stmt.Close()
+		return prev, nil
+	}
+	s.stmts[q] = stmt
+	return stmt, nil
+}
+
+func (s *statements) Exec(q string, args ...any) (sql.Result, error) {
+	stmt, err := s.prepare(q)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+func (s *statements) Query(q string, args ...any) (*sql.Rows, error) {
+	stmt, err := s.prepare(q)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+func (s *statements) QueryRow(q string, args ...any) *sql.Row {
+	stmt, err := s.prepare(q)
+	if err != nil {
+		// a *sql.Row can't be made to carry the error, running the query
+		// unprepared reports it
+		return s.db.QueryRow(q, args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+// begin starts a transaction running the prepared statements.
+func (s *statements) begin(ctx context.Context) (*stmtTx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &stmtTx{Tx: tx, stmts: s}, nil
+}
+
+// stmtTx is a transaction running the prepared statements of its pool. Preparing
+// a statement takes a connection of its own, which the writer pool doesn't
+// have while a transaction holds its only connection, so queries first seen
+// in a transaction run unprepared and are prepared once it ends. The embedded
+// *sql.Tx runs queries as they are, for scripts of several statements.
+type stmtTx struct {
+	*sql.Tx
+	stmts *statements
+
+	pending []string // queries to prepare once the transaction ends
+}
+
+func (t *stmtTx) stmt(q string) *sql.Stmt {
+	stmt := t.stmts.prepared(q)
+	if stmt == nil {
+		t.pending = append(t.pending, q)
+		return nil
+	}
+	return t.Tx.Stmt(stmt)
+}
+
+func (t *stmtTx) Exec(q string, args ...any) (sql.Result, error) {
+	if stmt := t.stmt(q); stmt != nil {
+		return stmt.Exec(args...)
+	}
+	return t.Tx.Exec(q, args...)
+}
+
+func (t *stmtTx) Query(q string, args ...any) (*sql.Rows, error) {
+	if stmt := t.stmt(q); stmt != nil {
+		return stmt.Query(args...)
+	}
+	return t.Tx.Query(q, args...)
+}
+
+func (t *stmtTx) QueryRow(q string, args ...any) *sql.Row {
+	if stmt := t.stmt(q); stmt != nil {
+		return stmt.QueryRow(args...)
+	}
+	return t.Tx.QueryRow(q, args...)
+}
+
+func (t *stmtTx) Commit() error {
+	err := t.Tx.Commit()
+	t.preparePending()
+	return err
+}
+
+func (t *stmtTx) Rollback() error {
+	err := t.Tx.Rollback()
+	t.preparePending()
+	return err
+}
+
+// preparePending prepares the queries first seen in the transaction. Queries
+// that fail to prepare are left to fail again when they next run.
+func (t *stmtTx) preparePending() {
+	pending := t.pending
+	t.pending = nil
+	for _, q := range pending {
+		t.stmts.prepare(q)
+	}
+}
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Position is a position of the worm as it's stored.
+type Position = position
+
+// StateAt is where the worm was at a block or a time.
+type StateAt = stateAt
+
+var errNotSupported = errors.New("not supported by the configured store")
+
+// Store keeps the positions of the worm and the fetcher's ledger, the block
+// ranges it has processed, and answers the reads of the active trajectory the
+// main routes are built on. Everything built on top of them, the other
+// trajectory versions, derivations and analytics, is only kept by the SQLite
+// store, the other stores hold just the ingested data. Tables and reads every
+// store has to provide are added here, and to the conformance suite in
+// storetest.
+//
+// The memory store serves /worm/positions?id=, /worm/historical, /worm/at,
+// /worm/arena and /worm/coverage for the active trajectory. The recomputer,
+// importer, snapshots, retention and block range repairs need the SQLite
+// store and are disabled without it, and the routes reading other trajectory
+// versions or derived data answer 501 Not Implemented.
+type Store interface {
+	// SavePosition stores a new position of the active trajectory and returns
+	// it with its id set. Ids grow with every position.
+	SavePosition(p Position) (Position, error)
+	// LatestPosition returns the latest position, the zero position when there
+	// is none.
+	LatestPosition() (Position, error)
+	// Positions returns up to limit positions after id, in order.
+	Positions(id, limit int) ([]Position, error)
+	// RecentPositions returns the last limit positions, in order.
+	RecentPositions(limit int) ([]Position, error)
+	// HasUpdate reports whether the position of the update logged at logIndex
+	// by a transaction is stored.
+	HasUpdate(transactionHash string, logIndex int) (bool, error)
+	// Sample returns count positions, at least 2, chosen along the path by
+	// one of the sampling methods of /worm/historical, in order. The first
+	// and last positions are always kept, and up to count positions are all
+	// returned.
+	Sample(count int, method string) ([]Position, error)
+	// StateAtBlock returns the state of the worm at a block, the last update
+	// at or before it being in effect. It fails before the first position.
+	StateAtBlock(block int) (StateAt, error)
+	// StateAtTime returns the state of the worm at a time, like StateAtBlock.
+	StateAtTime(ts time.Time) (StateAt, error)
+
+	// RecordBlockRange records the status of a range of blocks over whatever
+	// was recorded for them before, merging it with the contiguous ranges of
+	// the same status.
+	RecordBlockRange(r BlockRange) error
+	// BlockRanges returns the ledger, in order and without overlaps.
+	BlockRanges() ([]BlockRange, error)
+	// LatestCheckpoint returns the latest block recorded, whatever its status,
+	// 0 when there is none.
+	LatestCheckpoint() (int, error)
+
+	Close() error
+}
+
+var (
+	_ Store = (*dbManager)(nil)
+	_ Store = (*memoryStore)(nil)
+)
+
+// OpenStore opens the store chosen by STORE, either the SQLite database
+// (default) or an in-memory store that's lost on exit.
+func OpenStore(log *zap.Logger) (Store, error) {
+	switch backend := os.Getenv("STORE"); backend {
+	case "", "sqlite":
+		return OpenDatabase(log)
+	case "memory":
+		log.Info("using in-memory store")
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("invalid STORE %q: must be sqlite or memory", backend)
+	}
+}
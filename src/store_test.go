@@ -0,0 +1,31 @@
+package src_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/brainsonchain/worm-tracker/src"
+	"github.com/brainsonchain/worm-tracker/src/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) src.Store {
+		return src.NewMemoryStore()
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) src.Store {
+		db, err := src.NewDBManager(filepath.Join(t.TempDir(), "worm-tracker.sqlite"))
+		if err != nil {
+			t.Fatalf("opening database: %v", err)
+		}
+		if err := db.MigrateUp(zap.NewNop(), 0); err != nil {
+			db.Close()
+			t.Fatalf("migrating database: %v", err)
+		}
+		return db
+	})
+}
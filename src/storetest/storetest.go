@@ -0,0 +1,482 @@
+// Package storetest is the conformance suite every src.Store has to pass.
+// Backends run it from their tests with a constructor of empty stores:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) src.Store {
+//			return src.NewMemoryStore()
+//		})
+//	}
+package storetest
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/brainsonchain/worm-tracker/src"
+)
+
+// Run runs the suite against stores returned by newStore, which must be empty
+// and are closed by the suite.
+func Run(t *testing.T, newStore func(t *testing.T) src.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s src.Store)
+	}{
+		{"Empty", testEmpty},
+		{"SavePosition", testSavePosition},
+		{"RoundTrip", testRoundTrip},
+		{"Positions", testPositions},
+		{"RecentPositions", testRecentPositions},
+		{"HasUpdate", testHasUpdate},
+		{"Sample", testSample},
+		{"StateAt", testStateAt},
+		{"Copies", testCopies},
+		{"BlockRanges", testBlockRanges},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			t.Cleanup(func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("closing store: %v", err)
+				}
+			})
+			tt.fn(t, s)
+		})
+	}
+}
+
+// newPosition returns the i-th position of a made up trajectory.
+func newPosition(i int) src.Position {
+	left, right := int64(i%7), int64(-i%5)
+	return src.Position{
+		Block:           100 + i,
+		TransactionHash: fmt.Sprintf("0x%064x", i),
+		X:               float64(i) * 1.5,
+		Y:               float64(i) * -0.25,
+		Direction:       float64(i*10%360) + 0.5,
+		Price:           1 + float64(i)/100,
+		Timestamp:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+		Model:           "legacy",
+		ModelVersion:    1,
+		Collision:       i%3 == 0,
+		LeftMuscle:      &left,
+		RightMuscle:     &right,
+	}
+}
+
+// savePositions saves n positions and returns them with their ids set.
+func savePositions(t *testing.T, s src.Store, n int) []src.Position {
+	t.Helper()
+	saved := make([]src.Position, 0, n)
+	for i := 0; i < n; i++ {
+		p, err := s.SavePosition(newPosition(i))
+		if err != nil {
+			t.Fatalf("saving position %d: %v", i, err)
+		}
+		saved = append(saved, p)
+	}
+	return saved
+}
+
+func ids(ps []src.Position) []int {
+	ids := make([]int, 0, len(ps))
+	for _, p := range ps {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func testEmpty(t *testing.T, s src.Store) {
+	p, err := s.LatestPosition()
+	if err != nil {
+		t.Fatalf("LatestPosition: %v", err)
+	}
+	if p.ID != 0 {
+		t.Errorf("LatestPosition of an empty store has id %d, want 0", p.ID)
+	}
+
+	ps, err := s.Positions(0, 10)
+	if err != nil {
+		t.Fatalf("Positions: %v", err)
+	}
+	if len(ps) != 0 {
+		t.Errorf("Positions of an empty store returned %d positions", len(ps))
+	}
+
+	ps, err = s.RecentPositions(10)
+	if err != nil {
+		t.Fatalf("RecentPositions: %v", err)
+	}
+	if len(ps) != 0 {
+		t.Errorf("RecentPositions of an empty store returned %d positions", len(ps))
+	}
+
+	ps, err = s.Sample(10, "id")
+	if err != nil {
+		t.Fatalf("Sample: %v", err)
+	}
+	if len(ps) != 0 {
+		t.Errorf("Sample of an empty store returned %d positions", len(ps))
+	}
+
+	ranges, err := s.BlockRanges()
+	if err != nil {
+		t.Fatalf("BlockRanges: %v", err)
+	}
+	if len(ranges) != 0 {
+		t.Errorf("BlockRanges of an empty store returned %d ranges", len(ranges))
+	}
+
+	block, err := s.LatestCheckpoint()
+	if err != nil {
+		t.Fatalf("LatestCheckpoint: %v", err)
+	}
+	if block != 0 {
+		t.Errorf("LatestCheckpoint of an empty store is %d, want 0", block)
+	}
+}
+
+func testSavePosition(t *testing.T, s src.Store) {
+	saved := savePositions(t, s, 5)
+	for i := 1; i < len(saved); i++ {
+		if saved[i].ID <= saved[i-1].ID {
+			t.Fatalf("ids don't grow: %v", ids(saved))
+		}
+	}
+
+	latest, err := s.LatestPosition()
+	if err != nil {
+		t.Fatalf("LatestPosition: %v", err)
+	}
+	if want := saved[len(saved)-1].ID; latest.ID != want {
+		t.Errorf("LatestPosition has id %d, want %d", latest.ID, want)
+	}
+}
+
+func testRoundTrip(t *testing.T, s src.Store) {
+	want := newPosition(3)
+	want.Anomalies = []string{"long_gap", "price_jump"}
+	want.Kinematics = nil
+
+	saved, err := s.SavePosition(want)
+	if err != nil {
+		t.Fatalf("SavePosition: %v", err)
+	}
+	want.ID = saved.ID
+
+	noMuscles := newPosition(4)
+	noMuscles.LeftMuscle, noMuscles.RightMuscle = nil, nil
+	if _, err := s.SavePosition(noMuscles); err != nil {
+		t.Fatalf("SavePosition: %v", err)
+	}
+
+	ps, err := s.Positions(0, 10)
+	if err != nil {
+		t.Fatalf("Positions: %v", err)
+	}
+	if len(ps) != 2 {
+		t.Fatalf("Positions returned %d positions, want 2", len(ps))
+	}
+
+	got := ps[0]
+	if got.ID != want.ID ||
+		got.Block != want.Block ||
+		got.TransactionHash != want.TransactionHash ||
+		got.X != want.X || got.Y != want.Y ||
+		got.Direction != want.Direction ||
+		got.Price != want.Price ||
+		!got.Timestamp.Equal(want.Timestamp) ||
+		got.Model != want.Model ||
+		got.ModelVersion != want.ModelVersion ||
+		got.Collision != want.Collision {
+		t.Errorf("position changed in the store:\n got %+v\nwant %+v", got, want)
+	}
+	if got.LeftMuscle == nil || got.RightMuscle == nil ||
+		*got.LeftMuscle != *want.LeftMuscle || *got.RightMuscle != *want.RightMuscle {
+		t.Errorf("muscles changed in the store: got %v, %v", got.LeftMuscle, got.RightMuscle)
+	}
+	if !slices.Equal(got.Anomalies, want.Anomalies) {
+		t.Errorf("anomalies changed in the store: got %v, want %v", got.Anomalies, want.Anomalies)
+	}
+	if ps[1].LeftMuscle != nil || ps[1].RightMuscle != nil {
+		t.Errorf("unrecorded muscles came back as %v, %v", ps[1].LeftMuscle, ps[1].RightMuscle)
+	}
+	if ps[1].Anomalies != nil {
+		t.Errorf("a position without anomalies came back with %v", ps[1].Anomalies)
+	}
+}
+
+func testPositions(t *testing.T, s src.Store) {
+	saved := savePositions(t, s, 10)
+
+	ps, err := s.Positions(0, 4)
+	if err != nil {
+		t.Fatalf("Positions: %v", err)
+	}
+	if got, want := ids(ps), ids(saved[:4]); !slices.Equal(got, want) {
+		t.Errorf("first page is %v, want %v", got, want)
+	}
+
+	ps, err = s.Positions(saved[3].ID, 4)
+	if err != nil {
+		t.Fatalf("Positions: %v", err)
+	}
+	if got, want := ids(ps), ids(saved[4:8]); !slices.Equal(got, want) {
+		t.Errorf("second page is %v, want %v", got, want)
+	}
+
+	ps, err = s.Positions(saved[7].ID, 4)
+	if err != nil {
+		t.Fatalf("Positions: %v", err)
+	}
+	if got, want := ids(ps), ids(saved[8:]); !slices.Equal(got, want) {
+		t.Errorf("last page is %v, want %v", got, want)
+	}
+
+	ps, err = s.Positions(saved[9].ID, 4)
+	if err != nil {
+		t.Fatalf("Positions: %v", err)
+	}
+	if len(ps) != 0 {
+		t.Errorf("positions after the latest are %v, want none", ids(ps))
+	}
+}
+
+func testRecentPositions(t *testing.T, s src.Store) {
+	saved := savePositions(t, s, 10)
+
+	ps, err := s.RecentPositions(3)
+	if err != nil {
+		t.Fatalf("RecentPositions: %v", err)
+	}
+	if got, want := ids(ps), ids(saved[7:]); !slices.Equal(got, want) {
+		t.Errorf("recent positions are %v, want %v", got, want)
+	}
+
+	ps, err = s.RecentPositions(20)
+	if err != nil {
+		t.Fatalf("RecentPositions: %v", err)
+	}
+	if got, want := ids(ps), ids(saved); !slices.Equal(got, want) {
+		t.Errorf("recent positions are %v, want %v", got, want)
+	}
+}
+
+// testCopies checks that positions handed to and returned by the store don't
+// share memory with it.
+func testCopies(t *testing.T, s src.Store) {
+	p := newPosition(1)
+	p.Anomalies = []string{"long_gap"}
+	if _, err := s.SavePosition(p); err != nil {
+		t.Fatalf("SavePosition: %v", err)
+	}
+	*p.LeftMuscle = 99
+	p.Anomalies[0] = "changed"
+
+	got, err := s.LatestPosition()
+	if err != nil {
+		t.Fatalf("LatestPosition: %v", err)
+	}
+	if *got.LeftMuscle == 99 || got.Anomalies[0] != "long_gap" {
+		t.Fatalf("changing a saved position changed the store")
+	}
+
+	*got.LeftMuscle = 98
+	got.Anomalies[0] = "changed"
+	again, err := s.LatestPosition()
+	if err != nil {
+		t.Fatalf("LatestPosition: %v", err)
+	}
+	if *again.LeftMuscle == 98 || again.Anomalies[0] != "long_gap" {
+		t.Fatalf("changing a returned position changed the store")
+	}
+}
+
+func testBlockRanges(t *testing.T, s src.Store) {
+	record := func(from, to int, status string) {
+		t.Helper()
+		if err := s.RecordBlockRange(src.BlockRange{From: from, To: to, Status: status}); err != nil {
+			t.Fatalf("RecordBlockRange(%d-%d %s): %v", from, to, status, err)
+		}
+	}
+	record(100, 150, src.BlockRangeDone)
+	record(150, 200, src.BlockRangeDone)
+	record(201, 201, src.BlockRangeSkippedInvalid)
+	record(202, 250, src.BlockRangeDone)
+	record(300, 350, src.BlockRangeFailed)
+
+	type span struct {
+		from, to int
+		status   string
+	}
+	check := func(want []span) {
+		t.Helper()
+		ranges, err := s.BlockRanges()
+		if err != nil {
+			t.Fatalf("BlockRanges: %v", err)
+		}
+		got := make([]span, 0, len(ranges))
+		for _, r := range ranges {
+			got = append(got, span{r.From, r.To, r.Status})
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("BlockRanges are %v, want %v", got, want)
+		}
+	}
+
+	// Contiguous ranges with the same status are merged
+	check([]span{
+		{100, 200, src.BlockRangeDone},
+		{201, 201, src.BlockRangeSkippedInvalid},
+		{202, 250, src.BlockRangeDone},
+		{300, 350, src.BlockRangeFailed},
+	})
+
+	latest, err := s.LatestCheckpoint()
+	if err != nil {
+		t.Fatalf("LatestCheckpoint: %v", err)
+	}
+	if latest != 350 {
+		t.Errorf("LatestCheckpoint is %d, want 350", latest)
+	}
+
+	// A range recorded over others replaces them where they overlap
+	record(201, 201, src.BlockRangeDone)
+	record(320, 330, src.BlockRangeDone)
+	check([]span{
+		{100, 250, src.BlockRangeDone},
+		{300, 319, src.BlockRangeFailed},
+		{320, 330, src.BlockRangeDone},
+		{331, 350, src.BlockRangeFailed},
+	})
+
+	for _, r := range []src.BlockRange{
+		{From: 0, To: 10, Status: src.BlockRangeDone},
+		{From: 20, To: 10, Status: src.BlockRangeDone},
+		{From: 10, To: 20, Status: "pending"},
+	} {
+		if err := s.RecordBlockRange(r); err == nil {
+			t.Errorf("recording %d-%d %s succeeded, want an error", r.From, r.To, r.Status)
+		}
+	}
+}
+
+func testHasUpdate(t *testing.T, s src.Store) {
+	saved := savePositions(t, s, 3)
+	second := newPosition(3)
+	second.TransactionHash, second.LogIndex = saved[2].TransactionHash, 1
+	if _, err := s.SavePosition(second); err != nil {
+		t.Fatalf("saving position: %v", err)
+	}
+
+	tests := []struct {
+		hash   string
+		log    int
+		stored bool
+	}{
+		{saved[0].TransactionHash, 0, true},
+		{saved[2].TransactionHash, 0, true},
+		{saved[2].TransactionHash, 1, true},
+		{saved[1].TransactionHash, 1, false},
+		{"0xabc", 0, false},
+	}
+	for _, tt := range tests {
+		stored, err := s.HasUpdate(tt.hash, tt.log)
+		if err != nil {
+			t.Fatalf("HasUpdate: %v", err)
+		}
+		if stored != tt.stored {
+			t.Errorf("HasUpdate(%s, %d) = %v, want %v", tt.hash, tt.log, stored, tt.stored)
+		}
+	}
+}
+
+func testSample(t *testing.T, s src.Store) {
+	saved := savePositions(t, s, 10)
+
+	for _, method := range []string{"id", "time", "rdp", "vw", "lttb"} {
+		ps, err := s.Sample(4, method)
+		if err != nil {
+			t.Fatalf("Sample(%s): %v", method, err)
+		}
+		if len(ps) < 2 || len(ps) > 4 {
+			t.Errorf("%s sample has %d positions, want 2 to 4", method, len(ps))
+			continue
+		}
+		if ps[0].ID != saved[0].ID || ps[len(ps)-1].ID != saved[9].ID {
+			t.Errorf("%s sample %v doesn't keep the first and last positions", method, ids(ps))
+		}
+		for i := 1; i < len(ps); i++ {
+			if ps[i].ID <= ps[i-1].ID {
+				t.Errorf("%s sample %v is out of order", method, ids(ps))
+				break
+			}
+		}
+	}
+
+	ps, err := s.Sample(4, "id")
+	if err != nil {
+		t.Fatalf("Sample: %v", err)
+	}
+	if got, want := ids(ps), ids([]src.Position{saved[0], saved[3], saved[6], saved[9]}); !slices.Equal(got, want) {
+		t.Errorf("id sample is %v, want %v", got, want)
+	}
+
+	ps, err = s.Sample(20, "rdp")
+	if err != nil {
+		t.Fatalf("Sample: %v", err)
+	}
+	if got, want := ids(ps), ids(saved); !slices.Equal(got, want) {
+		t.Errorf("sample of a short path is %v, want %v", got, want)
+	}
+}
+
+func testStateAt(t *testing.T, s src.Store) {
+	saved := savePositions(t, s, 5)
+
+	if _, err := s.StateAtBlock(saved[0].Block - 1); err == nil {
+		t.Errorf("StateAtBlock before the first position succeeded, want an error")
+	}
+	if _, err := s.StateAtTime(saved[0].Timestamp.Add(-time.Second)); err == nil {
+		t.Errorf("StateAtTime before the first position succeeded, want an error")
+	}
+
+	state, err := s.StateAtBlock(saved[2].Block)
+	if err != nil {
+		t.Fatalf("StateAtBlock: %v", err)
+	}
+	if state.Position.ID != saved[2].ID || state.Next == nil || state.Next.ID != saved[3].ID {
+		t.Errorf("state at block %d is between %+v and %+v, want positions %d and %d",
+			saved[2].Block, state.Position, state.Next, saved[2].ID, saved[3].ID)
+	}
+	if state.Interpolated.X != saved[2].X || state.Interpolated.Fraction != 0 {
+		t.Errorf("state at block %d is interpolated to %+v, want x %v", saved[2].Block, state.Interpolated, saved[2].X)
+	}
+
+	// Halfway between two updates
+	ts := saved[2].Timestamp.Add(500 * time.Millisecond)
+	state, err = s.StateAtTime(ts)
+	if err != nil {
+		t.Fatalf("StateAtTime: %v", err)
+	}
+	if state.Position.ID != saved[2].ID || state.Next == nil || state.Next.ID != saved[3].ID {
+		t.Errorf("state at %v is between %+v and %+v, want positions %d and %d",
+			ts, state.Position, state.Next, saved[2].ID, saved[3].ID)
+	}
+	if want := (saved[2].X + saved[3].X) / 2; state.Interpolated.X != want || state.Interpolated.Fraction != 0.5 {
+		t.Errorf("state at %v is interpolated to %+v, want x %v", ts, state.Interpolated, want)
+	}
+
+	// After the latest update
+	state, err = s.StateAtBlock(saved[4].Block + 10)
+	if err != nil {
+		t.Fatalf("StateAtBlock: %v", err)
+	}
+	if state.Position.ID != saved[4].ID || state.Next != nil {
+		t.Errorf("state after the latest update is %+v followed by %+v, want position %d", state.Position, state.Next, saved[4].ID)
+	}
+}
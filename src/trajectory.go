@@ -0,0 +1,620 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// A trajectory is one version of the worm's path. The active trajectory lives
+// in the positions table and is extended as updates arrive, every other
+// version is kept in trajectory_points and stops growing once it's archived.
+const (
+	trajectoryBuilding = "building" // being recomputed
+	trajectoryReady    = "ready"    // recomputed but not activated
+	trajectoryActive   = "active"   // served by default and extended by the fetcher
+	trajectoryArchived = "archived" // was active, replaced by a recomputation
+	trajectoryFailed   = "failed"   // the recomputation failed
+)
+
+var (
+	errTrajectoryNotFound    = errors.New("trajectory not found")
+	errMissingMuscles        = errors.New("positions without recorded muscle inputs can't be recomputed")
+	errRecomputeRunning      = errors.New("a recomputation is already running")
+	errModelNotConfigured    = errors.New("only trajectories built with the configured locomotion model can be activated")
+	errTrajectoryNotBuilding = errors.New("only trajectories that are being built can be activated")
+)
+
+type trajectory struct {
+	Version      int             `json:"version"`
+	Model        string          `json:"model"`
+	ModelVersion int             `json:"modelVersion"`
+	Params       json.RawMessage `json:"params"`
+	Status       string          `json:"status"`
+	Error        string          `json:"error,omitempty"`
+	CreatedAt    time.Time       `json:"createdAt"`
+	ActivatedAt  *time.Time      `json:"activatedAt,omitempty"`
+}
+
+// trajectoryParams records everything needed to reproduce a trajectory.
+type trajectoryParams struct {
+	Locomotion LocomotionConfig `json:"locomotion"`
+	Arena      ArenaConfig      `json:"arena"`
+}
+
+// params returns the parameters the trajectory was built with, normalized so
+// that equal parameters compare equal. Trajectories from before they were
+// recorded were built with the legacy model on an unbounded plane.
+func (t trajectory) params() (trajectoryParams, error) {
+	var p trajectoryParams
+	if err := json.Unmarshal(t.Params, &p); err != nil {
+		return trajectoryParams{}, fmt.Errorf("error decoding trajectory params: %w", err)
+	}
+	p.Locomotion = p.Locomotion.normalized()
+	a, err := NewArena(p.Arena)
+	if err != nil {
+		return trajectoryParams{}, fmt.Errorf("error decoding trajectory params: %w", err)
+	}
+	p.Arena = a.cfg
+	return p, nil
+}
+
+const trajectoryColumns = /* sql */ `
+	version, model, model_version, params, status, error, created_at, activated_at`
+
+func scanTrajectory(row scanner) (trajectory, error) {
+	var (
+		t      trajectory
+		params string
+	)
+	if err := row.Scan(
+		&t.Version,
+		&t.Model,
+		&t.ModelVersion,
+		&params,
+		&t.Status,
+		&t.Error,
+		&t.CreatedAt,
+		&t.ActivatedAt,
+	); err != nil {
+		return trajectory{}, err
+	}
+	t.Params = json.RawMessage(params)
+	return t, nil
+}
+
+func (db *dbManager) fetchTrajectories() ([]trajectory, error) {
+	const q = /* sql */ `
+		SELECT ` + trajectoryColumns + `
+		FROM trajectories
+		ORDER BY version ASC;
+	`
+
+	rows, err := db.reader.Query(q)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching trajectories: %w", err)
+	}
+	defer rows.Close()
+
+	trajectories := make([]trajectory, 0)
+	for rows.Next() {
+		t, err := scanTrajectory(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning trajectory: %w", err)
+		}
+		trajectories = append(trajectories, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating trajectories: %w", err)
+	}
+
+	return trajectories, nil
+}
+
+func (db *dbManager) getTrajectory(version int) (trajectory, error) {
+	const q = /* sql */ `
+		SELECT ` + trajectoryColumns + `
+		FROM trajectories
+		WHERE version = ?;
+	`
+
+	t, err := scanTrajectory(db.reader.QueryRow(q, version))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return trajectory{}, errTrajectoryNotFound
+		}
+		return trajectory{}, fmt.Errorf("error getting trajectory: %w", err)
+	}
+
+	return t, nil
+}
+
+func (db *dbManager) getActiveTrajectory() (trajectory, error) {
+	return activeTrajectory(db.reader)
+}
+
+func activeTrajectory(ex execer) (trajectory, error) {
+	const q = /* sql */ `
+		SELECT ` + trajectoryColumns + `
+		FROM trajectories
+		WHERE status = 'active';
+	`
+
+	t, err := scanTrajectory(ex.QueryRow(q))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return trajectory{}, errTrajectoryNotFound
+		}
+		return trajectory{}, fmt.Errorf("error getting active trajectory: %w", err)
+	}
+
+	return t, nil
+}
+
+// describeActiveTrajectory records the model and parameters of the active
+// trajectory. It's used while the trajectory is still empty so that the first
+// version matches the configured model.
+func describeActiveTrajectory(ex execer, model LocomotionModel, params trajectoryParams) error {
+	const q = /* sql */ `
+		UPDATE trajectories
+		SET model = ?, model_version = ?, params = ?
+		WHERE status = 'active';
+	`
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("error encoding trajectory params: %w", err)
+	}
+
+	if _, err := ex.Exec(q, model.Name(), model.Version(), string(b)); err != nil {
+		return fmt.Errorf("error describing active trajectory: %w", err)
+	}
+
+	return nil
+}
+
+func (db *dbManager) createTrajectory(model LocomotionModel, params trajectoryParams) (trajectory, error) {
+	const q = /* sql */ `
+		INSERT INTO trajectories (model, model_version, params, status, created_at)
+		VALUES (?, ?, ?, 'building', ?)
+		RETURNING ` + trajectoryColumns + `;
+	`
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return trajectory{}, fmt.Errorf("error encoding trajectory params: %w", err)
+	}
+
+	t, err := scanTrajectory(db.writer.QueryRow(q, model.Name(), model.Version(), string(b), time.Now().UTC()))
+	if err != nil {
+		return trajectory{}, fmt.Errorf("error creating trajectory: %w", err)
+	}
+
+	return t, nil
+}
+
+func (db *dbManager) setTrajectoryStatus(version int, status, errMsg string) error {
+	const q = /* sql */ `
+		UPDATE trajectories SET status = ?, error = ? WHERE version = ?;
+	`
+
+	if _, err := db.writer.Exec(q, status, errMsg, version); err != nil {
+		return fmt.Errorf("error setting trajectory status: %w", err)
+	}
+
+	return nil
+}
+
+func (db *dbManager) countPositionsMissingMuscles() (int, error) {
+	const q = /* sql */ `
+		SELECT COUNT(*) FROM positions WHERE left_muscle IS NULL;
+	`
+
+	var n int
+	if err := db.reader.QueryRow(q).Scan(&n); err != nil {
+		return 0, fmt.Errorf("error counting positions missing muscles: %w", err)
+	}
+
+	return n, nil
+}
+
+// execer is satisfied by *sql.DB, *sql.Tx and the statements of the pools.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// replayPositions recomputes every position after last, in chain order, into
+// the points of a trajectory version, starting from last. It returns the last
+// recomputed position.
+func replayPositions(ctx context.Context, ex execer, version int, model LocomotionModel, arena *arena, last position) (position, error) {
+	const batchSize = 1000
+
+	const selectQ = /* sql */ `
+		SELECT ` + positionColumns + `
+		FROM positions
+		WHERE ` + chainKey + ` > (?, ?, ?)
+		ORDER BY ` + chainOrder + `
+		LIMIT ?;
+	`
+
+	const insertQ = /* sql */ `
+		INSERT OR REPLACE INTO trajectory_points
+			(version, id, x, y, direction, collision, model, model_version,
+			step_length, heading_change, speed, angular_velocity, path_length, displacement)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return position{}, err
+		}
+
+		rows, err := ex.Query(selectQ, append(last.chainKey(), batchSize)...)
+		if err != nil {
+			return position{}, fmt.Errorf("error fetching positions to replay: %w", err)
+		}
+		ps, err := scanPositions(rows)
+		rows.Close()
+		if err != nil {
+			return position{}, err
+		}
+		if len(ps) == 0 {
+			return last, nil
+		}
+
+		for _, p := range ps {
+			if p.LeftMuscle == nil || p.RightMuscle == nil {
+				return position{}, fmt.Errorf("position %d: %w", p.ID, errMissingMuscles)
+			}
+
+			np := updatePosition(model, arena, p.contractData(), last)
+			np.ID = p.ID
+
+			args := []any{version, np.ID, np.X, np.Y, np.Direction, np.Collision, np.Model, np.ModelVersion}
+			if _, err := ex.Exec(insertQ, append(args, kinematicsArgs(np.Kinematics)...)...); err != nil {
+				return position{}, fmt.Errorf("error saving trajectory point: %w", err)
+			}
+			last = np
+		}
+	}
+}
+
+// buildTrajectory replays every stored position through the model in batches
+// so that the positions table stays available to the fetcher and the API. The
+// positions are read on the reader pool, leaving the writer free for ingestion
+// between the inserts. When older positions were rolled up the replay starts
+// from the last of them, as it was stored.
+func (db *dbManager) buildTrajectory(ctx context.Context, version int, model LocomotionModel, arena *arena) (position, error) {
+	start, err := lastRolledUp(db.reader)
+	if err != nil {
+		return position{}, err
+	}
+
+	return replayPositions(ctx, readWrite{read: db.reader, write: db.writer}, version, model, arena, start)
+}
+
+// readWrite is an execer running queries on one pool and statements on
+// another.
+type readWrite struct {
+	read, write execer
+}
+
+func (rw readWrite) Exec(q string, args ...any) (sql.Result, error) {
+	return rw.write.Exec(q, args...)
+}
+
+func (rw readWrite) Query(q string, args ...any) (*sql.Rows, error) {
+	return rw.read.Query(q, args...)
+}
+
+func (rw readWrite) QueryRow(q string, args ...any) *sql.Row {
+	return rw.read.QueryRow(q, args...)
+}
+
+// activateTrajectory catches a built trajectory up with positions that arrived
+// after it was built and swaps it into the positions table. The previously
+// active trajectory is archived into trajectory_points. Everything happens in a
+// single transaction so readers see either the old or the new trajectory. It
+// returns the new latest position.
+func (db *dbManager) activateTrajectory(ctx context.Context, version int, model LocomotionModel, arena *arena, last position) (position, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return position{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow(`SELECT status FROM trajectories WHERE version = ?;`, version).Scan(&status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return position{}, errTrajectoryNotFound
+		}
+		return position{}, fmt.Errorf("error getting trajectory status: %w", err)
+	}
+	if status != trajectoryBuilding {
+		return position{}, fmt.Errorf("trajectory %d is %s: %w", version, status, errTrajectoryNotBuilding)
+	}
+
+	if _, err := replayPositions(ctx, tx, version, model, arena, last); err != nil {
+		return position{}, err
+	}
+
+	archive := /* sql */ `
+		INSERT INTO trajectory_points
+			(version, id, x, y, direction, collision, model, model_version,
+			step_length, heading_change, speed, angular_velocity, path_length, displacement)
+		SELECT
+			(SELECT version FROM trajectories WHERE status = 'active'),
+			id, x, y, direction, collision, model, model_version,
+			step_length, heading_change, speed, angular_velocity, path_length, displacement
+		FROM positions;
+	`
+	if _, err := tx.Exec(archive); err != nil {
+		return position{}, fmt.Errorf("error archiving active trajectory: %w", err)
+	}
+
+	swap := /* sql */ `
+		UPDATE positions
+		SET
+			x = t.x,
+			y = t.y,
+			direction = t.direction,
+			collision = t.collision,
+			model = t.model,
+			model_version = t.model_version,
+			step_length = t.step_length,
+			heading_change = t.heading_change,
+			speed = t.speed,
+			angular_velocity = t.angular_velocity,
+			path_length = t.path_length,
+			displacement = t.displacement
+		FROM trajectory_points AS t
+		WHERE t.version = ? AND t.id = positions.id;
+	`
+	if _, err := tx.Exec(swap, version); err != nil {
+		return position{}, fmt.Errorf("error swapping in trajectory: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM trajectory_points WHERE version = ?;`, version); err != nil {
+		return position{}, fmt.Errorf("error deleting swapped in trajectory points: %w", err)
+	}
+
+	statuses := /* sql */ `
+		UPDATE trajectories
+		SET
+			status = CASE WHEN version = ?1 THEN 'active' ELSE 'archived' END,
+			activated_at = CASE WHEN version = ?1 THEN ?2 ELSE activated_at END
+		WHERE version = ?1 OR status = 'active';
+	`
+	if _, err := tx.Exec(statuses, version, time.Now().UTC()); err != nil {
+		return position{}, fmt.Errorf("error updating trajectory statuses: %w", err)
+	}
+
+	if err := db.rebuildDerivations(tx); err != nil {
+		return position{}, err
+	}
+
+	latest, err := scanPosition(tx.QueryRow(`SELECT ` + positionColumns + ` FROM positions ORDER BY ` + chainOrderDesc + ` LIMIT 1;`))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return position{}, fmt.Errorf("error getting latest position: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return position{}, fmt.Errorf("error committing trajectory switch: %w", err)
+	}
+
+	return latest, nil
+}
+
+// positionsSource returns a FROM clause that reads a trajectory version with
+// the same columns as the positions table, along with its arguments. The active
+// trajectory is read straight from positions.
+func (db *dbManager) positionsSource(version int) (string, []any, error) {
+	if version == 0 {
+		return "positions", nil, nil
+	}
+
+	t, err := db.getTrajectory(version)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.Status == trajectoryActive {
+		return "positions", nil, nil
+	}
+
+	const source = /* sql */ `(
+		SELECT
+			p.id, p.blck, p.log_index, p.transaction_hash, t.x, t.y, t.direction, p.price, p.ts,
+			t.model, t.model_version, t.collision, p.left_muscle, p.right_muscle,
+			t.step_length, t.heading_change, t.speed, t.angular_velocity, t.path_length,
+			t.displacement, NULL AS behaviour, p.anomalies
+		FROM trajectory_points AS t
+		JOIN positions AS p ON p.id = t.id
+		WHERE t.version = ?
+	) AS positions`
+
+	return source, []any{version}, nil
+}
+
+// trajectorySwitch asks the worm loop to activate a built trajectory. The loop
+// owns the latest position so it has to be the one swapping it out.
+type trajectorySwitch struct {
+	version int
+	model   LocomotionModel
+	last    position
+	done    chan error
+}
+
+// recomputer rebuilds the trajectory from the stored muscle inputs, one
+// recomputation at a time.
+type recomputer struct {
+	log      *zap.Logger
+	db       *dbManager
+	cfg      LocomotionConfig // the configured locomotion model
+	arena    *arena
+	switchCh chan trajectorySwitch
+
+	mu      sync.Mutex
+	running bool
+}
+
+// NewRecomputer returns the recomputer of the store's trajectories, nil when
+// the store doesn't keep trajectories.
+func NewRecomputer(log *zap.Logger, store Store, cfg LocomotionConfig, arena *arena) *recomputer {
+	db, ok := store.(*dbManager)
+	if !ok {
+		return nil
+	}
+	return &recomputer{
+		log:      log,
+		db:       db,
+		cfg:      cfg.normalized(),
+		arena:    arena,
+		switchCh: make(chan trajectorySwitch),
+	}
+}
+
+// prepare validates a recomputation request and creates its trajectory. An
+// empty model recomputes with the configured one.
+func (rc *recomputer) prepare(cfg LocomotionConfig, activate bool) (trajectory, LocomotionModel, error) {
+	if cfg.Model == "" {
+		cfg = rc.cfg
+	}
+	cfg = cfg.normalized()
+
+	if activate && cfg != rc.cfg {
+		return trajectory{}, nil, errModelNotConfigured
+	}
+
+	model, err := NewLocomotionModel(cfg)
+	if err != nil {
+		return trajectory{}, nil, err
+	}
+
+	missing, err := rc.db.countPositionsMissingMuscles()
+	if err != nil {
+		return trajectory{}, nil, err
+	}
+	if missing > 0 {
+		return trajectory{}, nil, fmt.Errorf("%d %w", missing, errMissingMuscles)
+	}
+
+	t, err := rc.db.createTrajectory(model, trajectoryParams{Locomotion: cfg, Arena: rc.arena.cfg})
+	if err != nil {
+		return trajectory{}, nil, err
+	}
+
+	return t, model, nil
+}
+
+// pause keeps recomputations from starting until resume, for changes to the
+// positions a build would read halfway through. It fails when one is running.
+func (rc *recomputer) pause() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.running {
+		return false
+	}
+	rc.running = true
+	return true
+}
+
+func (rc *recomputer) resume() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.running = false
+}
+
+// Start recomputes the trajectory in the background and returns the new
+// trajectory version straight away. When activate is set the new version is
+// handed to the worm loop to become the active trajectory once it's built.
+func (rc *recomputer) Start(cfg LocomotionConfig, activate bool) (trajectory, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.running {
+		return trajectory{}, errRecomputeRunning
+	}
+
+	t, model, err := rc.prepare(cfg, activate)
+	if err != nil {
+		return trajectory{}, err
+	}
+	rc.running = true
+
+	go func() {
+		defer func() {
+			rc.mu.Lock()
+			rc.running = false
+			rc.mu.Unlock()
+		}()
+
+		err := rc.run(context.Background(), t.Version, model, activate, func(sw trajectorySwitch) error {
+			rc.switchCh <- sw
+			return <-sw.done
+		})
+		if err != nil {
+			rc.log.Error("error recomputing trajectory", zap.Int("version", t.Version), zap.Error(err))
+		}
+	}()
+
+	return t, nil
+}
+
+// Recompute recomputes the trajectory in the foreground, activating it
+// directly. It must only be used while the worm loop isn't running.
+func (rc *recomputer) Recompute(ctx context.Context, cfg LocomotionConfig, activate bool) (trajectory, error) {
+	t, model, err := rc.prepare(cfg, activate)
+	if err != nil {
+		return trajectory{}, err
+	}
+
+	err = rc.run(ctx, t.Version, model, activate, func(sw trajectorySwitch) error {
+		_, err := rc.db.activateTrajectory(ctx, sw.version, sw.model, rc.arena, sw.last)
+		return err
+	})
+	if err != nil {
+		return trajectory{}, err
+	}
+
+	return rc.db.getTrajectory(t.Version)
+}
+
+func (rc *recomputer) run(ctx context.Context, version int, model LocomotionModel, activate bool, switchFn func(trajectorySwitch) error) error {
+	log := rc.log.With(zap.Int("version", version), zap.String("model", model.Name()))
+	log.Info("recomputing trajectory")
+
+	fail := func(err error) error {
+		if serr := rc.db.setTrajectoryStatus(version, trajectoryFailed, err.Error()); serr != nil {
+			log.Error("error marking trajectory as failed", zap.Error(serr))
+		}
+		return err
+	}
+
+	last, err := rc.db.buildTrajectory(ctx, version, model, rc.arena)
+	if err != nil {
+		return fail(err)
+	}
+	log.Info("trajectory built", zap.Int("last_id", last.ID))
+
+	if !activate {
+		if err := rc.db.setTrajectoryStatus(version, trajectoryReady, ""); err != nil {
+			return fail(err)
+		}
+		return nil
+	}
+
+	if err := switchFn(trajectorySwitch{version: version, model: model, last: last, done: make(chan error, 1)}); err != nil {
+		return fail(err)
+	}
+	log.Info("trajectory activated")
+
+	return nil
+}
@@ -1,7 +1,7 @@
 package src
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -9,15 +9,79 @@ import (
 	"go.uber.org/zap"
 )
 
-func Run(log *zap.Logger, fetcher *blockFetcher, db *dbManager) error {
-	valueCh := make(chan contractData, 10)
-	blockCh := make(chan int)
+// WormDeps are what Run ingests the contract updates with. Trajectories,
+// imports, repairs and retention are only supported by the SQLite store, the
+// recomputer, importer, repairer and retention are nil with any other or when
+// they're disabled.
+type WormDeps struct {
+	Fetcher    *blockFetcher
+	Store      Store
+	Model      LocomotionModel
+	Arena      *arena
+	Detector   *anomalyDetector
+	Recomputer *recomputer
+	Importer   *importer
+	Repairer   *repairer
+	Retention  *retention
+}
+
+// Run ingests the contract updates into the store.
+func Run(log *zap.Logger, deps WormDeps) error {
+	fetcher, store, model, arena, detector := deps.Fetcher, deps.Store, deps.Model, deps.Arena, deps.Detector
+	rc, imp, rp, rt := deps.Recomputer, deps.Importer, deps.Repairer, deps.Retention
 
-	p, err := db.getLatestPosition()
+	rangeCh := make(chan fetchedRange)
+	restartCh := make(chan struct{}, 1) // restarts the fetcher from the latest block recorded
+
+	p, err := store.LatestPosition()
 	if err != nil {
 		return fmt.Errorf("error getting latest position: %w", err)
 	}
 
+	if err := detector.prime(store); err != nil {
+		return err
+	}
+
+	log.Info(
+		"using locomotion model",
+		zap.String("model", model.Name()),
+		zap.Int("version", model.Version()),
+	)
+	log.Info(
+		"using arena",
+		zap.String("shape", arena.cfg.Shape),
+		zap.String("boundary", arena.cfg.Boundary),
+	)
+
+	// An empty trajectory takes on the configured model and arena, otherwise
+	// warn when they no longer match the trajectory being extended. Only the
+	// SQLite store keeps trajectories, the others start empty.
+	if rc != nil {
+		params := trajectoryParams{Locomotion: model.Config(), Arena: arena.cfg}
+		if p.ID == 0 {
+			if err := describeActiveTrajectory(rc.db.writer, model, params); err != nil {
+				return err
+			}
+		} else {
+			active, err := rc.db.getActiveTrajectory()
+			if err != nil {
+				return err
+			}
+			built, err := active.params()
+			if err != nil {
+				return err
+			}
+			if built != params || active.ModelVersion != model.Version() {
+				log.Warn(
+					"configured locomotion model or arena differs from the active trajectory, recompute it to apply them to the whole history",
+					zap.String("trajectory_model", active.Model),
+					zap.Int("trajectory_model_version", active.ModelVersion),
+					zap.Any("trajectory_params", built),
+				)
+			}
+		}
+	}
+
 	if dryRun := os.Getenv("DRY_RUN"); dryRun == "true" {
 		log.Info("starting fetcher in dry-run mode")
 
@@ -28,7 +92,8 @@ func Run(log *zap.Logger, fetcher *blockFetcher, db *dbManager) error {
 					log.Error("error fetching contract data", zap.Error(err))
 					return
 				}
-				valueCh <- cd
+				// dry runs don't record block ranges
+				rangeCh <- fetchedRange{updates: []contractData{cd}}
 				time.Sleep(5 * time.Second)
 			}
 		}()
@@ -36,18 +101,43 @@ func Run(log *zap.Logger, fetcher *blockFetcher, db *dbManager) error {
 	} else {
 		log.Info("starting fetcher in live mode")
 
+		// recover the muscle inputs of positions stored before they were
+		// recorded, this only needs the chain so it runs alongside the fetcher
+		if db, ok := store.(*dbManager); ok {
+			go func() {
+				if err := backfillMuscles(context.Background(), log, fetcher, db); err != nil {
+					log.Error("error backfilling muscles", zap.Error(err))
+				}
+			}()
+		}
+
 		// run the fetcher in a goroutine but if it returns nil start it again
 		// after a 1 minute sleep this is to handle the case where the latest
 		// checked block is the current block
 		go func() {
 			for {
-				latestBlock, err := db.getLatestBlockChecked()
+				checkpoint, err := store.LatestCheckpoint()
 				if err != nil {
 					log.Error("error getting latest block checked", zap.Error(err))
 					return
 				}
 
-				if err = fetcher.fetch(valueCh, blockCh, latestBlock); err != nil {
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					select {
+					case <-restartCh:
+						cancel()
+					case <-ctx.Done():
+					}
+				}()
+				err = fetcher.fetch(ctx, rangeCh, checkpoint)
+				restarted := ctx.Err() != nil
+				cancel()
+
+				if restarted {
+					log.Info("restarting fetcher from the latest block checked")
+					continue
+				} else if err != nil {
 					log.Error("fetcher error", zap.Error(err))
 				} else {
 					log.Info("fetcher returned, sleeping for 20 seconds")
@@ -57,39 +147,147 @@ func Run(log *zap.Logger, fetcher *blockFetcher, db *dbManager) error {
 		}()
 	}
 
-	for {
-		select {
-		case block, ok := <-blockCh:
-			if !ok {
-				return fmt.Errorf("block channel closed")
+	// without trajectories there is nothing to switch to, receiving from a nil
+	// channel blocks forever
+	var switchCh chan trajectorySwitch
+	if rc != nil {
+		switchCh = rc.switchCh
+	}
+	var importCh chan importJob
+	if imp != nil {
+		importCh = imp.jobs
+	}
+	var repairCh chan repairJob
+	if rp != nil {
+		repairCh = rp.jobs
+	}
+	var compactCh chan compactJob
+	if rt != nil {
+		compactCh = rt.jobs
+	}
+
+	// after an import, what the fetcher sent from before the imported
+	// checkpoint is already stored
+	resumeFrom := 0
+
+	// ingest moves the worm on with an update and stores the new position
+	ingest := func(cd contractData) error {
+		if cd.block < resumeFrom {
+			return nil
+		}
+		// A range fetched again, when the fetcher stopped before it was
+		// recorded, holds updates that are already stored
+		if cd.transactionHash != "" {
+			stored, err := store.HasUpdate(cd.transactionHash, cd.logIndex)
+			if err != nil {
+				return fmt.Errorf("error checking for stored update: %w", err)
 			}
+			if stored {
+				log.Info("update already stored, skipping", zap.Int("block", cd.block), zap.String("transaction_hash", cd.transactionHash))
+				return nil
+			}
+		}
 
-			log.Info("new block tracked", zap.Int("block", block))
+		log.Info(
+			"received contract data",
+			zap.Int("block", cd.block),
+			zap.Int64("left_muscle", cd.leftMuscle),
+			zap.Int64("right_muscle", cd.rightMuscle),
+			zap.Float64("price", cd.price),
+			zap.Time("ts", cd.ts),
+		)
 
-			if err := db.saveBlockChecked(block); err != nil {
-				if errors.Is(err, errUniqueConstraintViolation) {
-					log.Info("block already checked", zap.Int("block", block))
-					continue
+		np := updatePosition(model, arena, cd, p)
+		np.Anomalies = detector.check(np)
+		if len(np.Anomalies) > 0 {
+			log.Warn(
+				"anomalous contract data",
+				zap.Int("block", cd.block),
+				zap.Strings("anomalies", np.Anomalies),
+			)
+		}
+
+		saved, err := store.SavePosition(np)
+		if err != nil {
+			return fmt.Errorf("error saving position: %w", err)
+		}
+		p = saved
+		countAnomalies(p.Anomalies)
+		return nil
+	}
+
+	for {
+		select {
+		case job := <-importCh:
+			result, latest, err := imp.run(job.ctx, job.r, job.opts)
+			if err == nil {
+				p, resumeFrom = latest, result.Checkpoint
+				if err := detector.prime(store); err != nil {
+					log.Error("error priming anomaly detector with the imported positions", zap.Error(err))
+				}
+				select {
+				case restartCh <- struct{}{}:
+				default:
+				}
+				log.Info(
+					"positions imported",
+					zap.Int("positions", result.Positions),
+					zap.Int("checkpoint", result.Checkpoint),
+				)
+			}
+			job.done <- importDone{result: result, err: err}
+		case job := <-repairCh:
+			// a recomputation's replay may already be past the recovered updates
+			if rc != nil && !rc.pause() {
+				job.done <- repairDone{err: errRecomputeRunning}
+				continue
+			}
+			latest, recovered, err := rp.db.applyRepair(job.ctx, job.r, job.cds, model, arena, rp.anomalies)
+			if rc != nil {
+				rc.resume()
+			}
+			if err == nil && recovered > 0 {
+				p = latest
+				detector.reset()
+				if err := detector.prime(store); err != nil {
+					log.Error("error priming anomaly detector with the repaired positions", zap.Error(err))
 				}
-				return fmt.Errorf("error saving block: %w", err)
 			}
-		case contractVal, ok := <-valueCh:
+			job.done <- repairDone{recovered: recovered, err: err}
+		case job := <-compactCh:
+			// the latest position is never rolled up, the worm moves on from it
+			job.done <- rt.compactPaused(job.ctx, job.now, rc)
+		case sw := <-switchCh:
+			latest, err := rc.db.activateTrajectory(context.Background(), sw.version, sw.model, arena, sw.last)
+			if err == nil {
+				p, model = latest, sw.model
+			}
+			sw.done <- err
+		case r, ok := <-rangeCh:
 			if !ok {
-				return fmt.Errorf("contract data channel closed")
+				return fmt.Errorf("block range channel closed")
+			}
+
+			// The range is only recorded once its updates are stored, a range
+			// cut short is fetched again
+			for _, cd := range r.updates {
+				if err := ingest(cd); err != nil {
+					return err
+				}
 			}
 
+			if r.Status == "" || r.To < resumeFrom {
+				continue
+			}
 			log.Info(
-				"received contract data",
-				zap.Int("block", contractVal.block),
-				zap.Int64("left_muscle", contractVal.leftMuscle),
-				zap.Int64("right_muscle", contractVal.rightMuscle),
-				zap.Float64("price", contractVal.price),
-				zap.Time("ts", contractVal.ts),
+				"block range recorded",
+				zap.Int("from", r.From),
+				zap.Int("to", r.To),
+				zap.String("status", r.Status),
 			)
 
-			p = updatePosition(contractVal, p)
-			if err := db.savePosition(p); err != nil {
-				return fmt.Errorf("error saving position: %w", err)
+			if err := store.RecordBlockRange(r.blockRange); err != nil {
+				return fmt.Errorf("error recording block range: %w", err)
 			}
 		}
 	}